@@ -30,6 +30,7 @@ import (
 	"github.com/thkukuk/kubic-control/pkg/certificate_server"
 	"github.com/thkukuk/kubic-control/pkg/deployment"
 	"github.com/thkukuk/kubic-control/pkg/kubeadm"
+	"github.com/thkukuk/kubic-control/pkg/tools"
 	"github.com/thkukuk/kubic-control/pkg/yomi"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -46,6 +47,11 @@ var (
 	crtFile      = "/etc/kubicd/pki/KubicD.crt"
 	keyFile      = "/etc/kubicd/pki/KubicD.key"
 	caFile       = "/etc/kubicd/pki/Kubic-Control-CA.crt"
+	nodeExecutor = "salt"
+	executor     tools.NodeExecutor
+	retryPolicy  = tools.DefaultRetryPolicy()
+	snapshots    = kubeadm.DefaultSnapshotConfig()
+	minMasters   = 1
 	cfg, cfg_err = ini.LooseLoad("/usr/etc/kubicd/kubicd.conf", "/etc/kubicd/kubicd.conf")
 )
 
@@ -53,43 +59,135 @@ type kubeadm_server struct{}
 type deploy_server struct{}
 type cert_server struct{}
 type yomi_server struct{}
+type etcd_server struct{}
+
+// policyContext returns the context of a request with the retry policy
+// from kubicd.conf and the overrides of the request.
+func policyContext(ctx context.Context, overrides []string) (context.Context, error) {
+	policy := retryPolicy.Copy()
+	if err := policy.Parse(overrides); err != nil {
+		return ctx, err
+	}
+	return tools.WithRetryPolicy(ctx, policy), nil
+}
 
 // kubeadm API
 func (s *kubeadm_server) InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	log.Infof("Received: Init Master")
-	return kubeadm.InitMaster(in, stream)
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.InitMaster(ctx, executor, in, stream)
 }
 
 func (s *kubeadm_server) DestroyMaster(in *pb.Empty, stream pb.Kubeadm_DestroyMasterServer) error {
 	log.Infof("Received: Destroy Master")
-	return kubeadm.DestroyMaster(in, stream)
+	return kubeadm.DestroyMaster(stream.Context(), executor, in, stream)
 }
 
 func (s *kubeadm_server) UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer) error {
 	log.Infof("Received: upgrade Kubernetes")
-	return kubeadm.UpgradeKubernetes(in, stream)
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.UpgradeKubernetes(ctx, executor, snapshots, in, stream)
+}
+
+func (s *kubeadm_server) ResumeUpgrade(in *pb.ResumeUpgradeRequest, stream pb.Kubeadm_ResumeUpgradeServer) error {
+	log.Infof("Received: resume upgrade")
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.ResumeUpgrade(ctx, executor, snapshots, in, stream)
+}
+
+func (s *kubeadm_server) UpgradeStatus(ctx context.Context, in *pb.Empty) (*pb.UpgradeStatusReply, error) {
+	log.Infof("Received: upgrade status")
+	return kubeadm.UpgradeStatus(), nil
+}
+
+func (s *kubeadm_server) PlanUpgrade(ctx context.Context, in *pb.PlanUpgradeRequest) (*pb.UpgradePlanReply, error) {
+	log.Infof("Received: plan upgrade")
+	return kubeadm.PlanUpgrade(ctx, executor, in), nil
 }
 
 func (s *kubeadm_server) RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) error {
 	log.Printf("Received: remove node  %v", in.NodeNames)
-	return kubeadm.RemoveNode(in, stream)
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.RemoveNode(ctx, executor, minMasters, in, stream)
 }
 
 func (s *kubeadm_server) AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 	log.Printf("Received: add node  %v", in.NodeNames)
-	return kubeadm.AddNode(in, stream)
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.AddNode(ctx, executor, in, stream)
 }
 
-func (s *kubeadm_server) RebootNode(ctx context.Context, in *pb.RebootNodeRequest) (*pb.StatusReply, error) {
+func (s *kubeadm_server) RebootNode(in *pb.RebootNodeRequest, stream pb.Kubeadm_RebootNodeServer) error {
 	log.Printf("Received: reboot node  %v", in.NodeNames)
-	status, message := kubeadm.RebootNode(in.NodeNames)
+	ctx, err := policyContext(stream.Context(), in.Policy)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.RebootNode(ctx, executor, minMasters, in, stream)
+}
+
+func (s *kubeadm_server) SetNodeLabels(ctx context.Context, in *pb.NodeLabelsRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: set labels of node %v", in.NodeName)
+	requestExecutor, plan := tools.DryRunPlan(executor, in.DryRun)
+	status, message := kubeadm.SetNodeLabels(ctx, requestExecutor, in)
+	if in.DryRun && status == true {
+		message = plan()
+	}
 	return &pb.StatusReply{Success: status, Message: message}, nil
 }
 
+func (s *kubeadm_server) SetNodeTaints(ctx context.Context, in *pb.NodeTaintsRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: set taints of node %v", in.NodeName)
+	requestExecutor, plan := tools.DryRunPlan(executor, in.DryRun)
+	status, message := kubeadm.SetNodeTaints(ctx, requestExecutor, in)
+	if in.DryRun && status == true {
+		message = plan()
+	}
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *kubeadm_server) CordonNode(in *pb.CordonRequest, stream pb.Kubeadm_CordonNodeServer) error {
+	log.Printf("Received: cordon node %v", in.NodeNames)
+	return kubeadm.CordonNode(stream.Context(), executor, in, stream)
+}
+
+func (s *kubeadm_server) UncordonNode(in *pb.CordonRequest, stream pb.Kubeadm_UncordonNodeServer) error {
+	log.Printf("Received: uncordon node %v", in.NodeNames)
+	return kubeadm.UncordonNode(stream.Context(), executor, in, stream)
+}
+
+func (s *kubeadm_server) MaintenanceNode(in *pb.MaintenanceRequest, stream pb.Kubeadm_MaintenanceNodeServer) error {
+	log.Printf("Received: maintenance of node %v: %v", in.NodeNames, in.Enable)
+	overrides := in.Policy
+	if len(in.Timeout) > 0 {
+		overrides = append(overrides, tools.StepDrain+".timeout="+in.Timeout)
+	}
+	ctx, err := policyContext(stream.Context(), overrides)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	return kubeadm.MaintenanceNode(ctx, executor, in, stream)
+}
+
 func (s *kubeadm_server) ListNodes(ctx context.Context, in *pb.Empty) (*pb.ListReply, error) {
 	log.Printf("Received: list nodes")
-	status, message, nodes := kubeadm.ListNodes()
-	return &pb.ListReply{Success: status, Message: message, Node: nodes}, nil
+	status, message, workers, nodes := kubeadm.ListNodes(ctx, executor)
+	return &pb.ListReply{Success: status, Message: message, Node: workers, Nodes: nodes}, nil
 }
 
 func (s *kubeadm_server) FetchKubeconfig(ctx context.Context, in *pb.Empty) (*pb.StatusReply, error) {
@@ -100,7 +198,12 @@ func (s *kubeadm_server) FetchKubeconfig(ctx context.Context, in *pb.Empty) (*pb
 
 func (s *kubeadm_server) GetStatus(in *pb.Empty, stream pb.Kubeadm_GetStatusServer) error {
 	log.Print("Received: GetStatus")
-	return kubeadm.GetStatus(in, stream, Version)
+	return kubeadm.GetStatus(stream.Context(), executor, in, stream, Version)
+}
+
+func (s *kubeadm_server) CheckHealth(in *pb.Empty, stream pb.Kubeadm_CheckHealthServer) error {
+	log.Print("Received: CheckHealth")
+	return kubeadm.CheckHealth(stream.Context(), executor, in, stream)
 }
 
 // Certificate API
@@ -113,19 +216,66 @@ func (s *cert_server) CreateCert(ctx context.Context, in *pb.CreateCertRequest)
 // Deploy API
 func (s *deploy_server) DeployKustomize(ctx context.Context, in *pb.DeployKustomizeRequest) (*pb.StatusReply, error) {
 	log.Printf("Received: deploy kustomized service %s", in.Service)
-	status, message := deployment.DeployKustomize(in.Service, in.Argument)
+	requestExecutor, plan := tools.DryRunPlan(executor, in.DryRun)
+	status, message := deployment.DeployKustomize(ctx, requestExecutor, in.Service, in.Argument)
+	if in.DryRun && status == true {
+		message = plan()
+	}
 	return &pb.StatusReply{Success: status, Message: message}, nil
 }
 
+// Etcd API
+func (s *etcd_server) Snapshot(in *pb.SnapshotRequest, stream pb.Etcd_SnapshotServer) error {
+	log.Infof("Received: etcd snapshot %s", in.Name)
+	return kubeadm.EtcdSnapshot(stream.Context(), executor, snapshots, in, stream)
+}
+
+func (s *etcd_server) ListSnapshots(ctx context.Context, in *pb.Empty) (*pb.SnapshotListReply, error) {
+	log.Printf("Received: list etcd snapshots")
+	status, message, list := kubeadm.ListSnapshots()
+	return &pb.SnapshotListReply{Success: status, Message: message, Snapshots: list}, nil
+}
+
+func (s *etcd_server) Restore(in *pb.RestoreRequest, stream pb.Etcd_RestoreServer) error {
+	log.Infof("Received: etcd restore of snapshot %s", in.Name)
+	return kubeadm.EtcdRestore(stream.Context(), executor, in, stream)
+}
+
+func (s *etcd_server) ListMembers(ctx context.Context, in *pb.Empty) (*pb.MemberListReply, error) {
+	log.Printf("Received: list etcd members")
+	status, message, list := kubeadm.ListEtcdMembers(ctx, executor)
+	return &pb.MemberListReply{Success: status, Message: message, Members: list}, nil
+}
+
+func (s *etcd_server) RemoveMember(ctx context.Context, in *pb.RemoveMemberRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: remove etcd member %s", in.Member)
+	requestExecutor, plan := tools.DryRunPlan(executor, in.DryRun)
+	status, message := kubeadm.RemoveEtcdMember(ctx, requestExecutor, in)
+	if in.DryRun && status == true {
+		message = plan()
+	}
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *etcd_server) Health(in *pb.Empty, stream pb.Etcd_HealthServer) error {
+	log.Infof("Received: etcd health")
+	return kubeadm.EtcdHealth(stream.Context(), executor, stream)
+}
+
+func (s *etcd_server) Maintain(in *pb.MaintainRequest, stream pb.Etcd_MaintainServer) error {
+	log.Infof("Received: etcd maintenance")
+	return kubeadm.EtcdMaintain(stream.Context(), executor, in, stream)
+}
+
 // Yomi API
 func (s *yomi_server) PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServer) error {
 	log.Infof("Received: PrepareConfig of %s for Node %s", in.Saltnode, in.Type)
-	return yomi.PrepareConfig(in, stream)
+	return yomi.PrepareConfig(stream.Context(), executor, in, stream)
 }
 
 func (s *yomi_server) Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 	log.Infof("Received: Install Node %s", in.Saltnode)
-	return yomi.Install(in, stream)
+	return yomi.Install(stream.Context(), executor, in, stream)
 }
 
 func rbacCheck(user string, function string) bool {
@@ -133,7 +283,7 @@ func rbacCheck(user string, function string) bool {
 	rbac, rbac_err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
 
 	if rbac_err != nil {
-		log.Error("Error opening rbac config file: %v", rbac_err)
+		log.Errorf("Error opening rbac config file: %v", rbac_err)
 		return false
 	}
 
@@ -179,6 +329,8 @@ func AuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.Unary
 	// Calls the handler
 	h, err := handler(ctx, req)
 
+	redactReply(info.FullMethod, h)
+
 	log.Infof("Function: %s, Caller: %s, Duration: %s, Error: %v",
 		info.FullMethod,
 		tlsAuth.State.VerifiedChains[0][0].Subject.CommonName,
@@ -208,7 +360,7 @@ func AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.Str
 
 	start := time.Now()
 	// Calls the handler
-	err := handler(srv, ss)
+	err := handler(srv, &redactStream{ss})
 
 	log.Infof("Function: %s, Caller: %s, Duration: %s, Error: %v",
 		info.FullMethod,
@@ -218,6 +370,26 @@ func AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.Str
 	return err
 }
 
+// redactReply masks secrets in the reply of an unary call
+func redactReply(method string, h interface{}) {
+	// FetchKubeconfig has to return the real credentials
+	if reply, ok := h.(*pb.StatusReply); ok && method != "/api.Kubeadm/FetchKubeconfig" {
+		reply.Message = tools.Redact(reply.Message)
+	}
+}
+
+// redactStream masks secrets in all status messages sent to the client
+type redactStream struct {
+	grpc.ServerStream
+}
+
+func (s *redactStream) SendMsg(m interface{}) error {
+	if reply, ok := m.(*pb.StatusReply); ok {
+		reply.Message = tools.Redact(reply.Message)
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
 func loadConfigFile() {
 	if cfg_err, ok := cfg_err.(*os.PathError); ok {
 		log.Fatal(cfg_err)
@@ -238,6 +410,87 @@ func loadConfigFile() {
 	if cfg.Section("global").HasKey("port") {
 		port = cfg.Section("global").Key("port").String()
 	}
+	if cfg.Section("global").HasKey("executor") {
+		nodeExecutor = cfg.Section("global").Key("executor").String()
+	}
+	if cfg.Section("global").HasKey("min_masters") {
+		value, err := cfg.Section("global").Key("min_masters").Int()
+		if err != nil || value < 0 {
+			log.Fatalf("Invalid min_masters in kubicd.conf: %s", cfg.Section("global").Key("min_masters").String())
+		}
+		minMasters = value
+	}
+}
+
+// loadRetryPolicy reads the "step.key = value" entries of the
+// [policy] section
+func loadRetryPolicy() {
+	for _, key := range cfg.Section("policy").Keys() {
+		if err := retryPolicy.Parse([]string{key.Name() + "=" + key.String()}); err != nil {
+			log.Fatalf("Invalid policy in kubicd.conf: %v", err)
+		}
+	}
+}
+
+// loadSnapshotConfig reads the [etcd] section
+func loadSnapshotConfig() {
+	section := cfg.Section("etcd")
+
+	if section.HasKey("snapshot_dir") {
+		snapshots.Dir = section.Key("snapshot_dir").String()
+	}
+	if section.HasKey("snapshot_keep") {
+		keep, err := section.Key("snapshot_keep").Int()
+		if err != nil || keep < 0 {
+			log.Fatalf("Invalid snapshot_keep in kubicd.conf: %s", section.Key("snapshot_keep").String())
+		}
+		snapshots.Keep = keep
+	}
+	if section.HasKey("snapshot_max_age") {
+		maxAge, err := time.ParseDuration(section.Key("snapshot_max_age").String())
+		if err != nil || maxAge < 0 {
+			log.Fatalf("Invalid snapshot_max_age in kubicd.conf: %s", section.Key("snapshot_max_age").String())
+		}
+		snapshots.MaxAge = maxAge
+	}
+}
+
+func createSaltAPIExecutor() tools.NodeExecutor {
+	section := cfg.Section("salt-api")
+
+	if !section.HasKey("url") {
+		log.Fatal("salt-api executor selected, but no url configured")
+	}
+	saltapi := tools.NewSaltAPIExecutor(section.Key("url").String(),
+		section.Key("username").String(),
+		section.Key("password").String(),
+		section.Key("eauth").String())
+	if section.HasKey("cafile") {
+		if err := saltapi.SetCAFile(section.Key("cafile").String()); err != nil {
+			log.Fatalf("Could not load salt-api CA: %v", err)
+		}
+	}
+	if section.HasKey("timeout") {
+		timeout, err := time.ParseDuration(section.Key("timeout").String())
+		if err != nil {
+			log.Fatalf("Invalid salt-api timeout: %v", err)
+		}
+		saltapi.Timeout = timeout
+	}
+	return saltapi
+}
+
+func createExecutor() tools.NodeExecutor {
+	switch nodeExecutor {
+	case "salt":
+		return tools.NewSaltExecutor()
+	case "salt-api":
+		return createSaltAPIExecutor()
+	case "local":
+		return tools.NewLocalExecutor()
+	}
+	log.Fatalf("Unknown executor '%s', valid values are 'salt', 'salt-api' or 'local'", nodeExecutor)
+	return nil
 }
 
 func main() {
@@ -256,6 +509,7 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&crtFile, "crtfile", crtFile, "Certificate with the public key for the daemon")
 	rootCmd.PersistentFlags().StringVar(&keyFile, "keyfile", keyFile, "Private key for the daemon")
 	rootCmd.PersistentFlags().StringVar(&caFile, "cafile", caFile, "Certificate with the public key of the CA for the server certificate")
+	rootCmd.PersistentFlags().StringVar(&nodeExecutor, "executor", nodeExecutor, "How to execute commands on the nodes: 'salt', 'salt-api' or 'local'")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -263,6 +517,7 @@ func main() {
 }
 
 func kubicd(cmd *cobra.Command, args []string) {
+	log.SetFormatter(&tools.RedactFormatter{Formatter: log.StandardLogger().Formatter})
 	log.Infof("Kubic Daemon: %s", Version)
 
 	// Create directory in /var/lib
@@ -271,6 +526,10 @@ func kubicd(cmd *cobra.Command, args []string) {
 		log.Fatalf("Could not create '/var/lib/kubic-control' directory: %s", err)
 	}
 
+	executor = createExecutor()
+	loadRetryPolicy()
+	loadSnapshotConfig()
+
 	// Load the certificates from disk
 	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
 	if err != nil {
@@ -309,6 +568,7 @@ func kubicd(cmd *cobra.Command, args []string) {
 	pb.RegisterDeployServer(s, &deploy_server{})
 	pb.RegisterCertificateServer(s, &cert_server{})
 	pb.RegisterYomiServer(s, &yomi_server{})
+	pb.RegisterEtcdServer(s, &etcd_server{})
 
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
@@ -0,0 +1,48 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deployment
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// applyManifest creates or updates all objects of manifest with
+// server-side apply, name is only used for reporting.
+func applyManifest(ctx context.Context, executor tools.NodeExecutor, name string, manifest []byte) (bool, string) {
+	if tools.DryRun(executor, "apply "+name) {
+		return true, ""
+	}
+
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return false, err.Error()
+	}
+	if err := client.Apply(ctx, manifest); err != nil {
+		return false, name + ": " + err.Error()
+	}
+	return true, ""
+}
+
+func applyFile(ctx context.Context, executor tools.NodeExecutor, yamlName string) (bool, string) {
+	manifest, err := ioutil.ReadFile(yamlName)
+	if err != nil {
+		return false, "Cannot read " + yamlName + ": " + err.Error()
+	}
+	return applyManifest(ctx, executor, yamlName, manifest)
+}
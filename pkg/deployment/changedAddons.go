@@ -0,0 +1,86 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deployment
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// Addon is a service deployed by kubicd
+type Addon struct {
+	Name string
+	// yaml, kustomize or helm
+	Kind string
+}
+
+// ChangedAddons returns the deployed services, whose manifest differs
+// from the deployed one and which UpdateAll would update.
+func ChangedAddons(ctx context.Context, executor tools.NodeExecutor) ([]Addon, error) {
+	var addons []Addon
+
+	cfg, err := ini.LooseLoad(StateDir + "/k8s-yaml.conf")
+	if err != nil {
+		return nil, errors.New("Cannot load k8s-yaml.conf: " + err.Error())
+	}
+	for _, key := range cfg.Section("").KeyStrings() {
+		hash, _ := tools.Sha256sum_f(key)
+		if hash != cfg.Section("").Key(key).String() {
+			addons = append(addons, Addon{Name: key, Kind: "yaml"})
+		}
+	}
+
+	cfg, err = ini.LooseLoad(StateDir + "/k8s-kustomize.conf")
+	if err != nil {
+		return nil, errors.New("Cannot load k8s-kustomize.conf: " + err.Error())
+	}
+	for _, key := range cfg.Section("").KeyStrings() {
+		success, message := executor.Run(ctx, "", "kustomize", "build",
+			StateDir+"/kustomize/"+key+"/overlay")
+		if success != true {
+			return nil, errors.New(message)
+		}
+		hash, _ := tools.Sha256sum_b(message)
+		if hash != cfg.Section("").Key(key).String() {
+			addons = append(addons, Addon{Name: key, Kind: "kustomize"})
+		}
+	}
+
+	cfg, err = ini.LooseLoad(helmConfig)
+	if err != nil {
+		return nil, errors.New("Cannot load k8s-helm.conf: " + err.Error())
+	}
+	for _, chartName := range cfg.Section("").KeyStrings() {
+		// the release settings are stored as chart.key
+		releaseName := cfg.Section("").Key(chartName + ".releaseName").String()
+		if len(releaseName) == 0 {
+			continue
+		}
+		valuesPath := cfg.Section("").Key(chartName + ".valuesPath").String()
+		namespace := cfg.Section("").Key(chartName + ".namespace").String()
+		hash := cfg.Section("").Key(chartName).String()
+		changed, err := checkHelmUpdate(ctx, executor, chartName, releaseName, valuesPath, namespace, hash)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			addons = append(addons, Addon{Name: releaseName + " (" + chartName + ")", Kind: "helm"})
+		}
+	}
+	return addons, nil
+}
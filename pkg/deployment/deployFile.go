@@ -15,19 +15,23 @@
 package deployment
 
 import (
+	"context"
+
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
 
-func DeployFile(yamlName string) (bool, string) {
+func DeployFile(ctx context.Context, executor tools.NodeExecutor, yamlName string) (bool, string) {
 
-	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
-		"apply", "-f", yamlName)
+	success, message := applyFile(ctx, executor, yamlName)
 	if success != true {
 		return success, message
 	}
 
 	result, err := tools.Sha256sum_f(yamlName)
+	if tools.DryRun(executor, "update /var/lib/kubic-control/k8s-yaml.conf: "+yamlName+" = "+result) {
+		return true, ""
+	}
 
 	cfg, err := ini.LooseLoad("/var/lib/kubic-control/k8s-yaml.conf")
 	if err != nil {
@@ -1,6 +1,7 @@
 package deployment
 
 import (
+	"context"
 	"errors"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
@@ -11,15 +12,15 @@ const (
 	adminKubeconfig = "/etc/kubernetes/admin.conf"
 )
 
-func setHelmConfig(chartName, releaseName, valuesPath, namespace string) error {
+func setHelmConfig(ctx context.Context, executor tools.NodeExecutor, chartName, releaseName, valuesPath, namespace string) error {
 
 	var success bool
 	var message string
 	if valuesPath == "" {
-		success, message = tools.ExecuteCmd("helm", "template", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "template", releaseName,
 			chartName, "--kubeconfig="+adminKubeconfig)
 	} else {
-		success, message = tools.ExecuteCmd("helm", "template", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "template", releaseName,
 			chartName, "--kubeconfig="+adminKubeconfig,
 			"-f", valuesPath)
 	}
@@ -29,6 +30,9 @@ func setHelmConfig(chartName, releaseName, valuesPath, namespace string) error {
 	}
 
 	result, err := tools.Sha256sum_b(message)
+	if tools.DryRun(executor, "update "+helmConfig+": "+chartName) {
+		return nil
+	}
 
 	cfg, err := ini.LooseLoad(helmConfig)
 	if err != nil {
@@ -47,7 +51,7 @@ func setHelmConfig(chartName, releaseName, valuesPath, namespace string) error {
 	return nil
 }
 
-func DeployHelm(chartName, releaseName, valuesPath, namespace string) error {
+func DeployHelm(ctx context.Context, executor tools.NodeExecutor, chartName, releaseName, valuesPath, namespace string) error {
 
 	var success bool
 	var message string
@@ -55,11 +59,11 @@ func DeployHelm(chartName, releaseName, valuesPath, namespace string) error {
 		namespace = "default"
 	}
 	if valuesPath == "" {
-		success, message = tools.ExecuteCmd("helm", "install", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "install", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"--namespace", namespace)
 	} else {
-		success, message = tools.ExecuteCmd("helm", "install", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "install", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"-f", valuesPath,
 			"--namespace", namespace)
@@ -69,5 +73,5 @@ func DeployHelm(chartName, releaseName, valuesPath, namespace string) error {
 		return errors.New(message)
 	}
 
-	return setHelmConfig(chartName, releaseName, valuesPath, namespace)
+	return setHelmConfig(ctx, executor, chartName, releaseName, valuesPath, namespace)
 }
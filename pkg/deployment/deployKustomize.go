@@ -15,9 +15,14 @@
 package deployment
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
 	"os"
 	"strings"
 
+	"github.com/thkukuk/kubic-control/pkg/k8s"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
@@ -113,76 +118,96 @@ func setupHelloKubic(arg string) (bool, string) {
 	return true, ""
 }
 
-func DeployKustomize(service string, argument string) (bool, string) {
-
-	yamlDidExist := false
-	if _, err := os.Stat(StateDir + "/kustomize/" + service + "/" + service + ".yaml"); err == nil {
-		yamlDidExist = true
+// createMemberlistSecret creates the random key metallb uses to
+// encrypt the communication between the speakers
+func createMemberlistSecret(ctx context.Context, executor tools.NodeExecutor) (bool, string) {
+	if tools.DryRun(executor, "create secret metallb-system/memberlist") {
+		return true, ""
 	}
 
-	os.RemoveAll(StateDir + "/kustomize/" + service)
-	err := os.MkdirAll(StateDir+"/kustomize/"+service+"/overlay",
-		os.ModePerm)
+	key := make([]byte, 128)
+	if _, err := rand.Read(key); err != nil {
+		return false, "Cannot create memberlist key: " + err.Error()
+	}
+	client, err := k8s.NewAdminClient()
 	if err != nil {
-		return false, "Cannot create " + StateDir + "/kustomize/" + service + "/overlay: " + err.Error()
+		return false, err.Error()
 	}
-	err = os.Symlink("/usr/share/k8s-yaml/"+service,
-		StateDir+"/kustomize/"+service+"/base")
+	err = client.CreateSecret(ctx, "metallb-system", "memberlist",
+		map[string]string{"secretkey": base64.StdEncoding.EncodeToString(key)})
 	if err != nil {
-		return false, "Cannot link " + service +
-			" base directory: " + err.Error()
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+func DeployKustomize(ctx context.Context, executor tools.NodeExecutor, service string, argument string) (bool, string) {
+
+	yamlDidExist := false
+	if _, err := os.Stat(StateDir + "/kustomize/" + service + "/" + service + ".yaml"); err == nil {
+		yamlDidExist = true
 	}
 
-	switch service {
-	case "metallb":
-		retval, message := setupMetalLB(argument)
-		if retval != true {
-			os.RemoveAll(StateDir + "/kustomize/" + service)
-			return false, message
+	if !tools.DryRun(executor, "create "+StateDir+"/kustomize/"+service+" with base /usr/share/k8s-yaml/"+service+" and overlay for '"+argument+"'") {
+		os.RemoveAll(StateDir + "/kustomize/" + service)
+		err := os.MkdirAll(StateDir+"/kustomize/"+service+"/overlay",
+			os.ModePerm)
+		if err != nil {
+			return false, "Cannot create " + StateDir + "/kustomize/" + service + "/overlay: " + err.Error()
 		}
-	case "hello-kubic":
-		retval, message := setupHelloKubic(argument)
-		if retval != true {
-			os.RemoveAll(StateDir + "/kustomize/" + service)
-			return false, message
+		err = os.Symlink("/usr/share/k8s-yaml/"+service,
+			StateDir+"/kustomize/"+service+"/base")
+		if err != nil {
+			return false, "Cannot link " + service +
+				" base directory: " + err.Error()
+		}
+
+		switch service {
+		case "metallb":
+			retval, message := setupMetalLB(argument)
+			if retval != true {
+				os.RemoveAll(StateDir + "/kustomize/" + service)
+				return false, message
+			}
+		case "hello-kubic":
+			retval, message := setupHelloKubic(argument)
+			if retval != true {
+				os.RemoveAll(StateDir + "/kustomize/" + service)
+				return false, message
+			}
 		}
 	}
-	retval, message := tools.ExecuteCmd("kustomize", "build",
+	retval, message := executor.Run(ctx, "", "kustomize", "build",
 		StateDir+"/kustomize/"+service+"/overlay")
 	if retval != true {
 		os.RemoveAll(StateDir + "/kustomize/" + service)
 		return false, message
 	}
 
-	f, err := os.Create(StateDir + "/kustomize/" + service + "/" + service + ".yaml")
-	if err != nil {
-		return false, err.Error()
-	}
-	defer f.Close()
-	_, err = f.WriteString(message)
-	if err != nil {
-		return false, err.Error()
+	if !tools.DryRun(executor, "write "+StateDir+"/kustomize/"+service+"/"+service+".yaml") {
+		err := ioutil.WriteFile(StateDir+"/kustomize/"+service+"/"+service+".yaml", []byte(message), 0644)
+		if err != nil {
+			return false, err.Error()
+		}
 	}
-	f.Close()
 
 	result, err := tools.Sha256sum_f(StateDir + "/kustomize/" + service + "/" + service + ".yaml")
-	retval, message = tools.ExecuteCmd("kubectl",
-		"--kubeconfig=/etc/kubernetes/admin.conf", "apply", "-f",
-		StateDir+"/kustomize/"+service+"/"+service+".yaml")
+	retval, message = applyManifest(ctx, executor, service, []byte(message))
 	if retval != true {
 		return false, message
 	}
 
 	if strings.EqualFold(service, "metallb") && !yamlDidExist {
-		retval, message = tools.ExecuteCmd("kubectl",
-			"--kubeconfig=/etc/kubernetes/admin.conf", "create",
-			"secret", "generic", "-n", "metallb-system",
-			"memberlist", "--from-literal=secretkey=\"$(openssl rand -base64 128)\"")
+		retval, message = createMemberlistSecret(ctx, executor)
 		if retval != true {
 			return false, message
 		}
 	}
 
+	if tools.DryRun(executor, "update "+StateDir+"/k8s-kustomize.conf: "+service) {
+		return true, ""
+	}
+
 	cfg, err := ini.LooseLoad(StateDir + "/k8s-kustomize.conf")
 	if err != nil {
 		return false, "Cannot load k8s-kustomize.conf: " + err.Error()
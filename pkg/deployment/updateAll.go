@@ -15,12 +15,14 @@
 package deployment
 
 import (
+	"context"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
 
-func UpdateAll(forced bool) (bool, string) {
+func UpdateAll(ctx context.Context, executor tools.NodeExecutor, forced bool) (bool, string) {
 
 	cfg, err := ini.Load("/var/lib/kubic-control/k8s-yaml.conf")
 	if err != nil {
@@ -31,7 +33,7 @@ func UpdateAll(forced bool) (bool, string) {
 	for _, key := range keys {
 		if forced {
 			// force, so always update even if not changed
-			success, message := UpdateFile(key)
+			success, message := UpdateFile(ctx, executor, key)
 			if success != true {
 				return success, message
 			}
@@ -41,7 +43,7 @@ func UpdateAll(forced bool) (bool, string) {
 
 			if hash != value {
 				log.Infof("%s has changed, updating", key)
-				success, message := UpdateFile(key)
+				success, message := UpdateFile(ctx, executor, key)
 				if success != true {
 					return success, message
 				}
@@ -61,12 +63,12 @@ func UpdateAll(forced bool) (bool, string) {
 	for _, key := range keys {
 		if forced {
 			// force, so always update even if not changed
-			success, message := UpdateKustomize(key)
+			success, message := UpdateKustomize(ctx, executor, key)
 			if success != true {
 				return success, message
 			}
 		} else {
-			retval, message := tools.ExecuteCmd("kustomize", "build",
+			retval, message := executor.Run(ctx, "", "kustomize", "build",
 				StateDir+"/kustomize/"+key+"/overlay")
 			if retval != true {
 				return retval, message
@@ -77,7 +79,7 @@ func UpdateAll(forced bool) (bool, string) {
 
 			if hash != value {
 				log.Infof("%s has changed, updating", key)
-				success, message := UpdateKustomize(key)
+				success, message := UpdateKustomize(ctx, executor, key)
 				if success != true {
 					return success, message
 				}
@@ -100,24 +102,24 @@ func UpdateAll(forced bool) (bool, string) {
 		namespace := cfg.Section("").Key(chartName + ".namespace").String()
 		if forced {
 			// force, so always update even if not changed
-			err = UpdateHelm(chartName, releaseName, valuesPath, namespace)
+			err = UpdateHelm(ctx, executor, chartName, releaseName, valuesPath, namespace)
 			if err != nil {
 				return false, err.Error()
 			}
 		} else {
 			hash := cfg.Section("").Key(chartName).String()
-			needsUpdate, err := checkHelmUpdate(chartName, releaseName, valuesPath, namespace, hash)
+			needsUpdate, err := checkHelmUpdate(ctx, executor, chartName, releaseName, valuesPath, namespace, hash)
 			if err != nil {
 				return false, err.Error()
 			}
 			if needsUpdate {
-				log.Infof("%s has changed, updating")
-				err = UpdateHelm(chartName, releaseName, valuesPath, namespace)
+				log.Infof("%s has changed, updating", chartName)
+				err = UpdateHelm(ctx, executor, chartName, releaseName, valuesPath, namespace)
 				if err != nil {
 					return false, err.Error()
 				}
 			} else {
-				log.Infof("%s has not changed, ignoring")
+				log.Infof("%s has not changed, ignoring", chartName)
 			}
 		}
 	}
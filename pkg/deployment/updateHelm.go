@@ -1,19 +1,20 @@
 package deployment
 
 import (
+	"context"
 	"errors"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-func checkHelmUpdate(chartName, releaseName, valuesPath, namespace, hash string) (bool, error) {
+func checkHelmUpdate(ctx context.Context, executor tools.NodeExecutor, chartName, releaseName, valuesPath, namespace, hash string) (bool, error) {
 	var success bool
 	var message string
 	if valuesPath == "" {
-		success, message = tools.ExecuteCmd("helm", "template", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "template", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"--namespace", namespace)
 	} else {
-		success, message = tools.ExecuteCmd("helm", "template", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "template", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"-f", valuesPath,
 			"--namespace", namespace)
@@ -30,7 +31,7 @@ func checkHelmUpdate(chartName, releaseName, valuesPath, namespace, hash string)
 	return true, nil
 }
 
-func UpdateHelm(chartName, releaseName, valuesPath, namespace string) error {
+func UpdateHelm(ctx context.Context, executor tools.NodeExecutor, chartName, releaseName, valuesPath, namespace string) error {
 
 	var success bool
 	var message string
@@ -38,11 +39,11 @@ func UpdateHelm(chartName, releaseName, valuesPath, namespace string) error {
 		namespace = "default"
 	}
 	if valuesPath == "" {
-		success, message = tools.ExecuteCmd("helm", "upgrade", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "upgrade", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"--namespace", namespace)
 	} else {
-		success, message = tools.ExecuteCmd("helm", "upgrade", releaseName,
+		success, message = executor.Run(ctx, "", "helm", "upgrade", releaseName,
 			chartName, "--kubeconfig=/etc/kubernetes/admin.conf",
 			"-f", valuesPath,
 			"--namespace", namespace)
@@ -52,5 +53,5 @@ func UpdateHelm(chartName, releaseName, valuesPath, namespace string) error {
 		return errors.New(message)
 	}
 
-	return setHelmConfig(chartName, releaseName, valuesPath, namespace)
+	return setHelmConfig(ctx, executor, chartName, releaseName, valuesPath, namespace)
 }
@@ -15,38 +15,37 @@
 package deployment
 
 import (
-	"os"
+	"context"
+	"io/ioutil"
 
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
 
-func UpdateKustomize(service string) (bool, string) {
+func UpdateKustomize(ctx context.Context, executor tools.NodeExecutor, service string) (bool, string) {
 
-	retval, message := tools.ExecuteCmd("kustomize", "build",
+	retval, message := executor.Run(ctx, "", "kustomize", "build",
 		StateDir+"/kustomize/"+service+"/overlay")
 	if retval != true {
 		return false, message
 	}
 
-	f, err := os.Create(StateDir + "/kustomize/" + service + "/" + service + ".yaml")
-	if err != nil {
-		return false, err.Error()
-	}
-	defer f.Close()
-	_, err = f.WriteString(message)
-	if err != nil {
-		return false, err.Error()
+	if !tools.DryRun(executor, "write "+StateDir+"/kustomize/"+service+"/"+service+".yaml") {
+		err := ioutil.WriteFile(StateDir+"/kustomize/"+service+"/"+service+".yaml", []byte(message), 0644)
+		if err != nil {
+			return false, err.Error()
+		}
 	}
-	f.Close()
 
-	retval, message = tools.ExecuteCmd("kubectl",
-		"--kubeconfig=/etc/kubernetes/admin.conf", "apply", "-f",
-		StateDir+"/kustomize/"+service+"/"+service+".yaml")
+	retval, message = applyManifest(ctx, executor, service, []byte(message))
 	if retval != true {
 		return false, message
 	}
 
+	if tools.DryRun(executor, "update "+StateDir+"/k8s-kustomize.conf: "+service) {
+		return true, ""
+	}
+
 	cfg, err := ini.LooseLoad(StateDir + "/k8s-kustomize.conf")
 	if err != nil {
 		return false, "Cannot load k8s-kustomize.conf: " + err.Error()
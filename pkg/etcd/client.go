@@ -0,0 +1,118 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// CAFile, CertFile and KeyFile are the kubeadm generated
+	// certificates kubicd uses to access etcd
+	CAFile   = "/etc/kubernetes/pki/etcd/ca.crt"
+	CertFile = "/etc/kubernetes/pki/etcd/healthcheck-client.crt"
+	KeyFile  = "/etc/kubernetes/pki/etcd/healthcheck-client.key"
+
+	dialTimeout = 10 * time.Second
+)
+
+// Credentials contain the PEM encoded CA, client certificate and
+// client key to authenticate with etcd
+type Credentials struct {
+	CA   []byte
+	Cert []byte
+	Key  []byte
+}
+
+// LoadCredentials reads the credentials from the local machine
+func LoadCredentials() (Credentials, error) {
+	var credentials Credentials
+	var err error
+
+	if credentials.CA, err = ioutil.ReadFile(CAFile); err != nil {
+		return credentials, &Error{Op: "load", Object: "credentials", Err: err}
+	}
+	if credentials.Cert, err = ioutil.ReadFile(CertFile); err != nil {
+		return credentials, &Error{Op: "load", Object: "credentials", Err: err}
+	}
+	if credentials.Key, err = ioutil.ReadFile(KeyFile); err != nil {
+		return credentials, &Error{Op: "load", Object: "credentials", Err: err}
+	}
+	return credentials, nil
+}
+
+// API is the part of the etcd v3 API the client uses, it is
+// implemented by *clientv3.Client
+type API interface {
+	clientv3.Cluster
+	clientv3.KV
+	clientv3.Maintenance
+	Close() error
+}
+
+// Client talks with the etcd cluster using the v3 API
+type Client struct {
+	client API
+}
+
+// NewClient creates a client for the etcd cluster reachable via
+// endpoints. Connections are established on demand, so an unreachable
+// endpoint is no error yet.
+func NewClient(endpoints []string, credentials Credentials) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, &Error{Op: "connect", Object: "cluster", Err: errors.New("no endpoints")}
+	}
+
+	certificate, err := tls.X509KeyPair(credentials.Cert, credentials.Key)
+	if err != nil {
+		return nil, &Error{Op: "load", Object: "credentials", Err: err}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(credentials.CA) {
+		return nil, &Error{Op: "load", Object: "credentials", Err: errors.New("invalid CA certificate")}
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      pool,
+		},
+		Logger: zap.NewNop(),
+	})
+	if err != nil {
+		return nil, &Error{Op: "connect", Object: "cluster", Err: err}
+	}
+	return NewClientFromAPI(client), nil
+}
+
+// NewClientFromAPI creates a client for an existing API, e.g. a fake
+// one in tests
+func NewClientFromAPI(api API) *Client {
+	return &Client{client: api}
+}
+
+// Close closes all connections of the client
+func (c *Client) Close() error {
+	return c.client.Close()
+}
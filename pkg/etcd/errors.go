@@ -0,0 +1,44 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"errors"
+)
+
+// ErrMemberNotFound is returned if no member matches
+var ErrMemberNotFound = errors.New("member not found")
+
+// Error describes a failed operation on the etcd cluster
+type Error struct {
+	// Op is the operation, e.g. "list", "remove" or "status"
+	Op string
+	// Object is the member or endpoint
+	Object string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Op + " etcd " + e.Object + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound returns true if the member does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrMemberNotFound)
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// defragTimeout is how long the defragmentation of one member may take,
+// the member does not answer any requests meanwhile
+const defragTimeout = 10 * time.Minute
+
+// Revision returns the current revision of the key space
+func (c *Client) Revision(ctx context.Context) (int64, error) {
+	response, err := c.client.Get(ctx, "kubicd", clientv3.WithCountOnly())
+	if err != nil {
+		return 0, &Error{Op: "get", Object: "revision", Err: err}
+	}
+	return response.Header.Revision, nil
+}
+
+// Compact removes all revisions older than revision. It is no error if
+// the revision is already compacted.
+func (c *Client) Compact(ctx context.Context, revision int64) error {
+	_, err := c.client.Compact(ctx, revision, clientv3.WithCompactPhysical())
+	if err != nil && !errors.Is(err, rpctypes.ErrCompacted) {
+		return &Error{Op: "compact", Object: "cluster", Err: err}
+	}
+	return nil
+}
+
+// Defragment releases the free space of the member behind endpoint.
+func (c *Client) Defragment(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, defragTimeout)
+	defer cancel()
+
+	if _, err := c.client.Defragment(ctx, endpoint); err != nil {
+		return &Error{Op: "defragment", Object: endpoint, Err: err}
+	}
+	return nil
+}
+
+// EndpointStatus returns the status of the member behind endpoint
+func (c *Client) EndpointStatus(ctx context.Context, member Member, endpoint string) EndpointStatus {
+	return c.endpointStatus(ctx, member, endpoint)
+}
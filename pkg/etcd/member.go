@@ -0,0 +1,140 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// statusTimeout is how long a single endpoint may take to answer
+const statusTimeout = 5 * time.Second
+
+// Member is a member of the etcd cluster
+type Member struct {
+	ID         uint64
+	Name       string
+	PeerURLs   []string
+	ClientURLs []string
+	IsLearner  bool
+}
+
+// IDString returns the ID in the hexadecimal format etcdctl uses
+func (m Member) IDString() string {
+	return strconv.FormatUint(m.ID, 16)
+}
+
+// EndpointStatus is the status of the etcd member behind one endpoint
+type EndpointStatus struct {
+	Endpoint string
+	Member   Member
+	Version  string
+	DBSize   int64
+	// DBSizeInUse is the logical size, the rest is freed by a defrag
+	DBSizeInUse int64
+	Leader      bool
+	RaftTerm    uint64
+	// Err is set if the member is unhealthy
+	Err error
+}
+
+// ListMembers returns all members of the cluster
+func (c *Client) ListMembers(ctx context.Context) ([]Member, error) {
+	response, err := c.client.MemberList(ctx)
+	if err != nil {
+		return nil, &Error{Op: "list", Object: "members", Err: err}
+	}
+
+	var members []Member
+	for _, member := range response.Members {
+		members = append(members, Member{
+			ID:         member.ID,
+			Name:       member.Name,
+			PeerURLs:   member.PeerURLs,
+			ClientURLs: member.ClientURLs,
+			IsLearner:  member.IsLearner,
+		})
+	}
+	return members, nil
+}
+
+// FindMember returns the member with the name or the hexadecimal ID
+func (c *Client) FindMember(ctx context.Context, nameOrID string) (Member, error) {
+	members, err := c.ListMembers(ctx)
+	if err != nil {
+		return Member{}, err
+	}
+	for _, member := range members {
+		if member.Name == nameOrID || member.IDString() == nameOrID {
+			return member, nil
+		}
+	}
+	return Member{}, &Error{Op: "find", Object: "member " + nameOrID, Err: ErrMemberNotFound}
+}
+
+// RemoveMember removes the member from the cluster
+func (c *Client) RemoveMember(ctx context.Context, member Member) error {
+	if _, err := c.client.MemberRemove(ctx, member.ID); err != nil {
+		return &Error{Op: "remove", Object: "member " + member.Name, Err: err}
+	}
+	return nil
+}
+
+// Health returns the status of every member of the cluster. A member
+// is unhealthy if it cannot be reached, reports errors or has no leader.
+func (c *Client) Health(ctx context.Context) ([]EndpointStatus, error) {
+	members, err := c.ListMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []EndpointStatus
+	for _, member := range members {
+		if len(member.ClientURLs) == 0 {
+			// added, but never started
+			result = append(result, EndpointStatus{Member: member,
+				Err: errors.New("member not started")})
+			continue
+		}
+		result = append(result, c.endpointStatus(ctx, member, member.ClientURLs[0]))
+	}
+	return result, nil
+}
+
+func (c *Client) endpointStatus(ctx context.Context, member Member, endpoint string) EndpointStatus {
+	status := EndpointStatus{Endpoint: endpoint, Member: member}
+
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	response, err := c.client.Status(ctx, endpoint)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	status.Version = response.Version
+	status.DBSize = response.DbSize
+	status.DBSizeInUse = response.DbSizeInUse
+	status.RaftTerm = response.RaftTerm
+	status.Leader = response.Leader == response.Header.MemberId
+	if len(response.Errors) > 0 {
+		status.Err = errors.New(response.Errors[0])
+	} else if response.Leader == 0 {
+		status.Err = errors.New("no leader")
+	}
+	return status
+}
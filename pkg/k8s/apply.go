@@ -0,0 +1,115 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// time to wait for new CustomResourceDefinitions
+	applyMappingRetries  = 5
+	applyMappingInterval = 2 * time.Second
+)
+
+// Apply creates or updates all objects of the YAML or JSON manifest
+// with server-side apply. Conflicting fields are taken over from
+// other managers, e.g. from an earlier "kubectl apply".
+func (c *Client) Apply(ctx context.Context, manifest []byte) error {
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return &Error{Op: "apply", Kind: "Manifest", Err: err}
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				return c.applyObject(ctx, item.(*unstructured.Unstructured))
+			})
+			if err != nil {
+				return err
+			}
+		} else if err := c.applyObject(ctx, obj); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) applyObject(ctx context.Context, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	name := obj.GetName()
+	if len(obj.GetNamespace()) > 0 {
+		name = obj.GetNamespace() + "/" + name
+	}
+
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	for retry := 0; meta.IsNoMatchError(err) && retry < applyMappingRetries; retry++ {
+		// the CustomResourceDefinition may be applied just before
+		if mapper, ok := c.mapper.(meta.ResettableRESTMapper); ok {
+			mapper.Reset()
+		}
+		select {
+		case <-ctx.Done():
+			return &Error{Op: "apply", Kind: gvk.Kind, Name: name, Err: ctx.Err()}
+		case <-time.After(applyMappingInterval):
+		}
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return &Error{Op: "apply", Kind: gvk.Kind, Name: name, Err: err}
+	}
+
+	var resource dynamic.ResourceInterface
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace := obj.GetNamespace()
+		if len(namespace) == 0 {
+			namespace = metav1.NamespaceDefault
+		}
+		resource = c.dynamic.Resource(mapping.Resource).Namespace(namespace)
+	} else {
+		resource = c.dynamic.Resource(mapping.Resource)
+	}
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return &Error{Op: "apply", Kind: gvk.Kind, Name: name, Err: err}
+	}
+	force := true
+	_, err = resource.Patch(ctx, obj.GetName(), types.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: FieldManager, Force: &force})
+	if err != nil {
+		return &Error{Op: "apply", Kind: gvk.Kind, Name: name, Err: err}
+	}
+	return nil
+}
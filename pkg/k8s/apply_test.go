@@ -0,0 +1,126 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kured
+  namespace: kube-system
+data:
+  period: 1h
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: kured
+rules: []
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ServiceAccount
+  metadata:
+    name: kured
+`
+
+type applied struct {
+	resource  string
+	namespace string
+	name      string
+	patchType types.PatchType
+	object    map[string]interface{}
+}
+
+func newApplyClient(t *testing.T) (*Client, *[]applied) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+
+	var patches []applied
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		entry := applied{
+			resource:  patch.GetResource().Resource,
+			namespace: patch.GetNamespace(),
+			name:      patch.GetName(),
+			patchType: patch.GetPatchType(),
+		}
+		if err := json.Unmarshal(patch.GetPatch(), &entry.object); err != nil {
+			t.Errorf("invalid patch for %s: %v", entry.name, err)
+		}
+		patches = append(patches, entry)
+		return true, nil, nil
+	})
+	return NewClientFromInterfaces(nil, dynamicClient, mapper), &patches
+}
+
+func TestApply(t *testing.T) {
+	client, patches := newApplyClient(t)
+
+	if err := client.Apply(context.Background(), []byte(testManifest)); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	want := []applied{
+		{resource: "configmaps", namespace: "kube-system", name: "kured"},
+		{resource: "clusterroles", namespace: "", name: "kured"},
+		{resource: "serviceaccounts", namespace: "default", name: "kured"},
+	}
+	if len(*patches) != len(want) {
+		t.Fatalf("got %d patches, want %d: %v", len(*patches), len(want), *patches)
+	}
+	for i, patch := range *patches {
+		if patch.resource != want[i].resource || patch.namespace != want[i].namespace || patch.name != want[i].name {
+			t.Errorf("patch %d: got %s %s/%s, want %s %s/%s", i, patch.resource, patch.namespace, patch.name,
+				want[i].resource, want[i].namespace, want[i].name)
+		}
+		if patch.patchType != types.ApplyPatchType {
+			t.Errorf("patch %d: got patch type %s, want server-side apply", i, patch.patchType)
+		}
+	}
+	if data, ok := (*patches)[0].object["data"].(map[string]interface{}); !ok || data["period"] != "1h" {
+		t.Errorf("configmap applied without data: %v", (*patches)[0].object)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	client, patches := newApplyClient(t)
+
+	err := client.Apply(context.Background(), []byte("kind: [\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "apply manifest:") {
+		t.Errorf("Apply of invalid manifest returned %v", err)
+	}
+	if len(*patches) != 0 {
+		t.Errorf("invalid manifest got applied: %v", *patches)
+	}
+}
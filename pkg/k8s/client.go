@@ -0,0 +1,85 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// AdminConf is the kubeconfig kubicd uses to access the cluster
+	AdminConf = "/etc/kubernetes/admin.conf"
+	// FieldManager owns all fields kubicd applies
+	FieldManager = "kubicd"
+)
+
+// ProgressFunc gets called for every step of a longer operation
+type ProgressFunc func(message string)
+
+// Client talks with the kubernetes API server
+type Client struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+}
+
+// NewClient creates a client for the cluster configured in kubeconfig
+func NewClient(kubeconfig string) (*Client, error) {
+	return NewClientForServer(kubeconfig, "")
+}
+
+// NewAdminClient creates a client for the cluster with AdminConf.
+// Tests replace it to work with a fake cluster.
+var NewAdminClient = func() (*Client, error) {
+	return NewClient(AdminConf)
+}
+
+// NewClientForServer creates a client for the cluster configured in
+// kubeconfig, which talks to server instead of the configured API server
+// address, e.g. to check the load balancer.
+func NewClientForServer(kubeconfig string, server string) (*Client, error) {
+	config, err := clientcmd.BuildConfigFromFlags(server, kubeconfig)
+	if err != nil {
+		return nil, &Error{Op: "load", Kind: "Kubeconfig", Name: kubeconfig, Err: err}
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, &Error{Op: "load", Kind: "Kubeconfig", Name: kubeconfig, Err: err}
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, &Error{Op: "load", Kind: "Kubeconfig", Name: kubeconfig, Err: err}
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+
+	return NewClientFromInterfaces(clientset, dynamicClient, mapper), nil
+}
+
+// NewClientFromInterfaces creates a client for existing interfaces,
+// e.g. the fake clientset and fake dynamic client.
+func NewClientFromInterfaces(clientset kubernetes.Interface, dynamicClient dynamic.Interface, mapper meta.RESTMapper) *Client {
+	return &Client{clientset: clientset, dynamic: dynamicClient, mapper: mapper}
+}
+
+func (c *Client) progress(progress ProgressFunc, message string) {
+	if progress != nil {
+		progress(message)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+	drainPollInterval   = 2 * time.Second
+	// blockedReportInterval is how often unchanged blocked evictions
+	// are reported again
+	blockedReportInterval = time.Minute
+)
+
+// evictRetryInterval is the time between two evictions blocked by a
+// PodDisruptionBudget, tests shorten it
+var evictRetryInterval = 5 * time.Second
+
+// DrainOptions modify which pods get evicted and how
+type DrainOptions struct {
+	// GracePeriodSeconds overrides the termination grace period of
+	// the pods, nil uses the one of the pod
+	GracePeriodSeconds *int64
+	// PodSelector is a label selector, only matching pods get evicted
+	PodSelector string
+	// DeleteEmptyDirData allows to evict pods with emptyDir volumes,
+	// else the drain fails if there are such pods
+	DeleteEmptyDirData bool
+}
+
+// Drain cordons node and evicts all pods, which are not managed by a
+// DaemonSet and are no static pods. Pods without controller get
+// evicted, too. Evictions blocked by a PodDisruptionBudget are retried
+// until ctx is done, the returned error names the blocked pods.
+func (c *Client) Drain(ctx context.Context, node string, options DrainOptions, progress ProgressFunc) error {
+	if len(options.PodSelector) > 0 {
+		if _, err := labels.Parse(options.PodSelector); err != nil {
+			return &Error{Op: "drain", Kind: "Node", Name: node, Err: err}
+		}
+	}
+
+	if err := c.Cordon(ctx, node); err != nil {
+		return err
+	}
+
+	pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node}).String(),
+		LabelSelector: options.PodSelector,
+	})
+	if err != nil {
+		return &Error{Op: "drain", Kind: "Node", Name: node, Err: err}
+	}
+
+	var drain []corev1.Pod
+	var localStorage []string
+	for _, pod := range pods.Items {
+		if skipDrain(pod) {
+			continue
+		}
+		if !options.DeleteEmptyDirData && hasEmptyDir(pod) {
+			localStorage = append(localStorage, pod.Namespace+"/"+pod.Name)
+		}
+		drain = append(drain, pod)
+	}
+	if len(localStorage) > 0 {
+		return &Error{Op: "drain", Kind: "Node", Name: node,
+			Err: errors.New("pods with emptyDir volumes need deletion of the data: " + strings.Join(localStorage, ", "))}
+	}
+
+	if err := c.evictPods(ctx, node, drain, options.GracePeriodSeconds, progress); err != nil {
+		return err
+	}
+
+	for _, pod := range drain {
+		if err := c.waitForDeletion(ctx, pod); err != nil {
+			return err
+		}
+		c.progress(progress, "pod "+pod.Namespace+"/"+pod.Name+" evicted")
+	}
+	return nil
+}
+
+// evictPods evicts all pods. Evictions blocked by a PodDisruptionBudget
+// are retried, while the other pods get evicted already, until the
+// budgets allow it or ctx is done. The blocked pods and their budgets
+// are reported via progress.
+func (c *Client) evictPods(ctx context.Context, node string, pods []corev1.Pod, gracePeriodSeconds *int64, progress ProgressFunc) error {
+	policyV1 := c.supportsPolicyV1()
+
+	var lastMessage string
+	var lastReport time.Time
+	pending := pods
+	for {
+		var blocked []corev1.Pod
+		var reasons []string
+
+		for _, pod := range pending {
+			name := pod.Namespace + "/" + pod.Name
+			err := c.evictPod(ctx, pod, policyV1, gracePeriodSeconds)
+			if err == nil {
+				c.progress(progress, "evicting pod "+name)
+				continue
+			}
+			if !IsBlocked(err) {
+				return &Error{Op: "evict", Kind: "Pod", Name: name, Err: err}
+			}
+			blocked = append(blocked, pod)
+			reasons = append(reasons, name+" ("+c.blockingBudgets(ctx, pod, policyV1)+")")
+		}
+		if len(blocked) == 0 {
+			return nil
+		}
+
+		message := fmt.Sprintf("%d pod(s) blocked by disruption budget: %s", len(blocked), strings.Join(reasons, ", "))
+		if message != lastMessage || time.Since(lastReport) >= blockedReportInterval {
+			c.progress(progress, message+", retrying")
+			lastMessage = message
+			lastReport = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return &Error{Op: "drain", Kind: "Node", Name: node,
+				Err: errors.New("eviction blocked by disruption budget: " + strings.Join(reasons, ", "))}
+		case <-time.After(evictRetryInterval):
+		}
+		pending = blocked
+	}
+}
+
+func hasEmptyDir(pod corev1.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// skipDrain returns true for DaemonSet pods, static pods and pods
+// which are already gone
+func skipDrain(pod corev1.Pod) bool {
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return true
+	}
+	if pod.DeletionTimestamp != nil {
+		return true
+	}
+	if controller := metav1.GetControllerOf(&pod); controller != nil && controller.Kind == "DaemonSet" {
+		return true
+	}
+	return false
+}
+
+// supportsPolicyV1 checks if the API server knows policy/v1 evictions,
+// which got introduced with kubernetes 1.22
+func (c *Client) supportsPolicyV1() bool {
+	groups, err := c.clientset.Discovery().ServerGroups()
+	if err != nil {
+		return false
+	}
+	for _, group := range groups.Groups {
+		if group.Name != "policy" {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == "v1" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Client) evictPod(ctx context.Context, pod corev1.Pod, policyV1 bool, gracePeriodSeconds *int64) error {
+	objectMeta := metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}
+	deleteOptions := &metav1.DeleteOptions{GracePeriodSeconds: gracePeriodSeconds}
+
+	var err error
+	if policyV1 {
+		err = c.clientset.CoreV1().Pods(pod.Namespace).EvictV1(ctx, &policyv1.Eviction{ObjectMeta: objectMeta, DeleteOptions: deleteOptions})
+	} else {
+		err = c.clientset.CoreV1().Pods(pod.Namespace).EvictV1beta1(ctx, &policyv1beta1.Eviction{ObjectMeta: objectMeta, DeleteOptions: deleteOptions})
+	}
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// blockingBudgets describes the PodDisruptionBudgets selecting pod with
+// the number of disruptions they allow at the moment
+func (c *Client) blockingBudgets(ctx context.Context, pod corev1.Pod, policyV1 bool) string {
+	var budgets []string
+
+	if policyV1 {
+		list, err := c.clientset.PolicyV1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			for _, pdb := range list.Items {
+				if selectsPod(pdb.Spec.Selector, pod) {
+					budgets = append(budgets, fmt.Sprintf("%s: %d disruptions allowed", pdb.Name, pdb.Status.DisruptionsAllowed))
+				}
+			}
+		}
+	} else {
+		list, err := c.clientset.PolicyV1beta1().PodDisruptionBudgets(pod.Namespace).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			for _, pdb := range list.Items {
+				if selectsPod(pdb.Spec.Selector, pod) {
+					budgets = append(budgets, fmt.Sprintf("%s: %d disruptions allowed", pdb.Name, pdb.Status.DisruptionsAllowed))
+				}
+			}
+		}
+	}
+
+	if len(budgets) == 0 {
+		return "unknown budget"
+	}
+	return "budget " + strings.Join(budgets, ", ")
+}
+
+func selectsPod(labelSelector *metav1.LabelSelector, pod corev1.Pod) bool {
+	if labelSelector == nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(pod.Labels))
+}
+
+// waitForDeletion waits until pod is gone or got replaced by a new pod
+// with the same name
+func (c *Client) waitForDeletion(ctx context.Context, pod corev1.Pod) error {
+	for {
+		current, err := c.clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return &Error{Op: "drain", Kind: "Pod", Name: pod.Namespace + "/" + pod.Name, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return &Error{Op: "drain", Kind: "Pod", Name: pod.Namespace + "/" + pod.Name, Err: ctx.Err()}
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testNode(name string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func testPod(name string, node string, ownerKind string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID(name),
+			Labels:    map[string]string{"app": name},
+		},
+		Spec: corev1.PodSpec{NodeName: node},
+	}
+	if len(ownerKind) > 0 {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1", Kind: ownerKind, Name: name + "-owner", Controller: &controller,
+		}}
+	}
+	return pod
+}
+
+// evictions records all evictions and removes the evicted pods like
+// the API server. The first blocked evictions of every pod in blocked
+// are refused with 429.
+type evictions struct {
+	mu       sync.Mutex
+	pods     []string
+	versions []string
+	grace    []*int64
+	blocked  map[string]int
+}
+
+func (e *evictions) reactor(clientset *fake.Clientset) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		var name string
+		var deleteOptions *metav1.DeleteOptions
+		switch eviction := action.(k8stesting.CreateAction).GetObject().(type) {
+		case *policyv1.Eviction:
+			name = eviction.Name
+			deleteOptions = eviction.DeleteOptions
+			e.versions = append(e.versions, "v1")
+		case *policyv1beta1.Eviction:
+			name = eviction.Name
+			deleteOptions = eviction.DeleteOptions
+			e.versions = append(e.versions, "v1beta1")
+		}
+		e.pods = append(e.pods, name)
+		if deleteOptions != nil {
+			e.grace = append(e.grace, deleteOptions.GracePeriodSeconds)
+		}
+		if e.blocked[name] != 0 {
+			if e.blocked[name] > 0 {
+				e.blocked[name]--
+			}
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		gvr := corev1.SchemeGroupVersion.WithResource("pods")
+		return true, nil, clientset.Tracker().Delete(gvr, action.GetNamespace(), name)
+	}
+}
+
+func (e *evictions) list() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.pods...)
+}
+
+func newDrainClient(policyV1 bool, objects ...runtime.Object) (*Client, *fake.Clientset, *evictions) {
+	clientset := fake.NewSimpleClientset(objects...)
+	if policyV1 {
+		clientset.Resources = []*metav1.APIResourceList{{GroupVersion: "policy/v1"}}
+	}
+	evicted := &evictions{blocked: make(map[string]int)}
+	clientset.PrependReactor("create", "pods", evicted.reactor(clientset))
+	return NewClientFromInterfaces(clientset, nil, nil), clientset, evicted
+}
+
+func TestDrain(t *testing.T) {
+	client, clientset, evicted := newDrainClient(true,
+		testNode("worker1"),
+		testPod("web-1", "worker1", "ReplicaSet"),
+		testPod("standalone", "worker1", ""),
+		testPod("kube-proxy-abc", "worker1", "DaemonSet"),
+	)
+	terminating := testPod("old-web", "worker1", "ReplicaSet")
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	clientset.Tracker().Add(terminating)
+	mirror := testPod("kube-apiserver-worker1", "worker1", "")
+	mirror.Annotations = map[string]string{mirrorPodAnnotation: "hash"}
+	clientset.Tracker().Add(mirror)
+
+	var progress []string
+	err := client.Drain(context.Background(), "worker1", DrainOptions{DeleteEmptyDirData: true},
+		func(message string) { progress = append(progress, message) })
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), "worker1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get node failed: %v", err)
+	}
+	if !node.Spec.Unschedulable {
+		t.Errorf("node was not cordoned")
+	}
+	if got := strings.Join(evicted.list(), ","); got != "standalone,web-1" && got != "web-1,standalone" {
+		t.Errorf("evicted pods %q, want standalone and web-1", got)
+	}
+	for _, version := range evicted.versions {
+		if version != "v1" {
+			t.Errorf("used %s eviction, want v1", version)
+		}
+	}
+	for _, name := range []string{"kube-proxy-abc", "kube-apiserver-worker1", "old-web"} {
+		if _, err := clientset.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("pod %s got removed: %v", name, err)
+		}
+	}
+	if !contains(progress, "pod default/web-1 evicted") || !contains(progress, "pod default/standalone evicted") {
+		t.Errorf("missing progress messages: %q", progress)
+	}
+}
+
+func TestDrainPolicyV1beta1(t *testing.T) {
+	client, _, evicted := newDrainClient(false, testNode("worker1"), testPod("web-1", "worker1", "ReplicaSet"))
+	grace := int64(0)
+
+	if err := client.Drain(context.Background(), "worker1",
+		DrainOptions{DeleteEmptyDirData: true, GracePeriodSeconds: &grace}, nil); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if len(evicted.versions) != 1 || evicted.versions[0] != "v1beta1" {
+		t.Errorf("used evictions %v, want v1beta1", evicted.versions)
+	}
+	if len(evicted.grace) != 1 || evicted.grace[0] == nil || *evicted.grace[0] != 0 {
+		t.Errorf("grace period not passed: %v", evicted.grace)
+	}
+}
+
+func TestDrainEmptyDir(t *testing.T) {
+	pod := testPod("cache", "worker1", "ReplicaSet")
+	pod.Spec.Volumes = []corev1.Volume{{Name: "tmp",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	client, _, evicted := newDrainClient(true, testNode("worker1"), pod)
+
+	err := client.Drain(context.Background(), "worker1", DrainOptions{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "emptyDir") || !strings.Contains(err.Error(), "default/cache") {
+		t.Fatalf("Drain returned %v, want emptyDir error", err)
+	}
+	if len(evicted.list()) != 0 {
+		t.Errorf("pods evicted: %v", evicted.list())
+	}
+}
+
+func TestDrainPodSelector(t *testing.T) {
+	client, _, evicted := newDrainClient(true, testNode("worker1"),
+		testPod("web-1", "worker1", "ReplicaSet"), testPod("db-1", "worker1", "StatefulSet"))
+
+	if err := client.Drain(context.Background(), "worker1", DrainOptions{PodSelector: "app=db-1"}, nil); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if got := evicted.list(); len(got) != 1 || got[0] != "db-1" {
+		t.Errorf("evicted pods %v, want db-1", got)
+	}
+	if err := client.Drain(context.Background(), "worker1", DrainOptions{PodSelector: "app in ("}, nil); err == nil {
+		t.Errorf("Drain accepted invalid selector")
+	}
+}
+
+func testBudget(name string, app string) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}},
+		},
+		Status: policyv1.PodDisruptionBudgetStatus{DisruptionsAllowed: 0},
+	}
+}
+
+func TestDrainBudgetRetry(t *testing.T) {
+	defer func(interval time.Duration) { evictRetryInterval = interval }(evictRetryInterval)
+	evictRetryInterval = 10 * time.Millisecond
+
+	client, _, evicted := newDrainClient(true, testNode("worker1"),
+		testPod("web-1", "worker1", "ReplicaSet"), testPod("db-1", "worker1", "StatefulSet"),
+		testBudget("web-pdb", "web-1"))
+	evicted.blocked["web-1"] = 2
+
+	var progress []string
+	err := client.Drain(context.Background(), "worker1", DrainOptions{DeleteEmptyDirData: true},
+		func(message string) { progress = append(progress, message) })
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	attempts := 0
+	for _, pod := range evicted.list() {
+		if pod == "web-1" {
+			attempts++
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("web-1 evicted %d times, want 3", attempts)
+	}
+	blocked := "1 pod(s) blocked by disruption budget: default/web-1 (budget web-pdb: 0 disruptions allowed), retrying"
+	if !contains(progress, blocked) {
+		t.Errorf("missing %q in %q", blocked, progress)
+	}
+	// unchanged blocks are reported only once per interval
+	reports := 0
+	for _, message := range progress {
+		if message == blocked {
+			reports++
+		}
+	}
+	if reports != 1 {
+		t.Errorf("blocked eviction reported %d times, want 1", reports)
+	}
+	if !contains(progress, "pod default/db-1 evicted") || !contains(progress, "pod default/web-1 evicted") {
+		t.Errorf("missing progress messages: %q", progress)
+	}
+}
+
+func TestDrainBudgetTimeout(t *testing.T) {
+	defer func(interval time.Duration) { evictRetryInterval = interval }(evictRetryInterval)
+	evictRetryInterval = 10 * time.Millisecond
+
+	client, _, evicted := newDrainClient(true, testNode("worker1"),
+		testPod("web-1", "worker1", "ReplicaSet"), testBudget("web-pdb", "web-1"))
+	evicted.blocked["web-1"] = -1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.Drain(ctx, "worker1", DrainOptions{DeleteEmptyDirData: true}, nil)
+	if err == nil {
+		t.Fatalf("Drain succeeded despite blocking budget")
+	}
+	if !strings.Contains(err.Error(), "eviction blocked by disruption budget: default/web-1 (budget web-pdb: 0 disruptions allowed)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(evicted.list()) < 2 {
+		t.Errorf("blocked eviction was not retried: %v", evicted.list())
+	}
+}
+
+func contains(list []string, entry string) bool {
+	for _, e := range list {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
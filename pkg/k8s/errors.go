@@ -0,0 +1,53 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Error describes a failed operation on a kubernetes object
+type Error struct {
+	// Op is the operation, e.g. "drain", "evict", "delete" or "apply"
+	Op   string
+	Kind string
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	object := strings.ToLower(e.Kind)
+	if len(e.Name) > 0 {
+		object = object + " " + e.Name
+	}
+	return e.Op + " " + object + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound returns true if the object of the operation does not exist
+func IsNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
+
+// IsBlocked returns true if an eviction was refused because of a
+// PodDisruptionBudget
+func IsBlocked(err error) bool {
+	return apierrors.IsTooManyRequests(err)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Readyz queries the readiness endpoint of the API server
+func (c *Client) Readyz(ctx context.Context) error {
+	_, err := c.clientset.Discovery().RESTClient().Get().AbsPath("/readyz").DoRaw(ctx)
+	if err != nil {
+		return &Error{Op: "query", Kind: "APIServer", Name: "/readyz", Err: err}
+	}
+	return nil
+}
+
+// ServerVersion returns the git version of the API server, e.g. "v1.18.6"
+func (c *Client) ServerVersion() (string, error) {
+	info, err := c.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return "", &Error{Op: "query", Kind: "APIServer", Name: "/version", Err: err}
+	}
+	return info.GitVersion, nil
+}
+
+// ListPods returns all pods of namespace
+func (c *Client) ListPods(ctx context.Context, namespace string) ([]corev1.Pod, error) {
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, &Error{Op: "list", Kind: "Pod", Name: namespace, Err: err}
+	}
+	return pods.Items, nil
+}
+
+// ListDaemonSets returns all DaemonSets of namespace, all namespaces
+// if namespace is empty
+func (c *Client) ListDaemonSets(ctx context.Context, namespace string) ([]appsv1.DaemonSet, error) {
+	daemonsets, err := c.clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, &Error{Op: "list", Kind: "DaemonSet", Name: namespace, Err: err}
+	}
+	return daemonsets.Items, nil
+}
+
+// GetService returns the service name in namespace
+func (c *Client) GetService(ctx context.Context, namespace string, name string) (*corev1.Service, error) {
+	service, err := c.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, &Error{Op: "get", Kind: "Service", Name: namespace + "/" + name, Err: err}
+	}
+	return service, nil
+}
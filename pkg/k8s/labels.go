@@ -0,0 +1,238 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+)
+
+const nodePollInterval = 2 * time.Second
+
+// Labels and taints use the syntax of kubectl: "key=value" sets a label,
+// "key-" removes it. "key=value:Effect" or "key:Effect" sets a taint,
+// "key:Effect-" removes the taint with this effect and "key-" all
+// taints with key.
+
+func parseLabel(label string) (key string, value string, remove bool, err error) {
+	if strings.HasSuffix(label, "-") && !strings.Contains(label, "=") {
+		key = strings.TrimSuffix(label, "-")
+		remove = true
+	} else {
+		entry := strings.SplitN(label, "=", 2)
+		if len(entry) != 2 {
+			return "", "", false, errors.New("invalid label '" + label + "', expected key=value or key-")
+		}
+		key, value = entry[0], entry[1]
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return "", "", false, errors.New("invalid label value '" + value + "': " + strings.Join(errs, "; "))
+		}
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return "", "", false, errors.New("invalid label key '" + key + "': " + strings.Join(errs, "; "))
+	}
+	return key, value, remove, nil
+}
+
+func parseTaint(entry string) (taint corev1.Taint, remove bool, err error) {
+	if strings.HasSuffix(entry, "-") {
+		remove = true
+		entry = strings.TrimSuffix(entry, "-")
+	}
+
+	keyValue := entry
+	if i := strings.LastIndex(entry, ":"); i >= 0 {
+		keyValue = entry[:i]
+		taint.Effect = corev1.TaintEffect(entry[i+1:])
+		switch taint.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return taint, false, errors.New("invalid taint effect '" + string(taint.Effect) + "', valid values are NoSchedule, PreferNoSchedule and NoExecute")
+		}
+	} else if !remove {
+		return taint, false, errors.New("invalid taint '" + entry + "', expected key=value:Effect")
+	}
+
+	pair := strings.SplitN(keyValue, "=", 2)
+	taint.Key = pair[0]
+	if len(pair) == 2 {
+		if remove {
+			return taint, false, errors.New("invalid taint '" + entry + "-', a removal has no value")
+		}
+		taint.Value = pair[1]
+		if errs := validation.IsValidLabelValue(taint.Value); len(errs) > 0 {
+			return taint, false, errors.New("invalid taint value '" + taint.Value + "': " + strings.Join(errs, "; "))
+		}
+	}
+	if errs := validation.IsQualifiedName(taint.Key); len(errs) > 0 {
+		return taint, false, errors.New("invalid taint key '" + taint.Key + "': " + strings.Join(errs, "; "))
+	}
+	return taint, remove, nil
+}
+
+func formatTaint(taint corev1.Taint) string {
+	if len(taint.Value) > 0 {
+		return taint.Key + "=" + taint.Value + ":" + string(taint.Effect)
+	}
+	return taint.Key + ":" + string(taint.Effect)
+}
+
+// mergeTaints applies changes to taints. A taint is identified by
+// key and effect.
+func mergeTaints(taints []corev1.Taint, changes []string) ([]corev1.Taint, error) {
+	for _, change := range changes {
+		taint, remove, err := parseTaint(change)
+		if err != nil {
+			return nil, err
+		}
+		var result []corev1.Taint
+		for _, existing := range taints {
+			if existing.Key == taint.Key && (len(taint.Effect) == 0 || existing.Effect == taint.Effect) {
+				continue
+			}
+			result = append(result, existing)
+		}
+		if !remove {
+			result = append(result, taint)
+		}
+		taints = result
+	}
+	return taints, nil
+}
+
+// MergeLabels applies the changes to the list of labels and returns
+// the sorted result
+func MergeLabels(labels []string, changes []string) ([]string, error) {
+	set := make(map[string]string)
+	for _, label := range append(append([]string{}, labels...), changes...) {
+		key, value, remove, err := parseLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		if remove {
+			delete(set, key)
+		} else {
+			set[key] = value
+		}
+	}
+
+	var result []string
+	for key, value := range set {
+		result = append(result, key+"="+value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// MergeTaints applies the changes to the list of taints and returns
+// the sorted result
+func MergeTaints(taints []string, changes []string) ([]string, error) {
+	merged, err := mergeTaints(nil, append(append([]string{}, taints...), changes...))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, taint := range merged {
+		result = append(result, formatTaint(taint))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// UpdateLabels sets or removes the labels of node
+func (c *Client) UpdateLabels(ctx context.Context, node string, changes []string) error {
+	labels := make(map[string]interface{})
+	for _, change := range changes {
+		key, value, remove, err := parseLabel(change)
+		if err != nil {
+			return &Error{Op: "label", Kind: "Node", Name: node, Err: err}
+		}
+		if remove {
+			labels[key] = nil
+		} else {
+			labels[key] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return &Error{Op: "label", Kind: "Node", Name: node, Err: err}
+	}
+	_, err = c.clientset.CoreV1().Nodes().Patch(ctx, node, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: FieldManager})
+	if err != nil {
+		return &Error{Op: "label", Kind: "Node", Name: node, Err: err}
+	}
+	return nil
+}
+
+// UpdateTaints sets or removes the taints of node
+func (c *Client) UpdateTaints(ctx context.Context, node string, changes []string) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := c.clientset.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		taints, err := mergeTaints(current.Spec.Taints, changes)
+		if err != nil {
+			return err
+		}
+		current.Spec.Taints = taints
+		_, err = c.clientset.CoreV1().Nodes().Update(ctx, current, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+	if err != nil {
+		return &Error{Op: "taint", Kind: "Node", Name: node, Err: err}
+	}
+	return nil
+}
+
+// WaitForNode waits until node is registered, e.g. after a join
+func (c *Client) WaitForNode(ctx context.Context, node string) error {
+	for {
+		_, err := c.clientset.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+		if err == nil {
+			return nil
+		}
+		if !IsNotFound(err) && ctx.Err() == nil {
+			return &Error{Op: "wait for", Kind: "Node", Name: node, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return &Error{Op: "wait for", Kind: "Node", Name: node, Err: err}
+		case <-time.After(nodePollInterval):
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Cordon marks node as unschedulable
+func (c *Client) Cordon(ctx context.Context, node string) error {
+	return c.setUnschedulable(ctx, "cordon", node, true)
+}
+
+// Uncordon marks node as schedulable again
+func (c *Client) Uncordon(ctx context.Context, node string) error {
+	return c.setUnschedulable(ctx, "uncordon", node, false)
+}
+
+func (c *Client) setUnschedulable(ctx context.Context, op string, node string, unschedulable bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"unschedulable": unschedulable},
+	})
+	if err != nil {
+		return &Error{Op: op, Kind: "Node", Name: node, Err: err}
+	}
+	_, err = c.clientset.CoreV1().Nodes().Patch(ctx, node, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return &Error{Op: op, Kind: "Node", Name: node, Err: err}
+	}
+	return nil
+}
+
+// ListNodes returns all nodes of the cluster
+func (c *Client) ListNodes(ctx context.Context) ([]corev1.Node, error) {
+	nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, &Error{Op: "list", Kind: "Node", Err: err}
+	}
+	return nodes.Items, nil
+}
+
+// DeleteNode removes node from the cluster
+func (c *Client) DeleteNode(ctx context.Context, node string) error {
+	err := c.clientset.CoreV1().Nodes().Delete(ctx, node, metav1.DeleteOptions{})
+	if err != nil {
+		return &Error{Op: "delete", Kind: "Node", Name: node, Err: err}
+	}
+	return nil
+}
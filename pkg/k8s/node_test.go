@@ -0,0 +1,78 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCordonUncordon(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("worker1"))
+	client := NewClientFromInterfaces(clientset, nil, nil)
+	ctx := context.Background()
+
+	for _, cordon := range []bool{true, false} {
+		var err error
+		if cordon {
+			err = client.Cordon(ctx, "worker1")
+		} else {
+			err = client.Uncordon(ctx, "worker1")
+		}
+		if err != nil {
+			t.Fatalf("cordon %v failed: %v", cordon, err)
+		}
+		node, err := clientset.CoreV1().Nodes().Get(ctx, "worker1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get node failed: %v", err)
+		}
+		if node.Spec.Unschedulable != cordon {
+			t.Errorf("unschedulable is %v, want %v", node.Spec.Unschedulable, cordon)
+		}
+	}
+
+	err := client.Cordon(ctx, "worker2")
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("Cordon of missing node returned %v", err)
+	}
+}
+
+func TestDeleteNode(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("worker1"), testNode("worker2"))
+	client := NewClientFromInterfaces(clientset, nil, nil)
+	ctx := context.Background()
+
+	if err := client.DeleteNode(ctx, "worker1"); err != nil {
+		t.Fatalf("DeleteNode failed: %v", err)
+	}
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		t.Fatalf("ListNodes failed: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "worker2" {
+		t.Errorf("remaining nodes %v, want worker2", nodes)
+	}
+
+	err = client.DeleteNode(ctx, "worker1")
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("second DeleteNode returned %v, want not found", err)
+	}
+	if err != nil && err.Error() != `delete node worker1: nodes "worker1" not found` {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
@@ -15,12 +15,14 @@
 package kubeadm
 
 import (
+	"context"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
@@ -29,37 +31,63 @@ var (
 	token_create_time time.Time
 )
 
-func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
+// addNodeStream serializes the messages, nodes are added in parallel
+type addNodeStream struct {
+	pb.Kubeadm_AddNodeServer
+	mu sync.Mutex
+}
+
+func (s *addNodeStream) Send(reply *pb.StatusReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Kubeadm_AddNodeServer.Send(reply)
+}
+
+func AddNode(ctx context.Context, executor tools.NodeExecutor, in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 	// XXX Check if node isn't already part of the kubernetes cluster
 
+	stream = &addNodeStream{Kubeadm_AddNodeServer: stream}
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	// validate labels and taints before changing anything
+	if _, err := k8s.MergeLabels(nil, in.Labels); err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	if _, err := k8s.MergeTaints(nil, in.Taints); err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+
 	haproxy_salt := ""
 	nodeNames := in.NodeNames
 	nodeType := in.Type
 	master_salt := Read_Cfg("control-plane.conf", "master")
 
+	joincmd := joincmd_g
+
 	// If the join command is older than 23 hours, generate a new one. Else re-use the old one.
-	if time.Since(token_create_time).Hours() > 23 {
+	if time.Since(token_create_time).Hours() > 23 || tools.IsDryRun(executor) {
 		stream.Send(&pb.StatusReply{Success: true, Message: "Generate new token ..."})
 		log.Info("Token to join nodes too old, creating new one")
 
-		success, token := executeCmdSalt(master_salt, "kubeadm", "token", "create", "--print-join-command")
+		success, token := tools.RetryStep(ctx, tools.StepKubeadm,
+			tools.StreamAttempts(stream, master_salt, "kubeadm token create"),
+			func(ctx context.Context) (bool, string) {
+				return executor.Run(ctx, master_salt, "kubeadm", "token", "create", "--print-join-command")
+			})
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: token}); err != nil {
 				return err
 			}
 			return nil
 		}
-		if len(master_salt) > 0 {
-			token = strings.Replace(token, "\n", "", -1)
-			i := strings.Index(token, ":") + 1
-			token = strings.TrimSpace(token[i:])
+		joincmd = strings.TrimSpace(token)
+		// a dry-run does not create a token
+		if !tools.IsDryRun(executor) {
+			joincmd_g = joincmd
+			token_create_time = time.Now()
 		}
-		joincmd_g = strings.TrimSuffix(token, "\n")
-		token_create_time = time.Now()
 	}
 
-	joincmd := joincmd_g
-
 	// if nodeType is not set, assume worker
 	if len(nodeType) == 0 {
 		nodeType = "worker"
@@ -69,59 +97,62 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 		joincmd = joincmd + " --control-plane"
 
 		stream.Send(&pb.StatusReply{Success: true, Message: "Upload certificates ..."})
-		success, lines := executeCmdSalt(master_salt, "kubeadm", "init", "phase", "upload-certs", "--upload-certs")
+		success, lines := tools.RetryStep(ctx, tools.StepKubeadm,
+			tools.StreamAttempts(stream, master_salt, "kubeadm upload-certs"),
+			func(ctx context.Context) (bool, string) {
+				return executor.Run(ctx, master_salt, "kubeadm", "init", "phase", "upload-certs", "--upload-certs")
+			})
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: lines}); err != nil {
 				return err
 			}
 			return nil
 		}
-		// the key is the third line in the output
-		cert_key := strings.Split(strings.Replace(lines, ":", "", -1), "\n")
-		joincmd = joincmd + " --certificate-key " + strings.TrimSuffix(string(cert_key[2]), "\n")
+		// the key is the last line in the output
+		cert_key := strings.Split(strings.TrimSpace(lines), "\n")
+		joincmd = joincmd + " --certificate-key " + strings.TrimSpace(cert_key[len(cert_key)-1])
 		haproxy_salt = Read_Cfg("control-plane.conf", "loadbalancer_salt")
 	}
 
 	// Ping all nodes to get an exact list of node names
-	var success bool
-	var message string
-	var nodelist []string
-
-	// Differentiate between 'name1,name2' and 'name[1,2]'
-	if strings.Index(nodeNames, ",") >= 0 && strings.Index(nodeNames, "[") == -1 {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt",
-			"-L", nodeNames, "test.ping")
-	} else {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt",
-			nodeNames, "test.ping")
+	results, err := tools.PingNodes(ctx, executor, nodeNames, tools.StreamAttempts(stream, "", "ping"))
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
 	}
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+	if len(results) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "No nodes found matching '" + nodeNames + "'"}); err != nil {
 			return err
 		}
 		return nil
 	}
-	// we have a list of minions, only use the one where the line ends with "True"
-	list := strings.Split(message, "\n")
-	for _, entry := range list {
-		if strings.HasSuffix(entry, ": True") {
-			list := strings.Split(entry, ":")
-			nodelist = append(nodelist, list[0])
+
+	failed := 0
+	for _, node := range results.Failed() {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": not reachable: " + results[node].Error().Error()}); err != nil {
+			log.Errorf("Send message failed: %s", err)
 		}
+		failed++
 	}
 
+	nodelist := results.Succeeded()
 	nodelistLength := len(nodelist)
 	var wg sync.WaitGroup
 	wg.Add(nodelistLength)
 
-	failed := 0
 	for i := 0; i < nodelistLength; i++ {
 		go func(i int) {
 			defer wg.Done()
 
 			stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": adding node..."})
+			report := tools.StreamAttempts(stream, nodelist[i], "service")
 
-			success, message := tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "service.start", "crio")
+			success, message := tools.RetryStep(ctx, tools.StepService, report,
+				func(ctx context.Context) (bool, string) {
+					return executor.ServiceStart(ctx, nodelist[i], "crio")
+				})
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -129,7 +160,10 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "service.enable", "crio")
+			success, message = tools.RetryStep(ctx, tools.StepService, report,
+				func(ctx context.Context) (bool, string) {
+					return executor.ServiceEnable(ctx, nodelist[i], "crio")
+				})
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -137,7 +171,10 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "service.start", "kubelet")
+			success, message = tools.RetryStep(ctx, tools.StepService, report,
+				func(ctx context.Context) (bool, string) {
+					return executor.ServiceStart(ctx, nodelist[i], "kubelet")
+				})
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -145,7 +182,10 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "service.enable", "kubelet")
+			success, message = tools.RetryStep(ctx, tools.StepService, report,
+				func(ctx context.Context) (bool, string) {
+					return executor.ServiceEnable(ctx, nodelist[i], "kubelet")
+				})
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -156,7 +196,18 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 
 			stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": joining cluster..."})
 
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "cmd.run", "\""+joincmd+"\"")
+			attempt := 0
+			success, message = tools.RetryStep(ctx, tools.StepJoin,
+				tools.StreamAttempts(stream, nodelist[i], "kubeadm join"),
+				func(ctx context.Context) (bool, string) {
+					// cleanup behind the failed join before trying again
+					if attempt > 0 {
+						executor.Run(ctx, nodelist[i], "kubeadm", "reset", "--force")
+					}
+					attempt++
+					return executor.RunStream(ctx, nodelist[i],
+						tools.StreamOutput(stream, nodelist[i], "kubeadm join"), joincmd)
+				})
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -164,7 +215,7 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "grains.append", "kubicd", "kubic-"+nodeType+"-node")
+			success, message = executor.GrainsAppend(ctx, nodelist[i], "kubicd", "kubic-"+nodeType+"-node")
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -173,7 +224,7 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				return
 			}
 			// Configure transactinal-update
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "cmd.run", "if [ -f /etc/transactional-update.conf ]; then grep -q ^REBOOT_METHOD= /etc/transactional-update.conf && sed -i -e 's|REBOOT_METHOD=.*|REBOOT_METHOD=kured|g' /etc/transactional-update.conf || echo REBOOT_METHOD=kured >> /etc/transactional-update.conf ; else echo REBOOT_METHOD=kured > /etc/transactional-update.conf ; fi")
+			success, message = executor.Run(ctx, nodelist[i], "if [ -f /etc/transactional-update.conf ]; then grep -q ^REBOOT_METHOD= /etc/transactional-update.conf && sed -i -e 's|REBOOT_METHOD=.*|REBOOT_METHOD=kured|g' /etc/transactional-update.conf || echo REBOOT_METHOD=kured >> /etc/transactional-update.conf ; else echo REBOOT_METHOD=kured > /etc/transactional-update.conf ; fi")
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 					log.Errorf("Send message failed: %s", err)
@@ -181,11 +232,28 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
+			// Apply the stored and the new labels and taints
+			labels, taints, err := updateNodeConfig(executor, nodelist[i], in.Labels, in.Taints)
+			if err == nil && (len(labels) > 0 || len(taints) > 0) {
+				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": setting labels and taints..."})
+				var hostname string
+				hostname, err = executor.GetHostname(ctx, nodelist[i])
+				if err == nil {
+					err = applyNodeConfig(ctx, executor, hostname, labels, taints, true)
+				}
+			}
+			if err != nil {
+				if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + err.Error()}); err != nil {
+					log.Errorf("Send message failed: %s", err)
+				}
+				failed++
+				return
+			}
 			// If master and loadbalancer is known, add to haproxy
 			if len(haproxy_salt) > 0 {
 				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": adding node to haproxy loadbalancer..."})
 
-				success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", haproxy_salt, "cmd.run", "haproxycfg server add "+nodelist[i])
+				success, message = executor.Run(ctx, haproxy_salt, "haproxycfg", "server", "add", nodelist[i])
 				if success != true {
 					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 						log.Errorf("Send message failed: %s", err)
@@ -0,0 +1,80 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+func TestAddNodeJoinFailure(t *testing.T) {
+	setupStateDir(t, map[string]string{"master": "master1"})
+	// always create a new token
+	t.Cleanup(func() {
+		joincmd_g = ""
+		token_create_time = time.Time{}
+	})
+	token_create_time = time.Time{}
+
+	executor := tools.NewFakeExecutor()
+	for _, node := range []string{"master1", "worker1", "worker2"} {
+		executor.AddNode(node, node)
+	}
+	executor.Output["master1: kubeadm token create --print-join-command"] =
+		"kubeadm join 10.0.0.1:6443 --token abcdef.0123456789abcdef\n"
+	executor.Failures["worker2: kubeadm join"] = "error execution phase preflight: Port-10250 is in use"
+
+	stream := &recordStream{}
+	if err := AddNode(testContext(), executor, &pb.AddNodeRequest{NodeNames: "worker[1,2]"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			stream.dump(t)
+		}
+	}()
+
+	// worker1 joined and is known to kubicd
+	if reply := stream.find("worker1: node successful added"); reply == nil || !reply.Success {
+		t.Errorf("worker1 was not added")
+	}
+	if grains := executor.Grains["worker1"]["kubicd"]; len(grains) != 1 || grains[0] != "kubic-worker-node" {
+		t.Errorf("worker1 has kubicd grain %v", grains)
+	}
+	if contains(executor.History, "worker1: kubeadm reset") {
+		t.Errorf("worker1 got reset")
+	}
+
+	// worker2 got reset before the second attempt and gave up
+	if !contains(executor.History, "worker2: kubeadm reset --force") {
+		t.Errorf("worker2 was not reset before retrying the join")
+	}
+	if reply := stream.find("worker2: error execution phase preflight: Port-10250 is in use (giving up after 2 attempts)"); reply == nil || reply.Success {
+		t.Errorf("join failure of worker2 not reported")
+	}
+	if grains := executor.Grains["worker2"]; len(grains) != 0 {
+		t.Errorf("worker2 has grains %v", grains)
+	}
+	if stream.find("worker2: node successful added") != nil {
+		t.Errorf("worker2 reported as added")
+	}
+
+	if last := stream.last(); last.Success || last.Message != "An error occured during adding Node(s)" {
+		t.Errorf("last reply is %v: %q", last.Success, last.Message)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const dnsTestName = "kubernetes.default.svc.cluster.local"
+
+// staticPods are the control-plane components kubeadm runs on every master
+var staticPods = []string{"etcd", "kube-apiserver", "kube-controller-manager", "kube-scheduler"}
+
+// addonDaemonSets maps the manifests deployed by kubicd to the name
+// prefix of their DaemonSet
+var addonDaemonSets = []struct {
+	yaml   string
+	prefix string
+}{
+	{weave_yaml, "weave-net"},
+	{flannel_yaml, "kube-flannel-ds"},
+	{kured_yaml, "kured"},
+}
+
+type healthCheckFunc func(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error
+
+// healthSender is implemented by all server streams of HealthReply
+type healthSender interface {
+	Send(*pb.HealthReply) error
+}
+
+func sendHealth(stream healthSender, check string, status pb.HealthStatus, object string, message string) error {
+	if err := stream.Send(&pb.HealthReply{Check: check, Status: status,
+		Object: object, Message: message}); err != nil {
+		log.Errorf("Send message failed: %s", err)
+		return err
+	}
+	return nil
+}
+
+// CheckHealth verifies the API server, the control-plane pods, etcd,
+// the nodes, the addon DaemonSets and the cluster DNS. Every check
+// sends it's own result.
+func CheckHealth(ctx context.Context, executor tools.NodeExecutor, in *pb.Empty, stream pb.Kubeadm_CheckHealthServer) error {
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return sendHealth(stream, "apiserver", pb.HealthStatus_FAIL, k8s.AdminConf, err.Error())
+	}
+
+	for _, check := range []healthCheckFunc{checkAPIServer, checkStaticPods,
+		checkEtcd, checkNodes, checkDaemonSets, checkDNS} {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := check(ctx, executor, client, stream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAPIServer verifies, that the API server is reachable through
+// the load balancer
+func checkAPIServer(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	loadbalancer := Read_Cfg("control-plane.conf", "loadbalancer_dns")
+	if len(loadbalancer) == 0 {
+		if err := client.Readyz(ctx); err != nil {
+			return sendHealth(stream, "apiserver", pb.HealthStatus_FAIL, "", err.Error())
+		}
+		return sendHealth(stream, "apiserver", pb.HealthStatus_PASS, "", "API server is ready, no load balancer configured")
+	}
+
+	server := "https://" + net.JoinHostPort(loadbalancer, "6443")
+	lbClient, err := k8s.NewClientForServer(k8s.AdminConf, server)
+	if err == nil {
+		err = lbClient.Readyz(ctx)
+	}
+	if err != nil {
+		return sendHealth(stream, "apiserver", pb.HealthStatus_FAIL, loadbalancer, err.Error())
+	}
+	return sendHealth(stream, "apiserver", pb.HealthStatus_PASS, loadbalancer, "API server is ready")
+}
+
+// checkStaticPods verifies, that all control-plane components are
+// running and ready on every master
+func checkStaticPods(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return sendHealth(stream, "static-pod", pb.HealthStatus_FAIL, "", err.Error())
+	}
+	pods, err := client.ListPods(ctx, "kube-system")
+	if err != nil {
+		return sendHealth(stream, "static-pod", pb.HealthStatus_FAIL, "", err.Error())
+	}
+	podsByName := make(map[string]corev1.Pod)
+	for _, pod := range pods {
+		podsByName[pod.Name] = pod
+	}
+
+	for _, node := range nodes {
+		if kubernetesRole(node) != "master" {
+			continue
+		}
+		for _, component := range staticPods {
+			name := component + "-" + node.Name
+			pod, ok := podsByName[name]
+			if !ok {
+				err = sendHealth(stream, "static-pod", pb.HealthStatus_FAIL, name, "not running")
+			} else if !podReady(pod) {
+				err = sendHealth(stream, "static-pod", pb.HealthStatus_FAIL, name, "not ready, phase "+string(pod.Status.Phase))
+			} else {
+				err = sendHealth(stream, "static-pod", pb.HealthStatus_PASS, name, "ready")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkEtcd verifies the health of every etcd member
+func checkEtcd(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	return etcdHealth(ctx, executor, stream)
+}
+
+// checkNodes verifies the Ready condition of every node
+func checkNodes(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return sendHealth(stream, "node", pb.HealthStatus_FAIL, "", err.Error())
+	}
+
+	for _, node := range nodes {
+		ready := nodeReady(node)
+		if ready != corev1.ConditionTrue {
+			err = sendHealth(stream, "node", pb.HealthStatus_FAIL, node.Name, "Ready condition is "+string(ready))
+		} else if node.Spec.Unschedulable {
+			err = sendHealth(stream, "node", pb.HealthStatus_WARN, node.Name, "ready, but scheduling disabled")
+		} else {
+			err = sendHealth(stream, "node", pb.HealthStatus_PASS, node.Name, "ready")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDaemonSets verifies the rollout of the pod network and kured
+func checkDaemonSets(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	daemonsets, err := client.ListDaemonSets(ctx, "")
+	if err != nil {
+		return sendHealth(stream, "daemonset", pb.HealthStatus_FAIL, "", err.Error())
+	}
+
+	for _, addon := range addonDaemonSets {
+		found := false
+		for _, ds := range daemonsets {
+			if !strings.HasPrefix(ds.Name, addon.prefix) {
+				continue
+			}
+			found = true
+			if err := sendDaemonSetHealth(stream, ds); err != nil {
+				return err
+			}
+		}
+		if !found && len(Read_Cfg("k8s-yaml.conf", addon.yaml)) > 0 {
+			if err := sendHealth(stream, "daemonset", pb.HealthStatus_FAIL, addon.prefix,
+				"deployed with "+addon.yaml+", but not found"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sendDaemonSetHealth(stream pb.Kubeadm_CheckHealthServer, ds appsv1.DaemonSet) error {
+	name := ds.Namespace + "/" + ds.Name
+	desired := ds.Status.DesiredNumberScheduled
+	status := strconv.Itoa(int(ds.Status.UpdatedNumberScheduled)) + " of " +
+		strconv.Itoa(int(desired)) + " pods updated, " +
+		strconv.Itoa(int(ds.Status.NumberAvailable)) + " available"
+
+	if ds.Status.ObservedGeneration < ds.Generation ||
+		ds.Status.UpdatedNumberScheduled != desired ||
+		ds.Status.NumberAvailable != desired {
+		return sendHealth(stream, "daemonset", pb.HealthStatus_FAIL, name, "rollout not complete: "+status)
+	}
+	return sendHealth(stream, "daemonset", pb.HealthStatus_PASS, name, status)
+}
+
+// checkDNS resolves the kubernetes service with the cluster DNS. Cluster
+// IPs are only routable on the nodes of the cluster, so if kubicd does not
+// run on the first master, a failed lookup is only a warning.
+func checkDNS(ctx context.Context, executor tools.NodeExecutor, client *k8s.Client, stream pb.Kubeadm_CheckHealthServer) error {
+	service, err := client.GetService(ctx, "kube-system", "kube-dns")
+	if err != nil {
+		return sendHealth(stream, "dns", pb.HealthStatus_FAIL, dnsTestName, err.Error())
+	}
+	server := net.JoinHostPort(service.Spec.ClusterIP, "53")
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	addresses, err := resolver.LookupHost(lookupCtx, dnsTestName)
+	if err != nil {
+		if len(Read_Cfg("control-plane.conf", "master")) > 0 {
+			return sendHealth(stream, "dns", pb.HealthStatus_WARN, dnsTestName, "lookup via "+server+
+				" failed, the cluster IP may not be reachable from the kubicd host: "+err.Error())
+		}
+		return sendHealth(stream, "dns", pb.HealthStatus_FAIL, dnsTestName, "lookup via "+server+" failed: "+err.Error())
+	}
+	return sendHealth(stream, "dns", pb.HealthStatus_PASS, dnsTestName, "resolved to "+strings.Join(addresses, ", "))
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func nodeReady(node corev1.Node) corev1.ConditionStatus {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status
+		}
+	}
+	return corev1.ConditionUnknown
+}
@@ -15,12 +15,14 @@
 package kubeadm
 
 import (
+	"context"
+
 	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-func DestroyMaster(in *pb.Empty, stream pb.Kubeadm_DestroyMasterServer) error {
-	success, message := ResetMaster()
+func DestroyMaster(ctx context.Context, executor tools.NodeExecutor, in *pb.Empty, stream pb.Kubeadm_DestroyMasterServer) error {
+	success, message := ResetMaster(ctx, executor)
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: message + " (ignored)"}); err != nil {
 			return err
@@ -28,14 +30,14 @@ func DestroyMaster(in *pb.Empty, stream pb.Kubeadm_DestroyMasterServer) error {
 		// ignore error
 	}
 	// Try some system cleanup, ignore if fails
-	tools.ExecuteCmd("/bin/sh", "-c", "sed -i -e 's|^REBOOT_METHOD=kured|REBOOT_METHOD=auto|g' /etc/transactional-update.conf")
-	success, message = tools.ExecuteCmd("/bin/sh", "-c", "iptables -F && iptables -t nat -F && iptables -t mangle -F && iptables -X")
+	executor.Run(ctx, "", "/bin/sh", "-c", "sed -i -e 's|^REBOOT_METHOD=kured|REBOOT_METHOD=auto|g' /etc/transactional-update.conf")
+	success, message = executor.Run(ctx, "", "/bin/sh", "-c", "iptables -F && iptables -t nat -F && iptables -t mangle -F && iptables -X")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Warning: removal of iptables failed."}); err != nil {
 			return err
 		}
 	}
-	tools.ExecuteCmd("/bin/sh", "-c", "ip link delete cni0; ip link delete flannel.1")
+	executor.Run(ctx, "", "/bin/sh", "-c", "ip link delete cni0; ip link delete flannel.1")
 
 	return nil
 }
@@ -0,0 +1,153 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/etcd"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// formatSize returns size in a human readable format
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// allHealthy returns an error if one of the members is unhealthy
+func allHealthy(endpoints []etcd.EndpointStatus) error {
+	var unhealthy []string
+	for _, endpoint := range endpoints {
+		if endpoint.Err != nil {
+			unhealthy = append(unhealthy, endpoint.Member.Name+" ("+endpoint.Err.Error()+")")
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("unhealthy etcd members: %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
+}
+
+// EtcdMaintain compacts the etcd key space to the current revision and
+// defragments the members one after the other, the leader last. All
+// members have to be healthy before every step.
+func EtcdMaintain(ctx context.Context, executor tools.NodeExecutor, in *pb.MaintainRequest, stream pb.Etcd_MaintainServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	defer client.Close()
+
+	// no master reboot or removal while a member is blocked
+	if err := acquireMasterLock(ctx); err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	defer releaseMasterLock()
+
+	endpoints, err := client.Health(ctx)
+	if err == nil {
+		err = allHealthy(endpoints)
+	}
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	var before int64
+	for _, endpoint := range endpoints {
+		before += endpoint.DBSize
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: endpoint.Member.Name + ": db size " +
+			formatSize(endpoint.DBSize) + ", in use " + formatSize(endpoint.DBSizeInUse)}); err != nil {
+			return err
+		}
+	}
+
+	revision, err := client.Revision(ctx)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: fmt.Sprintf("Compact etcd to revision %d...", revision)}); err != nil {
+		return err
+	}
+	if !tools.DryRun(executor, fmt.Sprintf("compact etcd to revision %d", revision)) {
+		if err := client.Compact(ctx, revision); err != nil {
+			return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+		}
+	}
+
+	// followers first, the leader last, so that there is only one
+	// leader election at most
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return !endpoints[i].Leader && endpoints[j].Leader
+	})
+
+	var after int64
+	for _, endpoint := range endpoints {
+		role := "follower"
+		if endpoint.Leader {
+			role = "leader"
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: endpoint.Member.Name + ": defragment " + role + "..."}); err != nil {
+			return err
+		}
+		if !tools.DryRun(executor, "defragment etcd member "+endpoint.Member.Name+" ("+endpoint.Endpoint+")") {
+			if err := client.Defragment(ctx, endpoint.Endpoint); err != nil {
+				return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+			}
+		}
+
+		// the next member only after all are healthy again
+		var current []etcd.EndpointStatus
+		err := waitForEtcd(ctx, executor, "all etcd members to become healthy", func(ctx context.Context) bool {
+			endpoints, err := client.Health(ctx)
+			if err != nil || allHealthy(endpoints) != nil {
+				return false
+			}
+			current = endpoints
+			return true
+		})
+		if err != nil {
+			return stream.Send(&pb.StatusReply{Success: false, Message: endpoint.Member.Name + ": " + err.Error()})
+		}
+
+		size := endpoint.DBSize
+		for _, status := range current {
+			if status.Member.ID == endpoint.Member.ID {
+				size = status.DBSize
+			}
+		}
+		after += size
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: endpoint.Member.Name + ": db size " +
+			formatSize(endpoint.DBSize) + " -> " + formatSize(size)}); err != nil {
+			return err
+		}
+	}
+
+	return stream.Send(&pb.StatusReply{Success: true, Message: "etcd maintenance finished, db size of all members " +
+		formatSize(before) + " -> " + formatSize(after)})
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/etcd"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// etcdEndpoints returns the client URLs of etcd on all known masters.
+// The masters are taken from kubernetes, the first master is always
+// part of the list.
+func etcdEndpoints(ctx context.Context, executor tools.NodeExecutor) []string {
+	var endpoints []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		endpoint := "https://" + host + ":2379"
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if len(firstMaster) == 0 {
+		add("127.0.0.1")
+	} else if hostname, err := executor.GetHostname(ctx, firstMaster); err == nil {
+		add(hostname)
+	}
+
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return endpoints
+	}
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return endpoints
+	}
+	for _, node := range nodes {
+		if kubernetesRole(node) != "master" {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == corev1.NodeInternalIP {
+				add(address.Address)
+			}
+		}
+	}
+	return endpoints
+}
+
+// etcdCredentials returns the etcd client certificates. If kubicd does
+// not run on the first master, they are fetched from it.
+func etcdCredentials(ctx context.Context, executor tools.NodeExecutor) (etcd.Credentials, error) {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if len(firstMaster) == 0 {
+		return etcd.LoadCredentials()
+	}
+
+	var files [3]string
+	for i, file := range []string{etcd.CAFile, etcd.CertFile, etcd.KeyFile} {
+		success, message := executor.Run(ctx, firstMaster, "cat", file)
+		if success != true {
+			return etcd.Credentials{}, fmt.Errorf("cannot fetch %s from %s: %s", file, firstMaster, message)
+		}
+		files[i] = message
+	}
+	return etcd.Credentials{CA: []byte(files[0]), Cert: []byte(files[1]), Key: []byte(files[2])}, nil
+}
+
+// newEtcdClient creates a client for the etcd cluster of the masters.
+// Tests replace it to work with a fake cluster.
+var newEtcdClient = func(ctx context.Context, executor tools.NodeExecutor) (*etcd.Client, error) {
+	credentials, err := etcdCredentials(ctx, executor)
+	if err != nil {
+		return nil, err
+	}
+	return etcd.NewClient(etcdEndpoints(ctx, executor), credentials)
+}
+
+// removeEtcdMember removes the member name from the etcd cluster. It is
+// no error if there is no such member.
+func removeEtcdMember(ctx context.Context, executor tools.NodeExecutor, name string) (bool, string) {
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer client.Close()
+
+	member, err := client.FindMember(ctx, name)
+	if etcd.IsNotFound(err) {
+		return true, ""
+	}
+	if err != nil {
+		return false, err.Error()
+	}
+	if tools.DryRun(executor, "remove etcd member "+member.Name+" ("+member.IDString()+")") {
+		return true, ""
+	}
+	if err := client.RemoveMember(ctx, member); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// ListEtcdMembers returns all members of the etcd cluster
+func ListEtcdMembers(ctx context.Context, executor tools.NodeExecutor) (bool, string, []*pb.EtcdMember) {
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+	defer client.Close()
+
+	members, err := client.ListMembers(ctx)
+	if err != nil {
+		return false, err.Error(), nil
+	}
+
+	var list []*pb.EtcdMember
+	for _, member := range members {
+		list = append(list, &pb.EtcdMember{
+			Id:         member.IDString(),
+			Name:       member.Name,
+			PeerUrls:   member.PeerURLs,
+			ClientUrls: member.ClientURLs,
+			Learner:    member.IsLearner,
+		})
+	}
+	return true, "", list
+}
+
+// RemoveEtcdMember removes a member, given by name or ID, from the etcd
+// cluster
+func RemoveEtcdMember(ctx context.Context, executor tools.NodeExecutor, in *pb.RemoveMemberRequest) (bool, string) {
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer client.Close()
+
+	member, err := client.FindMember(ctx, in.Member)
+	if err != nil {
+		return false, err.Error()
+	}
+	if tools.DryRun(executor, "remove etcd member "+member.Name+" ("+member.IDString()+")") {
+		return true, ""
+	}
+	if err := client.RemoveMember(ctx, member); err != nil {
+		return false, err.Error()
+	}
+	return true, "etcd member " + member.Name + " (" + member.IDString() + ") removed"
+}
+
+// etcdHealth sends the health of every etcd member
+func etcdHealth(ctx context.Context, executor tools.NodeExecutor, stream healthSender) error {
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return sendHealth(stream, "etcd", pb.HealthStatus_FAIL, "", err.Error())
+	}
+	defer client.Close()
+
+	endpoints, err := client.Health(ctx)
+	if err != nil {
+		return sendHealth(stream, "etcd", pb.HealthStatus_FAIL, "", err.Error())
+	}
+	if len(endpoints) == 0 {
+		return sendHealth(stream, "etcd", pb.HealthStatus_FAIL, "", "no etcd members found")
+	}
+
+	for _, endpoint := range endpoints {
+		object := endpoint.Member.Name
+		if len(endpoint.Endpoint) > 0 {
+			object = object + " (" + endpoint.Endpoint + ")"
+		}
+		var err error
+		if endpoint.Err != nil {
+			err = sendHealth(stream, "etcd", pb.HealthStatus_FAIL, object, "unhealthy: "+endpoint.Err.Error())
+		} else {
+			var details []string
+			if endpoint.Leader {
+				details = append(details, "leader")
+			}
+			details = append(details, "version "+endpoint.Version,
+				fmt.Sprintf("db size %d bytes", endpoint.DBSize))
+			err = sendHealth(stream, "etcd", pb.HealthStatus_PASS, object, "healthy, "+strings.Join(details, ", "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EtcdHealth reports the health of every etcd member
+func EtcdHealth(ctx context.Context, executor tools.NodeExecutor, stream pb.Etcd_HealthServer) error {
+	return etcdHealth(ctx, executor, stream)
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+const (
+	manifestDir        = "/etc/kubernetes/manifests"
+	restoreManifestDir = "/etc/kubernetes/manifests.restore"
+	etcdWaitTimeout    = 5 * time.Minute
+	etcdPollInterval   = 5 * time.Second
+)
+
+// etcdMember is the etcd configuration of a master as found in the
+// static pod manifest
+type etcdMember struct {
+	// salt node, empty for the local machine
+	node    string
+	name    string
+	peerURL string
+	dataDir string
+}
+
+// restoreToken returns the token, which confirms the restore of snapshot
+func restoreToken(snapshot *pb.SnapshotInfo) string {
+	if len(snapshot.Sha256) < 12 {
+		return snapshot.Name
+	}
+	return snapshot.Sha256[:12]
+}
+
+// masterName returns the name of the salt node for messages
+func masterName(node string) string {
+	if len(node) == 0 {
+		return "local"
+	}
+	return node
+}
+
+// readEtcdMember reads the etcd configuration from the static pod
+// manifest on node
+func readEtcdMember(ctx context.Context, executor tools.NodeExecutor, node string) (*etcdMember, error) {
+	success, message := executor.Run(ctx, node, "cat", manifestDir+"/etcd.yaml")
+	if success != true {
+		return nil, errors.New(message)
+	}
+
+	member := &etcdMember{node: node, dataDir: "/var/lib/etcd"}
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "-"))
+		switch {
+		case strings.HasPrefix(line, "--name="):
+			member.name = strings.TrimPrefix(line, "--name=")
+		case strings.HasPrefix(line, "--initial-advertise-peer-urls="):
+			member.peerURL = strings.TrimPrefix(line, "--initial-advertise-peer-urls=")
+		case strings.HasPrefix(line, "--data-dir="):
+			member.dataDir = strings.TrimPrefix(line, "--data-dir=")
+		}
+	}
+	if len(member.name) == 0 || len(member.peerURL) == 0 {
+		if tools.IsDryRun(executor) {
+			// etcd.yaml is missing on this machine
+			member.name = "<" + masterName(node) + ">"
+			member.peerURL = "<peer-url>"
+			return member, nil
+		}
+		return nil, errors.New("cannot find name and peer URL of etcd in " + manifestDir + "/etcd.yaml on " + masterName(node))
+	}
+	return member, nil
+}
+
+// waitForEtcd polls check until it returns true
+func waitForEtcd(ctx context.Context, executor tools.NodeExecutor, description string, check func(ctx context.Context) bool) error {
+	if tools.IsDryRun(executor) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdWaitTimeout)
+	defer cancel()
+	for {
+		if check(ctx) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("timeout waiting for " + description)
+		case <-time.After(etcdPollInterval):
+		}
+	}
+}
+
+func etcdStopped(executor tools.NodeExecutor, node string) func(ctx context.Context) bool {
+	return func(ctx context.Context) bool {
+		success, message := executor.Run(ctx, node, "crictl", "ps", "-q", "--name", "^etcd$")
+		return success == true && len(strings.TrimSpace(message)) == 0
+	}
+}
+
+func etcdHealthy(executor tools.NodeExecutor, node string) func(ctx context.Context) bool {
+	return func(ctx context.Context) bool {
+		success, _ := executor.Run(ctx, node, "etcdctl", etcdctl("endpoint", "health")...)
+		return success
+	}
+}
+
+// initialCluster returns the value of ETCD_INITIAL_CLUSTER from the
+// output of "etcdctl member add"
+func initialCluster(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "ETCD_INITIAL_CLUSTER=") {
+			return strings.Trim(strings.TrimPrefix(line, "ETCD_INITIAL_CLUSTER="), "\"")
+		}
+	}
+	return ""
+}
+
+// EtcdRestore replaces the etcd database of the cluster with a snapshot.
+// The control plane gets stopped on all masters, the snapshot is restored
+// as new single member cluster on the first master and the other masters
+// join this cluster again as new members.
+func EtcdRestore(ctx context.Context, executor tools.NodeExecutor, in *pb.RestoreRequest, stream pb.Etcd_RestoreServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	snapshots, err := readSnapshots()
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Cannot read " + snapshotListFile + ": " + err.Error()})
+	}
+	var snapshot *pb.SnapshotInfo
+	for _, entry := range snapshots {
+		if entry.Name == in.Name {
+			snapshot = entry
+		}
+	}
+	if snapshot == nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Snapshot '" + in.Name + "' not found"})
+	}
+
+	token := restoreToken(snapshot)
+	if in.DryRun {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Confirmation token: " + token}); err != nil {
+			return err
+		}
+	} else if in.Confirm != token {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Restoring snapshot " + snapshot.Name +
+			" replaces the etcd database of the cluster, all changes since " + snapshot.Created +
+			" get lost. Run again with the confirmation token '" + token + "' to continue."})
+	}
+
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if snapshot.Node != firstMaster {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Snapshot " + snapshot.Name + " is stored on " +
+			masterName(snapshot.Node) + ", but the first master is " + masterName(firstMaster)})
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Verify checksum of " + snapshot.Path + "..."}); err != nil {
+		return err
+	}
+	success, message := executor.Run(ctx, snapshot.Node, "sha256sum", snapshot.Path)
+	if success != true {
+		return stream.Send(&pb.StatusReply{Success: false, Message: message})
+	}
+	if fields := strings.Fields(message); len(fields) == 0 || fields[0] != snapshot.Sha256 {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Checksum of " + snapshot.Path + " does not match, snapshot is corrupt"})
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Read etcd configuration of the masters..."}); err != nil {
+		return err
+	}
+	first, err := readEtcdMember(ctx, executor, firstMaster)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	members := []*etcdMember{first}
+	if strings.EqualFold(Read_Cfg("control-plane.conf", "MultiMaster"), "True") {
+		results, err := tools.GetListOfNodes(ctx, executor, "master")
+		if err != nil {
+			return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+		}
+		if failed := results.Failed(); len(failed) > 0 {
+			return stream.Send(&pb.StatusReply{Success: false, Message: "All masters need to be reachable, not reachable: " + strings.Join(failed, ", ")})
+		}
+		for _, node := range results.Succeeded() {
+			if node == firstMaster {
+				continue
+			}
+			member, err := readEtcdMember(ctx, executor, node)
+			if err != nil {
+				return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+			}
+			members = append(members, member)
+		}
+	}
+
+	// From here on the cluster is modified. Nothing gets deleted, so
+	// that the old state can be recovered manually.
+	suffix := ".before-restore-" + time.Now().UTC().Format("20060102-150405")
+	fail := func(node string, message string) error {
+		return stream.Send(&pb.StatusReply{Success: false, Message: masterName(node) + ": " + message +
+			"\nRestore failed. Moved etcd data directories are kept as <data-dir>" + suffix +
+			", the control plane manifests of stopped masters are in " + restoreManifestDir})
+	}
+
+	for _, member := range members {
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: member.node, Message: masterName(member.node) + ": stop control plane static pods..."}); err != nil {
+			return err
+		}
+		success, message = executor.Run(ctx, member.node, "mkdir", "-p", restoreManifestDir)
+		if success == true {
+			success, message = executor.Run(ctx, member.node, "mv "+manifestDir+"/*.yaml "+restoreManifestDir+"/")
+		}
+		if success != true {
+			return fail(member.node, message)
+		}
+	}
+	for _, member := range members {
+		if err := waitForEtcd(ctx, executor, "etcd to stop", etcdStopped(executor, member.node)); err != nil {
+			return fail(member.node, err.Error())
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: member.node, Message: masterName(member.node) + ": move " + member.dataDir + " to " + member.dataDir + suffix + "..."}); err != nil {
+			return err
+		}
+		success, message = executor.Run(ctx, member.node, "mv", member.dataDir, member.dataDir+suffix)
+		if success != true {
+			return fail(member.node, message)
+		}
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Node: first.node, Message: masterName(first.node) + ": restore snapshot " + snapshot.Name + "..."}); err != nil {
+		return err
+	}
+	success, message = executor.RunStream(ctx, first.node,
+		tools.StreamOutput(stream, first.node, "etcd restore"),
+		"etcdctl", "snapshot", "restore", snapshot.Path,
+		"--name", first.name,
+		"--initial-cluster", first.name+"="+first.peerURL,
+		"--initial-advertise-peer-urls", first.peerURL,
+		"--data-dir", first.dataDir)
+	if success != true {
+		return fail(first.node, message)
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Node: first.node, Message: masterName(first.node) + ": start control plane static pods..."}); err != nil {
+		return err
+	}
+	success, message = executor.Run(ctx, first.node, "mv "+restoreManifestDir+"/*.yaml "+manifestDir+"/")
+	if success != true {
+		return fail(first.node, message)
+	}
+	if err := waitForEtcd(ctx, executor, "etcd to become healthy", etcdHealthy(executor, first.node)); err != nil {
+		return fail(first.node, err.Error())
+	}
+
+	// etcd members have to be added one after the other, the new one
+	// has to be running before the next one can be added
+	for _, member := range members[1:] {
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: member.node, Message: masterName(member.node) + ": add etcd member " + member.name + "..."}); err != nil {
+			return err
+		}
+		success, message = executor.Run(ctx, first.node, "etcdctl", etcdctl("member", "add", member.name, "--peer-urls="+member.peerURL)...)
+		if success != true {
+			return fail(member.node, message)
+		}
+		cluster := initialCluster(message)
+		if len(cluster) == 0 {
+			if !tools.IsDryRun(executor) {
+				return fail(member.node, "cannot find initial cluster in output of etcdctl member add")
+			}
+			cluster = "<members>"
+		}
+
+		success, message = executor.Run(ctx, member.node, "sed", "-i",
+			"-e", "s#--initial-cluster=.*#--initial-cluster="+cluster+"#",
+			"-e", "s#--initial-cluster-state=.*#--initial-cluster-state=existing#",
+			restoreManifestDir+"/etcd.yaml")
+		if success == true {
+			success, message = executor.Run(ctx, member.node, "mv "+restoreManifestDir+"/*.yaml "+manifestDir+"/")
+		}
+		if success != true {
+			return fail(member.node, message)
+		}
+		if err := waitForEtcd(ctx, executor, "etcd to become healthy", etcdHealthy(executor, member.node)); err != nil {
+			return fail(member.node, err.Error())
+		}
+	}
+
+	return stream.Send(&pb.StatusReply{Success: true, Message: "etcd restored from snapshot " + snapshot.Name +
+		", the old data directories were moved to <data-dir>" + suffix})
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// snapshotListFile contains the metadata of all etcd snapshots
+var snapshotListFile = stateDir + "/etcd-snapshots.conf"
+
+var (
+	snapshotMutex     sync.Mutex
+	validSnapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// SnapshotConfig defines where etcd snapshots are stored and how long
+// they are kept
+type SnapshotConfig struct {
+	// Dir is the directory on the first master
+	Dir string
+	// Keep is the number of snapshots to keep, 0 keeps all
+	Keep int
+	// MaxAge is the age after which snapshots get removed, 0 keeps
+	// them forever
+	MaxAge time.Duration
+}
+
+func DefaultSnapshotConfig() SnapshotConfig {
+	return SnapshotConfig{
+		Dir:    stateDir + "/etcd-snapshots",
+		Keep:   7,
+		MaxAge: 0,
+	}
+}
+
+// etcdctl returns the arguments for etcdctl to talk with the local etcd
+// member using the kubeadm generated certificates
+func etcdctl(arg ...string) []string {
+	return append([]string{
+		"--endpoints", "https://localhost:2379",
+		"--cacert", "/etc/kubernetes/pki/etcd/ca.crt",
+		"--cert", "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
+		"--key", "/etc/kubernetes/pki/etcd/healthcheck-client.key"}, arg...)
+}
+
+// readSnapshots returns the metadata of all snapshots, the newest first
+func readSnapshots() ([]*pb.SnapshotInfo, error) {
+	cfg, err := ini.LooseLoad(snapshotListFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*pb.SnapshotInfo
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+		snapshots = append(snapshots, &pb.SnapshotInfo{
+			Name:     section.Name(),
+			Node:     section.Key("node").String(),
+			Path:     section.Key("path").String(),
+			Size:     section.Key("size").MustInt64(0),
+			Sha256:   section.Key("sha256").String(),
+			Revision: section.Key("revision").MustInt64(0),
+			Created:  section.Key("created").String(),
+		})
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Created > snapshots[j].Created
+	})
+	return snapshots, nil
+}
+
+// updateSnapshots adds the snapshot to the list and removes the
+// snapshots in remove from it
+func updateSnapshots(add *pb.SnapshotInfo, remove []string) error {
+	cfg, err := ini.LooseLoad(snapshotListFile)
+	if err != nil {
+		return err
+	}
+	if add != nil {
+		section := cfg.Section(add.Name)
+		section.Key("node").SetValue(add.Node)
+		section.Key("path").SetValue(add.Path)
+		section.Key("size").SetValue(strconv.FormatInt(add.Size, 10))
+		section.Key("sha256").SetValue(add.Sha256)
+		section.Key("revision").SetValue(strconv.FormatInt(add.Revision, 10))
+		section.Key("created").SetValue(add.Created)
+	}
+	for _, name := range remove {
+		cfg.DeleteSection(name)
+	}
+	return cfg.SaveTo(snapshotListFile)
+}
+
+// snapshotStatus fills in checksum, size and revision of the snapshot
+func snapshotStatus(ctx context.Context, executor tools.NodeExecutor, snapshot *pb.SnapshotInfo) error {
+	success, message := executor.Run(ctx, snapshot.Node, "sha256sum", snapshot.Path)
+	if success != true {
+		return errors.New(message)
+	}
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return errors.New("sha256sum of " + snapshot.Path + " failed")
+	}
+	snapshot.Sha256 = fields[0]
+
+	success, message = executor.Run(ctx, snapshot.Node, "etcdctl", "snapshot", "status", snapshot.Path, "-w", "json")
+	if success != true {
+		return errors.New(message)
+	}
+	var status struct {
+		Revision  int64 `json:"revision"`
+		TotalSize int64 `json:"totalSize"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(message)), &status); err != nil {
+		return errors.New("cannot parse status of " + snapshot.Path + ": " + err.Error())
+	}
+	snapshot.Revision = status.Revision
+	snapshot.Size = status.TotalSize
+	return nil
+}
+
+// expiredSnapshots returns the snapshots, which exceed the retention
+// rules. The newest snapshot is always kept.
+func expiredSnapshots(config SnapshotConfig, snapshots []*pb.SnapshotInfo, now time.Time) []*pb.SnapshotInfo {
+	var expired []*pb.SnapshotInfo
+	for i, snapshot := range snapshots {
+		if i == 0 {
+			continue
+		}
+		if config.Keep > 0 && i >= config.Keep {
+			expired = append(expired, snapshot)
+			continue
+		}
+		if config.MaxAge > 0 {
+			created, err := time.Parse(time.RFC3339, snapshot.Created)
+			if err == nil && now.Sub(created) > config.MaxAge {
+				expired = append(expired, snapshot)
+			}
+		}
+	}
+	return expired
+}
+
+// takeSnapshot takes a snapshot of the etcd database on the first master,
+// stores it below config.Dir and removes old snapshots afterwards. The
+// caller has to hold snapshotMutex.
+func takeSnapshot(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig, name string, stream tools.StatusSender) (*pb.SnapshotInfo, error) {
+	now := time.Now().UTC()
+	if len(name) == 0 {
+		name = "etcd-snapshot-" + now.Format("20060102-150405")
+	}
+	if !validSnapshotName.MatchString(name) {
+		return nil, errors.New("Invalid snapshot name '" + name + "'")
+	}
+
+	snapshots, err := readSnapshots()
+	if err != nil {
+		return nil, errors.New("Cannot read " + snapshotListFile + ": " + err.Error())
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return nil, errors.New("Snapshot '" + name + "' exists already")
+		}
+	}
+
+	// "master" is empty if kubicd runs on the first master
+	snapshot := &pb.SnapshotInfo{
+		Name:    name,
+		Node:    Read_Cfg("control-plane.conf", "master"),
+		Path:    path.Join(config.Dir, name+".db"),
+		Created: now.Format(time.RFC3339),
+	}
+	nodeName := masterName(snapshot.Node)
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Take etcd snapshot " + name + " on " + nodeName + "..."}); err != nil {
+		return nil, err
+	}
+	success, message := executor.Run(ctx, snapshot.Node, "mkdir", "-p", "-m", "0700", config.Dir)
+	if success != true {
+		return nil, errors.New(message)
+	}
+	success, message = executor.RunStream(ctx, snapshot.Node,
+		tools.StreamOutput(stream, snapshot.Node, "etcd snapshot"),
+		"etcdctl", etcdctl("snapshot", "save", snapshot.Path)...)
+	if success != true {
+		executor.Run(ctx, snapshot.Node, "rm", "-f", snapshot.Path, snapshot.Path+".part")
+		return nil, errors.New(message)
+	}
+
+	if tools.DryRun(executor, "record snapshot "+name+" in "+snapshotListFile) {
+		snapshots = append([]*pb.SnapshotInfo{snapshot}, snapshots...)
+	} else {
+		if err := snapshotStatus(ctx, executor, snapshot); err != nil {
+			return nil, errors.New("Verifying snapshot failed: " + err.Error())
+		}
+		if err := updateSnapshots(snapshot, nil); err != nil {
+			return nil, errors.New("Cannot update " + snapshotListFile + ": " + err.Error())
+		}
+		if snapshots, err = readSnapshots(); err != nil {
+			return nil, errors.New("Cannot read " + snapshotListFile + ": " + err.Error())
+		}
+	}
+
+	// retention
+	var removed []string
+	for _, old := range expiredSnapshots(config, snapshots, now) {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Remove old snapshot " + old.Name + "..."}); err != nil {
+			return nil, err
+		}
+		success, message := executor.Run(ctx, old.Node, "rm", "-f", old.Path)
+		if success != true {
+			// Report error, but keep the entry to retry next time
+			log.Errorf("Removing snapshot %s failed: %s", old.Name, message)
+			if err := stream.Send(&pb.StatusReply{Success: true, Message: "Removing snapshot " + old.Name + " failed: " + message}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		removed = append(removed, old.Name)
+	}
+	if len(removed) > 0 && !tools.DryRun(executor, "remove "+strings.Join(removed, ", ")+" from "+snapshotListFile) {
+		if err := updateSnapshots(nil, removed); err != nil {
+			return nil, errors.New("Cannot update " + snapshotListFile + ": " + err.Error())
+		}
+	}
+	return snapshot, nil
+}
+
+// EtcdSnapshot takes a snapshot of the etcd database on the first master,
+// stores it below config.Dir and removes old snapshots afterwards.
+func EtcdSnapshot(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig, in *pb.SnapshotRequest, stream pb.Etcd_SnapshotServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	snapshot, err := takeSnapshot(ctx, executor, config, in.Name, stream)
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+
+	message := "Snapshot " + snapshot.Name + " stored as " + snapshot.Path + " on " + masterName(snapshot.Node)
+	if len(snapshot.Sha256) > 0 {
+		message = message + " (sha256 " + snapshot.Sha256 + ")"
+	}
+	return stream.Send(&pb.StatusReply{Success: true, Message: message})
+}
+
+// ListSnapshots returns all recorded etcd snapshots, the newest first
+func ListSnapshots() (bool, string, []*pb.SnapshotInfo) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	snapshots, err := readSnapshots()
+	if err != nil {
+		return false, "Cannot read " + snapshotListFile + ": " + err.Error(), nil
+	}
+	return true, "", snapshots
+}
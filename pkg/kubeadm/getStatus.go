@@ -15,28 +15,67 @@
 package kubeadm
 
 import (
+	"context"
+	"sort"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
 
-func GetStatus(in *pb.Empty, stream pb.Kubeadm_GetStatusServer, kubicdVersion string) error {
+func GetStatus(ctx context.Context, executor tools.NodeExecutor, in *pb.Empty, stream pb.Kubeadm_GetStatusServer, kubicdVersion string) error {
 
 	if err := stream.Send(&pb.StatusReply{Success: true,
 		Message: "Kubicd version: " + kubicdVersion}); err != nil {
 		log.Errorf("Send message failed: %s", err)
 		return err
 	}
-	_, message := tools.GetKubeadmVersion("") // XXX needs better handling, per master via salt.
+	// kubicd does not need to run on a master, ask every master for
+	// its kubeadm version
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	masters := []string{firstMaster}
+	results, err := tools.GetListOfNodes(ctx, executor, "master")
+	if err == nil {
+		minions := results.Minions()
+		sort.Strings(minions)
+		for _, minion := range minions {
+			if minion != firstMaster {
+				masters = append(masters, minion)
+			}
+		}
+	}
 	if err := stream.Send(&pb.StatusReply{Success: true,
-		Message: "kubeadm version: " + message}); err != nil {
+		Message: "kubeadm version:"}); err != nil {
 		log.Errorf("Send message failed: %s", err)
 		return err
 	}
+	for _, master := range masters {
+		name := masterName(master)
+		if master == firstMaster {
+			name = name + " (first master)"
+		}
+		success, message := tools.GetKubeadmVersion(ctx, executor, master)
+		if success != true {
+			message = "unknown (" + strings.TrimSpace(message) + ")"
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true,
+			Message: "- " + name + ": " + message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+			return err
+		}
+	}
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: true,
+			Message: "- other masters: unknown (" + err.Error() + ")"}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+			return err
+		}
+	}
 
 	// Standard yaml files
-	cfg, err := ini.Load("/var/lib/kubic-control/k8s-yaml.conf")
+	cfg, err := ini.Load(stateDir + "/k8s-yaml.conf")
 	if err != nil {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: "Cannot load k8s-yaml.conf: " + err.Error()}); err != nil {
@@ -75,7 +114,7 @@ func GetStatus(in *pb.Empty, stream pb.Kubeadm_GetStatusServer, kubicdVersion st
 	}
 
 	// kustomize
-	cfg, err = ini.Load("/var/lib/kubic-control/k8s-kustomize.conf")
+	cfg, err = ini.Load(stateDir + "/k8s-kustomize.conf")
 	if err != nil {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: "Cannot load k8s-kustomize.conf: " + err.Error()}); err != nil {
@@ -95,8 +134,8 @@ func GetStatus(in *pb.Empty, stream pb.Kubeadm_GetStatusServer, kubicdVersion st
 		}
 		for _, key := range keys {
 			value := cfg.Section("").Key(key).String()
-			_, output := tools.ExecuteCmd("kustomize", "build",
-				"/var/lib/kubic-control/kustomize/"+key+"/overlay")
+			_, output := executor.Run(ctx, "", "kustomize", "build",
+				stateDir+"/kustomize/"+key+"/overlay")
 			hash, _ := tools.Sha256sum_b(output)
 			if hash != value {
 				if err := stream.Send(&pb.StatusReply{Success: true,
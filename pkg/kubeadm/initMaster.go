@@ -15,7 +15,8 @@
 package kubeadm
 
 import (
-	"errors"
+	"context"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"strings"
@@ -34,14 +35,18 @@ const (
 )
 
 // update data in /var/lib/kubic-control
-func update_cfg(file string, key string, value string) error {
-	cfg, err := ini.LooseLoad("/var/lib/kubic-control/" + file)
+func update_cfg(executor tools.NodeExecutor, file string, key string, value string) error {
+	if tools.DryRun(executor, "update "+stateDir+"/"+file+": "+key+" = "+value) {
+		return nil
+	}
+
+	cfg, err := ini.LooseLoad(stateDir + "/" + file)
 	if err != nil {
 		return err
 	}
 
 	cfg.Section("").Key(key).SetValue(value)
-	err = cfg.SaveTo("/var/lib/kubic-control/" + file)
+	err = cfg.SaveTo(stateDir + "/" + file)
 	if err != nil {
 		return err
 	}
@@ -49,57 +54,26 @@ func update_cfg(file string, key string, value string) error {
 	return nil
 }
 
-func executeCmdSalt(salt string, command string, arg ...string) (bool, string) {
-	if len(salt) > 0 {
-		return tools.ExecuteCmd("salt", "--module-executors='direct_call'", salt, "cmd.run", command+" "+strings.Join(arg[:], " "))
-	} else {
-		return tools.ExecuteCmd(command, arg...)
-	}
-}
-
-// exists returns whether the given file or directory exists
-func exists(path string, salt string) (bool, error) {
-	if len(salt) > 0 {
-		success, message := tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", salt, "file.access", path, "f")
-		if success != true {
-			return false, errors.New(message)
-		}
-		if strings.HasSuffix(message, ": True") {
-			return true, nil
-		} else {
-			return false, nil
-		}
-	} else {
-		_, err := os.Stat(path)
-		if err == nil {
-			return true, nil
-		}
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return true, err
-	}
-}
-
-func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
+func InitMaster(ctx context.Context, executor tools.NodeExecutor, in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
 	arg_pod_network := in.PodNetworking
 	arg_salt := in.FirstMaster
 
-	found, _ := exists("/etc/kubernetes/manifests/kube-apiserver.yaml", arg_salt)
+	found, _ := executor.FileExists(ctx, arg_salt, "/etc/kubernetes/manifests/kube-apiserver.yaml")
 	if found == true {
 		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Seems like a kubernetes control-plane is already running. If not, please use \"kubeadm reset\" to clean up the system."}); err != nil {
 			return err
 		}
 		return nil
 	}
-	found, _ = exists("/etc/kubernetes/manifests/kube-scheduler.yaml", arg_salt)
+	found, _ = executor.FileExists(ctx, arg_salt, "/etc/kubernetes/manifests/kube-scheduler.yaml")
 	if found == true {
 		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Seems like a kubernetes control-plane is already running. If not, please use \"kubeadm reset\" to clean up the system"}); err != nil {
 			return err
 		}
 		return nil
 	}
-	found, _ = exists("/etc/kubernetes/manifests/etcd.yaml", arg_salt)
+	found, _ = executor.FileExists(ctx, arg_salt, "/etc/kubernetes/manifests/etcd.yaml")
 	if found == true {
 		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Seems like a kubernetes control-plane is already running. If not, please use \"kubeadm reset\" to clean up the system"}); err != nil {
 			return err
@@ -113,7 +87,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	}
 
 	if strings.EqualFold(arg_pod_network, "weave") {
-		found, _ = exists(weave_yaml, "")
+		found, _ = tools.Exists(weave_yaml)
 		if found != true {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: "weave-k8s-yaml is not installed!"}); err != nil {
 				return err
@@ -121,7 +95,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 			return nil
 		}
 	} else if strings.EqualFold(arg_pod_network, "flannel") {
-		found, _ = exists(flannel_yaml, "")
+		found, _ = tools.Exists(flannel_yaml)
 		if found != true {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: "flannel-k8s-yaml is not installed!"}); err != nil {
 				return err
@@ -135,7 +109,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		return nil
 	}
 
-	found, _ = exists(kured_yaml, "")
+	found, _ = tools.Exists(kured_yaml)
 	if found != true {
 		if err := stream.Send(&pb.StatusReply{Success: false, Message: "kured-k8s-yaml is not installed!"}); err != nil {
 			return err
@@ -143,16 +117,26 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		return nil
 	}
 
-	success, message := executeCmdSalt(arg_salt, "systemctl", "enable", "--now", "crio")
+	success, message := tools.RetryStep(ctx, tools.StepService,
+		tools.StreamAttempts(stream, arg_salt, "service"),
+		func(ctx context.Context) (bool, string) {
+			return executor.Run(ctx, arg_salt, "systemctl", "enable", "--now", "crio")
+		})
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
 		}
 		return nil
 	}
-	success, message = executeCmdSalt(arg_salt, "systemctl", "enable", "--now", "kubelet")
+	success, message = tools.RetryStep(ctx, tools.StepService,
+		tools.StreamAttempts(stream, arg_salt, "service"),
+		func(ctx context.Context) (bool, string) {
+			return executor.Run(ctx, arg_salt, "systemctl", "enable", "--now", "kubelet")
+		})
 	if success != true {
-		executeCmdSalt(arg_salt, "systemctl", "disable", "--now", "crio")
+		cleanupCtx, cancel := cleanupContext()
+		executor.Run(cleanupCtx, arg_salt, "systemctl", "disable", "--now", "crio")
+		cancel()
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
 		}
@@ -169,7 +153,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 			if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
 				return err
 			}
-			hostname, err := os.Hostname()
+			hostname, err := executor.GetHostname(ctx, arg_salt)
 			if err != nil {
 				if err2 := stream.Send(&pb.StatusReply{Success: false,
 					Message: "Could not get hostname: " + err.Error() +
@@ -178,8 +162,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 				}
 				return nil
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", in.Haproxy, "cmd.run",
-				"\"haproxycfg init --force "+in.MultiMaster+" "+hostname+"\"")
+			success, message = executor.Run(ctx, in.Haproxy, "haproxycfg", "init", "--force", in.MultiMaster, hostname)
 			if success != true {
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
 					return err
@@ -223,7 +206,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	if len(in.KubernetesVersion) > 0 {
 		kubernetes_version = in.KubernetesVersion
 	} else {
-		success, message := tools.GetKubeadmVersion(arg_salt)
+		success, message := tools.GetKubeadmVersion(ctx, executor, arg_salt)
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
 				return err
@@ -232,73 +215,41 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		}
 		kubernetes_version = message
 	}
-	update_cfg("control-plane.conf", "version", kubernetes_version)
-	update_cfg("control-plane.conf", "master", arg_salt)
+	update_cfg(executor, "control-plane.conf", "version", kubernetes_version)
+	update_cfg(executor, "control-plane.conf", "master", arg_salt)
 
 	if len(in.MultiMaster) > 0 {
-		os.MkdirAll("/var/lib/kubic-control/multi-master", os.ModePerm)
-
-		f, err := os.Create("/var/lib/kubic-control/multi-master/kubeadm-config.yaml")
-		if err != nil {
-			ResetMaster()
-			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
-				return err
+		config := "apiVersion: kubeadm.k8s.io/v1beta2\nkind: ClusterConfiguration\nkubernetesVersion: " + kubernetes_version + "\ncontrolPlaneEndpoint: \"" + in.MultiMaster + ":6443\"\n"
+		if len(in.ApiserverCertExtraSans) > 0 || len(in.AdvAddr) > 0 {
+			config = config + "apiServer:\n"
+			if len(in.ApiserverCertExtraSans) > 0 {
+				config = config + "  certSANs:\n    - " + in.ApiserverCertExtraSans + "\n"
 			}
-			return nil
-		}
-		defer f.Close()
-
-		_, err = f.WriteString("apiVersion: kubeadm.k8s.io/v1beta2\nkind: ClusterConfiguration\nkubernetesVersion: " + kubernetes_version + "\ncontrolPlaneEndpoint: \"" + in.MultiMaster + ":6443\"\n")
-		if err != nil {
-			ResetMaster()
-			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
-				return err
+			if len(in.AdvAddr) > 0 {
+				config = config + "  extraArgs:\n    advertise-address: " + in.AdvAddr + "\n"
 			}
-			return nil
 		}
 
-		if len(in.ApiserverCertExtraSans) > 0 || len(in.AdvAddr) > 0 {
-			_, err = f.WriteString("apiServer:\n")
+		if !tools.DryRun(executor, "write "+stateDir+"/multi-master/kubeadm-config.yaml:\n"+config) {
+			os.MkdirAll(stateDir+"/multi-master", os.ModePerm)
+			err := ioutil.WriteFile(stateDir+"/multi-master/kubeadm-config.yaml", []byte(config), 0644)
 			if err != nil {
-				ResetMaster()
+				cleanupMaster(executor)
 				if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
 					return err
 				}
 				return nil
 			}
-
-			if len(in.ApiserverCertExtraSans) > 0 {
-				_, err = f.WriteString("  certSANs:\n    - " + in.ApiserverCertExtraSans + "\n")
-				if err != nil {
-					ResetMaster()
-					if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
-						return err
-					}
-					return nil
-				}
-			}
-
-			if len(in.AdvAddr) > 0 {
-				_, err = f.WriteString("  extraArgs:\n    advertise-address: " + in.AdvAddr + "\n")
-				if err != nil {
-					ResetMaster()
-					if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
-						return err
-					}
-					return nil
-				}
-			}
 		}
-		f.Close()
 
-		update_cfg("control-plane.conf", "MultiMaster", "True")
-		update_cfg("control-plane.conf", "loadbalancer_dns", in.MultiMaster)
+		update_cfg(executor, "control-plane.conf", "MultiMaster", "True")
+		update_cfg(executor, "control-plane.conf", "loadbalancer_dns", in.MultiMaster)
 		if len(in.Haproxy) > 0 {
-			update_cfg("control-plane.conf", "loadbalancer_salt", in.Haproxy)
+			update_cfg(executor, "control-plane.conf", "loadbalancer_salt", in.Haproxy)
 		}
 
 		kubeadm_args = append(kubeadm_args,
-			"--config=/var/lib/kubic-control/multi-master/kubeadm-config.yaml")
+			"--config="+stateDir+"/multi-master/kubeadm-config.yaml")
 		// No need to upload certs, we have to do it anyways if we add a new
 		// master node.
 		// kubeadm_args = append(kubeadm_args, "--upload-certs")
@@ -320,9 +271,20 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		return err
 	}
 	log.Infof("Calling kubeadm '%v'", kubeadm_args)
-	success, message = executeCmdSalt(arg_salt, "kubeadm", kubeadm_args...)
+	attempt := 0
+	success, message = tools.RetryStep(ctx, tools.StepKubeadm,
+		tools.StreamAttempts(stream, arg_salt, "kubeadm init"),
+		func(ctx context.Context) (bool, string) {
+			// cleanup behind the failed init before trying again
+			if attempt > 0 {
+				executor.Run(ctx, arg_salt, "kubeadm", "reset", "--force")
+			}
+			attempt++
+			return executor.RunStream(ctx, arg_salt,
+				tools.StreamOutput(stream, arg_salt, "kubeadm init"), "kubeadm", kubeadm_args...)
+		})
 	if success != true {
-		ResetMaster()
+		cleanupMaster(executor)
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
 		}
@@ -331,19 +293,27 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 
 	if len(arg_salt) > 0 {
 		// Get kubernetes/admin.conf for kubectl calls
-		tools.ExecuteCmd("mkdir", "/etc/kubernetes")
 		log.Infof("Download /etc/kubernetes/admin.conf")
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=newline_values_only",
-			"--out-file=/etc/kubernetes/admin.conf", arg_salt,
-			"cmd.run", "cat /etc/kubernetes/admin.conf")
+		success, message = executor.Run(ctx, arg_salt, "cat", "/etc/kubernetes/admin.conf")
 		if success != true {
-			ResetMaster()
+			cleanupMaster(executor)
 			if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 				return err
 			}
 			return nil
 		}
-		os.Chmod("/etc/kubernetes/admin.conf", 0600) // XXX error handling
+		var err error
+		if !tools.DryRun(executor, "write /etc/kubernetes/admin.conf") {
+			os.MkdirAll("/etc/kubernetes", 0755)
+			err = ioutil.WriteFile("/etc/kubernetes/admin.conf", []byte(message), 0600)
+		}
+		if err != nil {
+			cleanupMaster(executor)
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot write /etc/kubernetes/admin.conf: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
 	}
 
 	if strings.EqualFold(arg_pod_network, "weave") {
@@ -351,9 +321,9 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Deploy weave"}); err != nil {
 			return err
 		}
-		success, message = deployment.DeployFile(weave_yaml)
+		success, message = deployment.DeployFile(ctx, executor, weave_yaml)
 		if success != true {
-			ResetMaster()
+			cleanupMaster(executor)
 			if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 				return err
 			}
@@ -364,9 +334,9 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Deploy flannel"}); err != nil {
 			return err
 		}
-		success, message = deployment.DeployFile(flannel_yaml)
+		success, message = deployment.DeployFile(ctx, executor, flannel_yaml)
 		if success != true {
-			ResetMaster()
+			cleanupMaster(executor)
 			if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 				return err
 			}
@@ -382,16 +352,16 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Deploy Kubernetes Reboot Daemon (kured)"}); err != nil {
 		return err
 	}
-	success, message = deployment.DeployFile(kured_yaml)
+	success, message = deployment.DeployFile(ctx, executor, kured_yaml)
 	if success != true {
-		ResetMaster()
+		cleanupMaster(executor)
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
 		}
 		return nil
 	}
 	if len(arg_salt) > 0 {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", arg_salt, "grains.append", "kubicd", "kubic-master-node")
+		success, message = executor.GrainsAppend(ctx, arg_salt, "kubicd", "kubic-master-node")
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 				return err
@@ -405,7 +375,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	cfg, err := ini.LooseLoad("/etc/transactional-update.conf")
 	if err != nil {
 		stream.Send(&pb.StatusReply{Success: true, Message: "Adjusting transactional-update to use kured for reboot failed.\nPlease ajdust /etc/transactional-update.conf yourself."})
-	} else {
+	} else if !tools.DryRun(executor, "update /etc/transactional-update.conf: REBOOT_METHOD = kured") {
 		cfg.Section("").Key("REBOOT_METHOD").SetValue("kured")
 		cfg.SaveTo("/etc/transactional-update.conf")
 	}
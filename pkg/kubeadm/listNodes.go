@@ -15,10 +15,177 @@
 package kubeadm
 
 import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
 	"github.com/thkukuk/kubic-control/pkg/tools"
+	corev1 "k8s.io/api/core/v1"
 )
 
-func ListNodes() (bool, string, []string) {
-	// Get list of all worker nodes:
-	return tools.GetListOfNodes("worker")
+// nodeRoles are the roles of the nodes managed by kubicd, in the order
+// they get listed
+var nodeRoles = []string{"master", "worker", "haproxy"}
+
+// ListNodes returns the salt names of all reachable worker nodes and
+// all nodes known to salt or kubernetes. Unreachable nodes and errors
+// are reported in the message.
+func ListNodes(ctx context.Context, executor tools.NodeExecutor) (bool, string, []string, []*pb.NodeInfo) {
+	var messages []string
+	var workers []string
+	var nodes []*pb.NodeInfo
+	saltNodes := make(map[string]*pb.NodeInfo)
+
+	for _, role := range nodeRoles {
+		results, err := tools.GetListOfNodes(ctx, executor, role)
+		if err != nil {
+			// the error is the same for all roles
+			messages = append(messages, err.Error())
+			break
+		}
+		if message := results.FailedMessage(); len(message) > 0 {
+			messages = append(messages, message)
+		}
+		for _, minion := range results.Minions() {
+			if _, ok := saltNodes[minion]; ok {
+				continue
+			}
+			info := &pb.NodeInfo{SaltId: minion, Role: role, InSalt: true,
+				Reachable: !results[minion].Failed()}
+			saltNodes[minion] = info
+			nodes = append(nodes, info)
+		}
+		if role == "worker" {
+			workers = results.Succeeded()
+		}
+	}
+
+	// the loadbalancer configured with "kubicctl init" has no grain
+	loadbalancer := Read_Cfg("control-plane.conf", "loadbalancer_salt")
+	if _, ok := saltNodes[loadbalancer]; len(loadbalancer) > 0 && !ok {
+		info := &pb.NodeInfo{SaltId: loadbalancer, Role: "haproxy", InSalt: true}
+		if results, err := executor.Ping(ctx, loadbalancer); err == nil {
+			if result, ok := results[loadbalancer]; ok {
+				info.Reachable = !result.Failed()
+			}
+		}
+		saltNodes[loadbalancer] = info
+		nodes = append(nodes, info)
+	}
+
+	nodes, err := addKubernetesNodes(ctx, executor, nodes)
+	if err != nil {
+		messages = append(messages, "Cannot query kubernetes: "+err.Error())
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].Role != nodes[j].Role {
+			return roleIndex(nodes[i].Role) < roleIndex(nodes[j].Role)
+		}
+		return nodeName(nodes[i]) < nodeName(nodes[j])
+	})
+
+	return true, strings.Join(messages, "\n"), workers, nodes
+}
+
+// addKubernetesNodes merges the kubernetes nodes into the list of salt
+// nodes. Salt names are mapped with the hostname of the node, for
+// unreachable nodes the salt name without domain is used.
+func addKubernetesNodes(ctx context.Context, executor tools.NodeExecutor, nodes []*pb.NodeInfo) ([]*pb.NodeInfo, error) {
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return nodes, err
+	}
+	k8sNodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return nodes, err
+	}
+
+	hostnames := make(map[string]*pb.NodeInfo)
+	for _, info := range nodes {
+		if !info.Reachable || info.Role == "haproxy" {
+			continue
+		}
+		if hostname, err := executor.GetHostname(ctx, info.SaltId); err == nil {
+			hostnames[strings.ToLower(hostname)] = info
+		}
+	}
+
+	// without salt name of the first master, kubicd runs on it
+	localHostname := ""
+	if len(Read_Cfg("control-plane.conf", "master")) == 0 {
+		localHostname, _ = os.Hostname()
+	}
+
+	for _, node := range k8sNodes {
+		info, ok := hostnames[node.Name]
+		if !ok {
+			info = findSaltNode(nodes, node.Name)
+		}
+		if info == nil {
+			info = &pb.NodeInfo{Role: kubernetesRole(node)}
+			if strings.EqualFold(node.Name, localHostname) {
+				info.Local = true
+				info.Reachable = true
+			}
+			nodes = append(nodes, info)
+		}
+		setKubernetesInfo(info, node)
+	}
+	return nodes, nil
+}
+
+func findSaltNode(nodes []*pb.NodeInfo, name string) *pb.NodeInfo {
+	for _, info := range nodes {
+		if info.InKubernetes || info.Role == "haproxy" {
+			continue
+		}
+		saltName := strings.ToLower(info.SaltId)
+		if saltName == name || strings.Split(saltName, ".")[0] == name {
+			return info
+		}
+	}
+	return nil
+}
+
+func kubernetesRole(node corev1.Node) string {
+	for _, label := range []string{"node-role.kubernetes.io/control-plane", "node-role.kubernetes.io/master"} {
+		if _, ok := node.Labels[label]; ok {
+			return "master"
+		}
+	}
+	return "worker"
+}
+
+func setKubernetesInfo(info *pb.NodeInfo, node corev1.Node) {
+	info.Name = node.Name
+	info.InKubernetes = true
+	info.KubeletVersion = node.Status.NodeInfo.KubeletVersion
+	info.OsImage = node.Status.NodeInfo.OSImage
+	info.Schedulable = !node.Spec.Unschedulable
+	info.Ready = string(nodeReady(node))
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP || address.Type == corev1.NodeExternalIP {
+			info.Addresses = append(info.Addresses, address.Address)
+		}
+	}
+}
+
+func roleIndex(role string) int {
+	for i := range nodeRoles {
+		if nodeRoles[i] == role {
+			return i
+		}
+	}
+	return len(nodeRoles)
+}
+
+func nodeName(info *pb.NodeInfo) string {
+	if len(info.SaltId) > 0 {
+		return info.SaltId
+	}
+	return info.Name
 }
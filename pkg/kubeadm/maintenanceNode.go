@@ -0,0 +1,159 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// forEachNode calls fn for every reachable node matching nodeNames with
+// the salt name and the kubernetes node name. The nodes are handled one
+// after the other, so that not all of them are unavailable at the same
+// time. Returns the number of failed and unreachable nodes.
+func forEachNode(ctx context.Context, executor tools.NodeExecutor, nodeNames string, stream tools.StatusSender,
+	fn func(saltNode string, hostname string) (bool, string)) (int, error) {
+
+	results, err := tools.PingNodes(ctx, executor, nodeNames, tools.StreamAttempts(stream, "", "ping"))
+	if err != nil {
+		return 1, stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+	if len(results) == 0 {
+		return 1, stream.Send(&pb.StatusReply{Success: false, Message: "No nodes found matching '" + nodeNames + "'"})
+	}
+
+	failed := 0
+	for _, node := range results.Failed() {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": not reachable: " + results[node].Error().Error()}); err != nil {
+			return failed, err
+		}
+		failed++
+	}
+
+	for _, node := range results.Succeeded() {
+		if ctx.Err() != nil {
+			return failed, ctx.Err()
+		}
+		hostname, err := executor.GetHostname(ctx, node)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": could not get hostname: " + err.Error()}); err != nil {
+				return failed, err
+			}
+			failed++
+			continue
+		}
+		success, message := fn(node, hostname)
+		if success != true {
+			failed++
+		}
+		if err := stream.Send(&pb.StatusReply{Success: success, Node: node, Message: node + ": " + message}); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+func CordonNode(ctx context.Context, executor tools.NodeExecutor, in *pb.CordonRequest, stream pb.Kubeadm_CordonNodeServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	failed, err := forEachNode(ctx, executor, in.NodeNames, stream, func(saltNode string, hostname string) (bool, string) {
+		success, message := cordonNode(ctx, executor, hostname)
+		if success != true {
+			return success, message
+		}
+		return true, "cordoned"
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "An error occured during cordoning Node(s)"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func UncordonNode(ctx context.Context, executor tools.NodeExecutor, in *pb.CordonRequest, stream pb.Kubeadm_UncordonNodeServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	failed, err := forEachNode(ctx, executor, in.NodeNames, stream, func(saltNode string, hostname string) (bool, string) {
+		success, message := uncordonNode(executor, hostname)
+		if success != true {
+			return success, message
+		}
+		return true, "uncordoned"
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "An error occured during uncordoning Node(s)"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaintenanceNode cordons and drains the nodes, or makes them
+// schedulable again after the maintenance.
+func MaintenanceNode(ctx context.Context, executor tools.NodeExecutor, in *pb.MaintenanceRequest, stream pb.Kubeadm_MaintenanceNodeServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	if !in.Enable {
+		return UncordonNode(ctx, executor, &pb.CordonRequest{NodeNames: in.NodeNames}, stream)
+	}
+
+	options := k8s.DrainOptions{
+		PodSelector:        in.PodSelector,
+		DeleteEmptyDirData: in.DeleteEmptydirData,
+	}
+	if in.GracePeriod != nil {
+		if *in.GracePeriod < -1 {
+			return stream.Send(&pb.StatusReply{Success: false,
+				Message: "Invalid grace period " + strconv.Itoa(int(*in.GracePeriod)) + ", must be -1 or larger"})
+		}
+		if *in.GracePeriod >= 0 {
+			gracePeriod := int64(*in.GracePeriod)
+			options.GracePeriodSeconds = &gracePeriod
+		}
+	}
+
+	failed, err := forEachNode(ctx, executor, in.NodeNames, stream, func(saltNode string, hostname string) (bool, string) {
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: saltNode, Message: saltNode + ": draining node..."}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		success, message := tools.DrainNodeWithOptions(ctx, executor, hostname, options,
+			tools.StreamAttempts(stream, saltNode, "drain"))
+		if success != true {
+			return success, message
+		}
+		return true, "in maintenance"
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "An error occured during draining Node(s)"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// nodeConfigFile contains the desired labels and taints per salt node
+var nodeConfigFile = stateDir + "/nodes.conf"
+
+var nodeConfigMutex sync.Mutex
+
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// updateNodeConfig merges the changes into the labels and taints
+// stored for saltNode and returns the result
+func updateNodeConfig(executor tools.NodeExecutor, saltNode string, labelChanges []string, taintChanges []string) ([]string, []string, error) {
+	nodeConfigMutex.Lock()
+	defer nodeConfigMutex.Unlock()
+
+	cfg, err := ini.LooseLoad(nodeConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	section := cfg.Section(saltNode)
+
+	labels, err := k8s.MergeLabels(splitList(section.Key("labels").String()), labelChanges)
+	if err != nil {
+		return nil, nil, err
+	}
+	taints, err := k8s.MergeTaints(splitList(section.Key("taints").String()), taintChanges)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(labelChanges) == 0 && len(taintChanges) == 0 {
+		return labels, taints, nil
+	}
+
+	if tools.DryRun(executor, "update "+nodeConfigFile+": ["+saltNode+"] labels = "+
+		strings.Join(labels, ",")+", taints = "+strings.Join(taints, ",")) {
+		return labels, taints, nil
+	}
+	if len(labels) == 0 && len(taints) == 0 {
+		cfg.DeleteSection(saltNode)
+	} else {
+		section.Key("labels").SetValue(strings.Join(labels, ","))
+		section.Key("taints").SetValue(strings.Join(taints, ","))
+	}
+	return labels, taints, cfg.SaveTo(nodeConfigFile)
+}
+
+// applyNodeConfig sets or removes labels and taints of the kubernetes
+// node hostname. After a join, it waits until the node is registered.
+func applyNodeConfig(ctx context.Context, executor tools.NodeExecutor, hostname string, labels []string, taints []string, wait bool) error {
+	if len(labels) == 0 && len(taints) == 0 {
+		return nil
+	}
+	if tools.DryRun(executor, "update node "+hostname+": labels "+
+		strings.Join(labels, ",")+", taints "+strings.Join(taints, ",")) {
+		return nil
+	}
+
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return err
+	}
+	if wait {
+		waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		err = client.WaitForNode(waitCtx, hostname)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if err := client.UpdateLabels(ctx, hostname, labels); err != nil {
+		return err
+	}
+	return client.UpdateTaints(ctx, hostname, taints)
+}
+
+// setNodeConfig stores the changes for saltNode and applies them to
+// the kubernetes node, if it is part of the cluster
+func setNodeConfig(ctx context.Context, executor tools.NodeExecutor, saltNode string, labelChanges []string, taintChanges []string) (bool, string) {
+	if len(saltNode) == 0 {
+		return false, "No node specified"
+	}
+	if _, _, err := updateNodeConfig(executor, saltNode, labelChanges, taintChanges); err != nil {
+		return false, err.Error()
+	}
+
+	hostname, err := executor.GetHostname(ctx, saltNode)
+	if err != nil {
+		return true, saltNode + ": stored, but not reachable (" + err.Error() + "), will be applied when the node gets added"
+	}
+	err = applyNodeConfig(ctx, executor, hostname, labelChanges, taintChanges, false)
+	if k8s.IsNotFound(err) {
+		return true, saltNode + ": stored, will be applied when the node gets added"
+	}
+	if err != nil {
+		return false, saltNode + ": " + err.Error()
+	}
+	return true, saltNode + ": updated"
+}
+
+func SetNodeLabels(ctx context.Context, executor tools.NodeExecutor, in *pb.NodeLabelsRequest) (bool, string) {
+	return setNodeConfig(ctx, executor, in.NodeName, in.Labels, nil)
+}
+
+func SetNodeTaints(ctx context.Context, executor tools.NodeExecutor, in *pb.NodeTaintsRequest) (bool, string) {
+	return setNodeConfig(ctx, executor, in.NodeName, nil, in.Taints)
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+const (
+	// masterDownTimeout is how long a rebooting master may take to go down
+	masterDownTimeout = 2 * time.Minute
+	// masterUpTimeout is how long a rebooting master may take until it's
+	// etcd member is healthy again
+	masterUpTimeout = 15 * time.Minute
+)
+
+// masterLock serialises all operations, which take down a master. It
+// is a semaphore instead of a mutex, so waiting for it can be cancelled.
+var masterLock = make(chan bool, 1)
+
+// acquireMasterLock waits until no other operation takes down a master
+// or ctx is done
+func acquireMasterLock(ctx context.Context) error {
+	select {
+	case masterLock <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseMasterLock() {
+	<-masterLock
+}
+
+// controlPlane describes the masters of the cluster
+type controlPlane struct {
+	// salt nodes with the master grain
+	saltMasters map[string]bool
+	// etcd member names with their health
+	etcdMembers map[string]bool
+	// set if the etcd membership could not be read
+	etcdErr error
+}
+
+// readControlPlane collects the masters from the salt grains and the
+// etcd membership
+func readControlPlane(ctx context.Context, executor tools.NodeExecutor) (*controlPlane, error) {
+	cp := &controlPlane{saltMasters: make(map[string]bool), etcdMembers: make(map[string]bool)}
+
+	results, err := tools.GetListOfNodes(ctx, executor, "master")
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range results.Minions() {
+		cp.saltMasters[node] = true
+	}
+	if firstMaster := Read_Cfg("control-plane.conf", "master"); len(firstMaster) > 0 {
+		cp.saltMasters[firstMaster] = true
+	}
+
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		cp.etcdErr = err
+		return cp, nil
+	}
+	defer client.Close()
+	endpoints, err := client.Health(ctx)
+	if err != nil {
+		cp.etcdErr = err
+		return cp, nil
+	}
+	for _, endpoint := range endpoints {
+		cp.etcdMembers[endpoint.Member.Name] = endpoint.Err == nil
+	}
+	return cp, nil
+}
+
+func (cp *controlPlane) isMaster(saltNode string, hostname string) bool {
+	if cp.saltMasters[saltNode] {
+		return true
+	}
+	_, ok := cp.etcdMembers[hostname]
+	return ok
+}
+
+// masters returns the number of masters. A local first master has no
+// grain, but is a member of etcd.
+func (cp *controlPlane) masters() int {
+	if len(cp.etcdMembers) > len(cp.saltMasters) {
+		return len(cp.etcdMembers)
+	}
+	return len(cp.saltMasters)
+}
+
+// check returns an error if taking down the master hostname, or removing
+// it if remove is set, leaves etcd without quorum or less than minMasters
+// masters.
+func (cp *controlPlane) check(hostname string, remove bool, minMasters int) error {
+	if cp.etcdErr != nil {
+		return errors.New("cannot verify etcd quorum: " + cp.etcdErr.Error())
+	}
+
+	members := len(cp.etcdMembers)
+	healthy := 0
+	for _, ok := range cp.etcdMembers {
+		if ok {
+			healthy++
+		}
+	}
+	if ok, isMember := cp.etcdMembers[hostname]; isMember {
+		if ok {
+			healthy--
+		}
+		if remove {
+			members--
+		}
+	}
+	if quorum := members/2 + 1; members > 0 && healthy < quorum {
+		return fmt.Errorf("etcd would have only %d of %d members healthy, %d are needed for quorum", healthy, members, quorum)
+	}
+	if masters := cp.masters() - 1; masters < minMasters {
+		return fmt.Errorf("only %d masters would be left, the minimum is %d", masters, minMasters)
+	}
+	return nil
+}
+
+// lockMaster serialises operations taking down masters. If the node is
+// a master, it waits until no other master is taken down, verifies that
+// etcd keeps it's quorum and enough masters are left, and returns true.
+// The caller has to call releaseMasterLock after the operation then.
+// With force, failed checks are only reported.
+func lockMaster(ctx context.Context, executor tools.NodeExecutor, saltNode string, hostname string,
+	remove bool, force bool, minMasters int, report tools.AttemptFunc) (bool, error) {
+
+	cp, err := readControlPlane(ctx, executor)
+	if err != nil {
+		if !force {
+			return false, errors.New("cannot determine masters: " + err.Error())
+		}
+		cp = &controlPlane{saltMasters: map[string]bool{saltNode: true}}
+	}
+	if !cp.isMaster(saltNode, hostname) {
+		return false, nil
+	}
+
+	if report != nil {
+		report("master node, waiting for other master operations and checking etcd quorum...")
+	}
+	if err := acquireMasterLock(ctx); err != nil {
+		return false, err
+	}
+
+	// the cluster may have changed while waiting
+	cp, err = readControlPlane(ctx, executor)
+	if err == nil {
+		err = cp.check(hostname, remove, minMasters)
+	}
+	if err != nil {
+		if !force {
+			releaseMasterLock()
+			return false, errors.New(err.Error() + ", use force to continue anyway")
+		}
+		if report != nil {
+			report(err.Error() + ", continuing because of force")
+		}
+	}
+	return true, nil
+}
+
+// etcdMemberHealthy returns true if the etcd member name is healthy
+func etcdMemberHealthy(ctx context.Context, executor tools.NodeExecutor, name string) bool {
+	client, err := newEtcdClient(ctx, executor)
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+
+	endpoints, err := client.Health(ctx)
+	if err != nil {
+		return false
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Member.Name == name {
+			return endpoint.Err == nil
+		}
+	}
+	return false
+}
+
+// waitForMasterReboot waits until the etcd member of the rebooted master
+// was down and is healthy again.
+func waitForMasterReboot(ctx context.Context, executor tools.NodeExecutor, hostname string) error {
+	if tools.IsDryRun(executor) {
+		return nil
+	}
+
+	// give the member the chance to go down first, a very fast reboot
+	// may be missed
+	deadline := time.Now().Add(masterDownTimeout)
+	for time.Now().Before(deadline) && etcdMemberHealthy(ctx, executor, hostname) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(etcdPollInterval):
+		}
+	}
+
+	deadline = time.Now().Add(masterUpTimeout)
+	for !etcdMemberHealthy(ctx, executor, hostname) {
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for etcd member " + hostname + " to become healthy again")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(etcdPollInterval):
+		}
+	}
+	return nil
+}
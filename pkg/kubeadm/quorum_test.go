@@ -0,0 +1,53 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLockMasterCancel(t *testing.T) {
+	executor, _, _ := setupRemoveNode(t)
+
+	// another operation takes down a master
+	if err := acquireMasterLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseMasterLock()
+
+	ctx, cancel := context.WithTimeout(testContext(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := lockMaster(ctx, executor, "master2", "master2", true, false, 1, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("lockMaster returned %v, expected %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lockMaster did not return after the context was done")
+	}
+
+	// workers do not wait
+	if master, err := lockMaster(testContext(), executor, "worker1", "worker1", true, false, 1, nil); master || err != nil {
+		t.Errorf("lockMaster for worker1 returned %v, %v", master, err)
+	}
+}
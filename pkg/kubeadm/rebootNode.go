@@ -15,26 +15,72 @@
 package kubeadm
 
 import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-func RebootNode(nodeName string) (bool, string) {
+// RebootNode drains the nodes and reboots them one after the other.
+// Masters are only rebooted if etcd keeps it's quorum and at least
+// minMasters other masters are running, and the next node is handled
+// after the master is healthy again.
+func RebootNode(ctx context.Context, executor tools.NodeExecutor, minMasters int, in *pb.RebootNodeRequest, stream pb.Kubeadm_RebootNodeServer) error {
 
-	// salt host names are not identical with kubernetes node name.
-	hostname, err := tools.GetNodeName(nodeName)
-	if err != nil {
-		return false, err.Error()
-	}
+	failed, err := forEachNode(ctx, executor, in.NodeNames, stream, func(saltNode string, hostname string) (bool, string) {
+		master, err := lockMaster(ctx, executor, saltNode, hostname, false, in.Force, minMasters,
+			tools.StreamAttempts(stream, saltNode, "quorum"))
+		if err != nil {
+			return false, err.Error()
+		}
+		if master {
+			defer releaseMasterLock()
+		}
 
-	success, message := tools.DrainNode(hostname, "")
-	if success != true {
-		return success, message
-	}
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: saltNode, Message: saltNode + ": draining node..."}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		// salt host names are not identical with kubernetes node name.
+		success, message := drainNode(ctx, executor, hostname, in.ForceDrain,
+			tools.StreamAttempts(stream, saltNode, "drain"))
+		if success != true {
+			return success, message
+		}
 
-	success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "system.reboot")
-	if success != true {
-		return success, message
-	}
+		if err := stream.Send(&pb.StatusReply{Success: true, Node: saltNode, Message: saltNode + ": rebooting node..."}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		success, message = tools.RetryStep(ctx, tools.StepReboot,
+			tools.StreamAttempts(stream, saltNode, "reboot"),
+			func(ctx context.Context) (bool, string) {
+				return executor.Call(ctx, saltNode, "system.reboot")
+			})
+		if success != true {
+			if ctx.Err() != nil {
+				// cancelled, don't leave the node unschedulable
+				uncordonNode(executor, hostname)
+			}
+			return success, message
+		}
 
-	return true, ""
+		if master {
+			if err := stream.Send(&pb.StatusReply{Success: true, Node: saltNode, Message: saltNode + ": waiting for etcd member to become healthy again..."}); err != nil {
+				log.Errorf("Send message failed: %s", err)
+			}
+			if err := waitForMasterReboot(ctx, executor, hostname); err != nil {
+				return false, err.Error()
+			}
+		}
+		return true, "rebooted"
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "An error occured during reboot of Node(s)"}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -15,6 +15,7 @@
 package kubeadm
 
 import (
+	"context"
 	"strings"
 	"sync"
 
@@ -23,45 +24,61 @@ import (
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-// output_stream types takes bool and string, returns nothing.
+// OutputStream sends a status message to the client
 type OutputStream func(bool, string)
 
-var output_stream pb.Kubeadm_RemoveNodeServer
+// removeNodeStream serializes the messages, workers are removed in
+// parallel
+type removeNodeStream struct {
+	pb.Kubeadm_RemoveNodeServer
+	mu sync.Mutex
+}
 
-func RemoveNodeOutput(success bool, message string) {
-	if err := output_stream.Send(&pb.StatusReply{Success: success,
-		Message: message}); err != nil {
-		log.Errorf("Send message failed: %s", err)
-	}
+func (s *removeNodeStream) Send(reply *pb.StatusReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Kubeadm_RemoveNodeServer.Send(reply)
 }
 
-func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) error {
+func RemoveNode(ctx context.Context, executor tools.NodeExecutor, minMasters int, in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) error {
+	stream = &removeNodeStream{Kubeadm_RemoveNodeServer: stream}
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
 	var nodelist []string
-	output_stream = stream
+	unreachable := 0
 
 	// If we have a list of Nodes, try to find the right node names which
 	// have a kubic-worker-node or kubic-master-node grain.
 	if strings.Index(in.NodeNames, ",") >= 0 || strings.Index(in.NodeNames, "[") >= 0 || strings.Compare(in.NodeNames, "*") == 0 {
-		var success bool
-		var message string
-
-		if strings.Index(in.NodeNames, ",") >= 0 && strings.Index(in.NodeNames, "[") == -1 {
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", "-L", in.NodeNames, "grains.get", "kubicd")
-		} else {
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", in.NodeNames, "grains.get", "kubicd")
-		}
-		if success != true {
-			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+		targets, err := tools.PingNodes(ctx, executor, in.NodeNames, tools.StreamAttempts(stream, "", "ping"))
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
 				return err
 			}
 			return nil
 		}
 
-		list := strings.Split(message, "\n")
-		for _, entry := range list {
-			if strings.Contains(entry, "'kubic-worker-node'") || strings.Contains(entry, "kubic-master-node") {
-				list := strings.Split(entry, ":")
-				nodelist = append(nodelist, list[0])
+		for _, role := range []string{"worker", "master"} {
+			members, err := tools.GetListOfNodes(ctx, executor, role)
+			if err != nil {
+				if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+					return err
+				}
+				return nil
+			}
+			for _, node := range targets.Minions() {
+				if _, ok := members[node]; !ok {
+					continue
+				}
+				if targets[node].Failed() {
+					if err := stream.Send(&pb.StatusReply{Success: false,
+						Message: node + ": not reachable: " + targets[node].Error().Error()}); err != nil {
+						return err
+					}
+					unreachable++
+				} else {
+					nodelist = append(nodelist, node)
+				}
 			}
 		}
 	} else {
@@ -72,6 +89,12 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 	nodelistLength := len(nodelist)
 
 	if nodelistLength == 0 {
+		if unreachable > 0 {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "No reachable Nodes found"}); err != nil {
+				return err
+			}
+			return nil
+		}
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: "No Nodes found"}); err != nil {
 			return err
 		}
@@ -79,51 +102,55 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 	}
 
 	haproxy_salt := Read_Cfg("control-plane.conf", "loadbalancer_salt")
-	var wg sync.WaitGroup
-	wg.Add(nodelistLength)
 
-	failed := 0
-	for i := 0; i < nodelistLength; i++ {
-		go func(i int) {
-			defer wg.Done()
-
-			stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": start node removal..."})
+	// Workers are removed in parallel, masters one after the other to
+	// keep the etcd quorum.
+	var workers, masters []string
+	cp, err := readControlPlane(ctx, executor)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot determine masters: " + err.Error()}); err != nil {
+			return err
+		}
+		if !in.Force {
+			return nil
+		}
+		cp = &controlPlane{}
+	}
+	for _, node := range nodelist {
+		hostname, err := executor.GetHostname(ctx, node)
+		if err == nil && !cp.isMaster(node, hostname) {
+			workers = append(workers, node)
+		} else {
+			masters = append(masters, node)
+		}
+	}
 
-			// If loadbalancer is known, remove from haproxy
-			if len(haproxy_salt) > 0 {
-				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": removing node from haproxy loadbalancer..."})
-				success, message := tools.ExecuteCmd("salt", "--module-executors='direct_call'", haproxy_salt, "cmd.run", "haproxycfg server remove "+nodelist[i])
-				if success != true {
-					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
-						log.Errorf("Send message failed: %s", err)
-					}
-					failed++ // XXX try to detect type: ignore for worker
-				}
-			}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
 
-			success, message := ResetNode(nodelist[i], RemoveNodeOutput)
-			if len(message) > 0 {
-				if err := stream.Send(&pb.StatusReply{Success: false,
-					Message: nodelist[i] + ": " + message}); err != nil {
-					log.Errorf("Send message failed: %s", err)
-				}
-			}
-			if success != true {
+	failed := unreachable
+	for _, node := range workers {
+		go func(node string) {
+			defer wg.Done()
+			if removeOneNode(ctx, executor, in, stream, node, haproxy_salt, minMasters) != true {
+				mu.Lock()
 				failed++
-				if err := stream.Send(&pb.StatusReply{Success: false,
-					Message: nodelist[i] + ": removal not fully successful, please check logs"}); err != nil {
-					log.Errorf("Send message failed: %s", err)
-				}
-			} else {
-				if err := stream.Send(&pb.StatusReply{Success: false,
-					Message: nodelist[i] + ": successfully removed"}); err != nil {
-					log.Errorf("Send message failed: %s", err)
-				}
+				mu.Unlock()
 			}
-		}(i)
+		}(node)
 	}
-
 	wg.Wait()
+
+	for _, node := range masters {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if removeOneNode(ctx, executor, in, stream, node, haproxy_salt, minMasters) != true {
+			failed++
+		}
+	}
+
 	if failed > 0 {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: "An error occured during removal of Nodes"}); err != nil {
@@ -132,3 +159,80 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 	}
 	return nil
 }
+
+// removeOneNode drains, resets and removes one node from the cluster.
+// Masters are only removed if etcd keeps it's quorum and at least
+// minMasters masters are left.
+func removeOneNode(ctx context.Context, executor tools.NodeExecutor, in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer,
+	node string, haproxy_salt string, minMasters int) bool {
+
+	stream.Send(&pb.StatusReply{Success: true, Message: node + ": start node removal..."})
+
+	hostname, err := executor.GetHostname(ctx, node)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + err.Error()}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		return false
+	}
+
+	master, err := lockMaster(ctx, executor, node, hostname, true, in.Force, minMasters,
+		tools.StreamAttempts(stream, node, "quorum"))
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + err.Error() + ", node not removed"}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		return false
+	}
+	if master {
+		defer releaseMasterLock()
+	}
+
+	stream.Send(&pb.StatusReply{Success: true, Message: node + ": draining node..."})
+	success, message := drainNode(ctx, executor, hostname, in.ForceDrain,
+		tools.StreamAttempts(stream, node, "drain"))
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + message + ", node not removed"}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		return false
+	}
+
+	ret_success := true
+
+	// If loadbalancer is known, remove from haproxy
+	if len(haproxy_salt) > 0 {
+		stream.Send(&pb.StatusReply{Success: true, Message: node + ": removing node from haproxy loadbalancer..."})
+		success, message = executor.Run(ctx, haproxy_salt, "haproxycfg", "server", "remove", node)
+		if success != true {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + message}); err != nil {
+				log.Errorf("Send message failed: %s", err)
+			}
+			ret_success = false // XXX try to detect type: ignore for worker
+		}
+	}
+
+	success, message = ResetNode(ctx, executor, node, func(success bool, message string) {
+		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+	})
+	if len(message) > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: node + ": " + message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+	}
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: node + ": removal not fully successful, please check logs"}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+		return false
+	}
+	if err := stream.Send(&pb.StatusReply{Success: false,
+		Message: node + ": successfully removed"}); err != nil {
+		log.Errorf("Send message failed: %s", err)
+	}
+	return ret_success
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// setupRemoveNode creates a cluster with three masters behind the
+// load balancer lb and one worker
+func setupRemoveNode(t *testing.T) (*tools.FakeExecutor, *fake.Clientset, *fakeEtcd) {
+	setupStateDir(t, map[string]string{"master": "master1",
+		"MultiMaster": "True", "loadbalancer_salt": "lb"})
+
+	executor := tools.NewFakeExecutor()
+	for _, node := range []string{"master1", "master2", "master3", "worker1", "lb"} {
+		executor.AddNode(node, node)
+	}
+	for _, node := range []string{"master2", "master3"} {
+		executor.Grains[node] = map[string][]string{"kubicd": {"kubic-master-node"}}
+	}
+	executor.Grains["worker1"] = map[string][]string{"kubicd": {"kubic-worker-node"}}
+
+	clientset := setupCluster(t, "v1.20.4",
+		testNode("master1", "v1.20.4"), testNode("master2", "v1.20.4"),
+		testNode("master3", "v1.20.4"), testNode("worker1", "v1.20.4"))
+
+	cluster := newFakeEtcd("master1", "master2", "master3")
+	setupEtcd(t, cluster)
+	return executor, clientset, cluster
+}
+
+func nodeExists(clientset *fake.Clientset, name string) bool {
+	_, err := clientset.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	return err == nil
+}
+
+func TestRemoveNode(t *testing.T) {
+	executor, clientset, cluster := setupRemoveNode(t)
+
+	stream := &recordStream{}
+	if err := RemoveNode(testContext(), executor, 1, &pb.RemoveNodeRequest{NodeNames: "master2,worker1"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			stream.dump(t)
+		}
+	}()
+
+	// only the master gets removed from etcd and has to check the quorum
+	if strings.Join(cluster.removed, ",") != "master2" {
+		t.Errorf("removed etcd members %v, expected master2", cluster.removed)
+	}
+	if stream.find("master2: master node, waiting for other master operations") == nil {
+		t.Errorf("master2 not handled as master")
+	}
+	if stream.find("worker1: master node") != nil {
+		t.Errorf("worker1 handled as master")
+	}
+
+	for _, node := range []string{"master2", "worker1"} {
+		for _, request := range []string{
+			"lb: haproxycfg server remove " + node,
+			node + ": kubeadm reset --force",
+			node + ": grains.delkey kubicd",
+		} {
+			if !contains(executor.History, request) {
+				t.Errorf("%q missing", request)
+			}
+		}
+		if nodeExists(clientset, node) {
+			t.Errorf("node %s not deleted", node)
+		}
+		if stream.find(node+": successfully removed") == nil {
+			t.Errorf("%s not reported as removed", node)
+		}
+	}
+	for _, node := range []string{"master1", "master3"} {
+		if contains(executor.History, node+": kubeadm reset") || !nodeExists(clientset, node) {
+			t.Errorf("%s got removed", node)
+		}
+	}
+	if stream.find("An error occured") != nil {
+		t.Errorf("removal reported an error")
+	}
+}
+
+func TestRemoveNodeMinMasters(t *testing.T) {
+	executor, clientset, cluster := setupRemoveNode(t)
+
+	stream := &recordStream{}
+	if err := RemoveNode(testContext(), executor, 3, &pb.RemoveNodeRequest{NodeNames: "master2,worker1"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			stream.dump(t)
+		}
+	}()
+
+	// the master is refused before it gets drained
+	if reply := stream.find("master2: only 2 masters would be left, the minimum is 3, use force to continue anyway, node not removed"); reply == nil || reply.Success {
+		t.Errorf("refused removal of master2 not reported")
+	}
+	if len(cluster.removed) > 0 {
+		t.Errorf("removed etcd members %v", cluster.removed)
+	}
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), "master2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("master2: %v", err)
+	}
+	if node.Spec.Unschedulable {
+		t.Errorf("master2 got cordoned")
+	}
+	if contains(executor.History, "master2: kubeadm reset") || contains(executor.History, "lb: haproxycfg server remove master2") {
+		t.Errorf("master2 got reset")
+	}
+
+	// the worker does not care about the number of masters
+	if !contains(executor.History, "worker1: kubeadm reset --force") || nodeExists(clientset, "worker1") {
+		t.Errorf("worker1 not removed")
+	}
+
+	if last := stream.last(); last.Success || last.Message != "An error occured during removal of Nodes" {
+		t.Errorf("last reply is %v: %q", last.Success, last.Message)
+	}
+}
@@ -15,9 +15,9 @@
 package kubeadm
 
 import (
+	"context"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
@@ -36,73 +36,56 @@ func removeContents(dir string) error {
 	return nil
 }
 
-func ResetMaster() (bool, string) {
+func ResetMaster(ctx context.Context, executor tools.NodeExecutor) (bool, string) {
 
-	success, message := tools.ExecuteCmd("kubeadm", "reset", "--force")
+	success, message := executor.Run(ctx, "", "kubeadm", "reset", "--force")
 
 	// cleanup behind kubeadm
-	removeContents("/var/lib/etcd")
-	removeContents("/var/lib/cni")
+	if !tools.DryRun(executor, "remove /var/lib/etcd/*, /var/lib/cni/*, "+stateDir+"/control-plane.conf and "+stateDir+"/k8s-yaml.conf") {
+		removeContents("/var/lib/etcd")
+		removeContents("/var/lib/cni")
 
-	os.Remove("/var/lib/kubic-control/control-plane.conf")
-	os.Remove("/var/lib/kubic-control/k8s-yaml.conf")
+		os.Remove(stateDir + "/control-plane.conf")
+		os.Remove(stateDir + "/k8s-yaml.conf")
+	}
 
-	tools.ExecuteCmd("systemctl", "disable", "--now", "crio")
-	tools.ExecuteCmd("systemctl", "disable", "--now", "kubelet")
+	executor.Run(ctx, "", "systemctl", "disable", "--now", "crio")
+	executor.Run(ctx, "", "systemctl", "disable", "--now", "kubelet")
 
 	return success, message
 }
 
-func ResetNode(nodeName string, send OutputStream) (bool, string) {
+// ResetNode removes a node from the etcd cluster and kubernetes and
+// cleans it up. The node has to be drained before.
+func ResetNode(ctx context.Context, executor tools.NodeExecutor, nodeName string, send OutputStream) (bool, string) {
 
 	ret_success := true
 
-	hostname, err := tools.GetNodeName(nodeName)
+	hostname, err := executor.GetHostname(ctx, nodeName)
 	if err != nil {
 		return false, err.Error()
 	}
 
-	send(true, nodeName+": draining node...")
-	/* ignore if we cannot drain node */
-	tools.DrainNode(hostname, "")
+	report := func(message string) {
+		send(true, nodeName+": "+message)
+	}
 
 	send(true, nodeName+": verify etcd cluster...")
 	/* Delete the node from the etcd member list if it is on it.
 	   Else we will can end with a non-functional etcd cluster */
-	success, message := tools.ExecuteCmd("etcdctl",
-		"--endpoints", "https://localhost:2379",
-		"--ca-file", "/etc/kubernetes/pki/etcd/ca.crt",
-		"--cert-file", "/etc/kubernetes/pki/etcd/server.crt",
-		"--key-file", "/etc/kubernetes/pki/etcd/server.key",
-		"member", "list")
-	if success == true {
-		var etcd_member_id string
-
-		list := strings.Split(message, "\n")
-		for _, entry := range list {
-			if strings.Contains(entry, "name="+hostname) {
-				list := strings.Split(entry, ":")
-				etcd_member_id = list[0]
-
-				success, message = tools.ExecuteCmd("etcdctl",
-					"--endpoints", "https://localhost:2379",
-					"--ca-file", "/etc/kubernetes/pki/etcd/ca.crt",
-					"--cert-file", "/etc/kubernetes/pki/etcd/server.crt",
-					"--key-file", "/etc/kubernetes/pki/etcd/server.key",
-					"member", "remove", etcd_member_id)
-				if success != true {
-					send(success, nodeName+": "+message+" (ignored)")
-					ret_success = false
-				}
-			}
-		}
+	success, message := removeEtcdMember(ctx, executor, hostname)
+	if success != true {
+		send(success, nodeName+": "+message+" (ignored)")
+		ret_success = false
 	}
 
 	/* reset the node. Even if this fails, continue cleanup, but
 	   report back */
 	send(true, nodeName+": reset node...")
-	success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName,
-		"cmd.run", "kubeadm reset --force")
+	success, message = tools.RetryStep(ctx, tools.StepKubeadm, report,
+		func(ctx context.Context) (bool, string) {
+			return executor.Run(ctx, nodeName, "kubeadm", "reset", "--force")
+		})
 	if success != true {
 		send(success, nodeName+": "+message+" (ignored)")
 		ret_success = false
@@ -110,23 +93,20 @@ func ResetNode(nodeName string, send OutputStream) (bool, string) {
 
 	send(true, nodeName+": cleanup after kubeadm...")
 	/* Try some system cleanup, ignore if fails */
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "cmd.run",
-		"sed -i -e 's|^REBOOT_METHOD=kured|REBOOT_METHOD=auto|g' /etc/transactional-update.conf")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "grains.delkey", "kubicd")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "cmd.run",
-		"\"iptables -F && iptables -t nat -F && iptables -t mangle -F && iptables -X\"")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "cmd.run", "\"rm -rf /var/lib/etcd/*\"")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "cmd.run", "\"rm -rf /var/lib/cni/*\"")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "cmd.run", "\"ip link delete cni0;  ip link delete flannel.1\"")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "service.disable", "kubelet")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "service.stop", "kubelet")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "service.disable", "crio")
-	tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodeName, "service.stop", "crio")
+	executor.Run(ctx, nodeName, "sed -i -e 's|^REBOOT_METHOD=kured|REBOOT_METHOD=auto|g' /etc/transactional-update.conf")
+	executor.Call(ctx, nodeName, "grains.delkey", "kubicd")
+	executor.Run(ctx, nodeName, "iptables -F && iptables -t nat -F && iptables -t mangle -F && iptables -X")
+	executor.Run(ctx, nodeName, "rm -rf /var/lib/etcd/*")
+	executor.Run(ctx, nodeName, "rm -rf /var/lib/cni/*")
+	executor.Run(ctx, nodeName, "ip link delete cni0;  ip link delete flannel.1")
+	executor.Call(ctx, nodeName, "service.disable", "kubelet")
+	executor.Call(ctx, nodeName, "service.stop", "kubelet")
+	executor.Call(ctx, nodeName, "service.disable", "crio")
+	executor.Call(ctx, nodeName, "service.stop", "crio")
 
 	/* ignore if we cannot delete the node*/
 	send(true, nodeName+": final node deletion...")
-	success, message = tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
-		"delete", "node", hostname)
+	success, message = deleteNode(ctx, executor, hostname)
 	if success != true {
 		send(success, nodeName+": "+message+" (ignored)")
 		ret_success = false
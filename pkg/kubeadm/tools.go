@@ -15,12 +15,21 @@
 package kubeadm
 
 import (
+	"context"
+	"time"
+
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
 	"gopkg.in/ini.v1"
 )
 
+// stateDir contains the configuration and state of kubicd, tests
+// replace it with a temporary directory
+var stateDir = "/var/lib/kubic-control"
+
 // read data /var/lib/kubic-control
 func Read_Cfg(file string, key string) string {
-	cfg, err := ini.LooseLoad("/var/lib/kubic-control/" + file)
+	cfg, err := ini.LooseLoad(stateDir + "/" + file)
 	if err != nil {
 		return ""
 	}
@@ -28,3 +37,83 @@ func Read_Cfg(file string, key string) string {
 	value := cfg.Section("").Key(key).String()
 	return value
 }
+
+// cleanupContext returns the context for cleanup steps after a failed
+// operation. They have to run even if the request was cancelled.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Minute)
+}
+
+// cleanupMaster resets the master after a failed or cancelled setup
+func cleanupMaster(executor tools.NodeExecutor) (bool, string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	return ResetMaster(ctx, executor)
+}
+
+// cordonNode marks a node as unschedulable
+func cordonNode(ctx context.Context, executor tools.NodeExecutor, hostname string) (bool, string) {
+	if tools.DryRun(executor, "cordon node "+hostname) {
+		return true, ""
+	}
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return false, err.Error()
+	}
+	if err := client.Cordon(ctx, hostname); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// drainNode drains a node and reports the progress. If draining fails
+// and force is set, the failure is only reported and the caller can
+// continue. Else the node gets uncordoned again and the error returned.
+func drainNode(ctx context.Context, executor tools.NodeExecutor, hostname string, force bool, report tools.AttemptFunc) (bool, string) {
+	success, message := tools.DrainNode(ctx, executor, hostname, report)
+	if success == true {
+		return true, ""
+	}
+	if force && ctx.Err() == nil {
+		if report != nil {
+			report("draining failed, continuing anyway: " + message)
+		}
+		return true, ""
+	}
+	uncordonNode(executor, hostname)
+	return false, "draining node " + hostname + " failed: " + message
+}
+
+// uncordonNode makes a drained node schedulable again
+func uncordonNode(executor tools.NodeExecutor, hostname string) (bool, string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	if tools.DryRun(executor, "uncordon node "+hostname) {
+		return true, ""
+	}
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return false, err.Error()
+	}
+	if err := client.Uncordon(ctx, hostname); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// deleteNode removes the node object from the cluster
+func deleteNode(ctx context.Context, executor tools.NodeExecutor, hostname string) (bool, string) {
+	if tools.DryRun(executor, "delete node "+hostname) {
+		return true, ""
+	}
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return false, err.Error()
+	}
+	// already gone is fine, too
+	if err := client.DeleteNode(ctx, hostname); err != nil && !k8s.IsNotFound(err) {
+		return false, err.Error()
+	}
+	return true, ""
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/etcd"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"gopkg.in/ini.v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	fakerest "k8s.io/client-go/rest/fake"
+)
+
+// recordStream records all replies, it implements the server side of
+// all streaming kubeadm requests
+type recordStream struct {
+	grpc.ServerStream
+	mu      sync.Mutex
+	replies []*pb.StatusReply
+}
+
+func (s *recordStream) Send(reply *pb.StatusReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, reply)
+	return nil
+}
+
+// find returns the first reply containing message
+func (s *recordStream) find(message string) *pb.StatusReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reply := range s.replies {
+		if strings.Contains(reply.Message, message) {
+			return reply
+		}
+	}
+	return nil
+}
+
+func (s *recordStream) last() *pb.StatusReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.replies) == 0 {
+		return &pb.StatusReply{}
+	}
+	return s.replies[len(s.replies)-1]
+}
+
+func (s *recordStream) dump(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reply := range s.replies {
+		t.Logf("%v: %s", reply.Success, reply.Message)
+	}
+}
+
+// contains returns true if one entry of history starts with request
+func contains(history []string, request string) bool {
+	for _, entry := range history {
+		if strings.HasPrefix(entry, request) {
+			return true
+		}
+	}
+	return false
+}
+
+// testContext returns a context, whose retry policy does not wait
+// between two attempts
+func testContext() context.Context {
+	policy := tools.DefaultRetryPolicy()
+	for step, stepPolicy := range policy {
+		stepPolicy.Backoff = time.Millisecond
+		policy[step] = stepPolicy
+	}
+	return tools.WithRetryPolicy(context.Background(), policy)
+}
+
+// setupStateDir moves the state of kubicd into a temporary directory
+// and writes control-plane.conf
+func setupStateDir(t *testing.T, controlPlane map[string]string) {
+	dir := t.TempDir()
+	saved := []string{stateDir, upgradeStateFile, nodeConfigFile, snapshotListFile}
+	stateDir = dir
+	upgradeStateFile = dir + "/upgrade.conf"
+	nodeConfigFile = dir + "/nodes.conf"
+	snapshotListFile = dir + "/etcd-snapshots.conf"
+	t.Cleanup(func() {
+		stateDir, upgradeStateFile, nodeConfigFile, snapshotListFile = saved[0], saved[1], saved[2], saved[3]
+	})
+
+	cfg := ini.Empty()
+	for key, value := range controlPlane {
+		cfg.Section("").Key(key).SetValue(value)
+	}
+	if err := cfg.SaveTo(dir + "/control-plane.conf"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readyClientset is a fake clientset with a ready API server
+type readyClientset struct {
+	*fake.Clientset
+}
+
+func (c readyClientset) Discovery() discovery.DiscoveryInterface {
+	return readyDiscovery{c.Clientset.Discovery().(*fakediscovery.FakeDiscovery)}
+}
+
+type readyDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+// RESTClient answers /readyz, the fake discovery has no REST client
+func (readyDiscovery) RESTClient() rest.Interface {
+	return &fakerest.RESTClient{
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		Client: fakerest.CreateHTTPClient(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK,
+				Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+		}),
+	}
+}
+
+func testNode(name string, kubeletVersion string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			NodeInfo:   corev1.NodeSystemInfo{KubeletVersion: kubeletVersion},
+		},
+	}
+}
+
+// setupCluster lets k8s.NewAdminClient return a client for a fake
+// cluster running serverVersion with the given objects
+func setupCluster(t *testing.T, serverVersion string, objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: serverVersion}
+
+	saved := k8s.NewAdminClient
+	k8s.NewAdminClient = func() (*k8s.Client, error) {
+		return k8s.NewClientFromInterfaces(readyClientset{clientset}, nil, nil), nil
+	}
+	t.Cleanup(func() {
+		k8s.NewAdminClient = saved
+	})
+	return clientset
+}
+
+// fakeEtcd is an etcd cluster with healthy members
+type fakeEtcd struct {
+	clientv3.Cluster
+	clientv3.KV
+	clientv3.Maintenance
+
+	mu      sync.Mutex
+	members []*etcdserverpb.Member
+	// names of the removed members
+	removed []string
+}
+
+func newFakeEtcd(names ...string) *fakeEtcd {
+	f := &fakeEtcd{}
+	for i, name := range names {
+		f.members = append(f.members, &etcdserverpb.Member{ID: uint64(i + 1), Name: name,
+			PeerURLs:   []string{"https://" + name + ":2380"},
+			ClientURLs: []string{"https://" + name + ":2379"}})
+	}
+	return f
+}
+
+func (f *fakeEtcd) MemberList(ctx context.Context) (*clientv3.MemberListResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &clientv3.MemberListResponse{Members: append([]*etcdserverpb.Member{}, f.members...)}, nil
+}
+
+func (f *fakeEtcd) MemberRemove(ctx context.Context, id uint64) (*clientv3.MemberRemoveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, member := range f.members {
+		if member.ID == id {
+			f.members = append(f.members[:i], f.members[i+1:]...)
+			f.removed = append(f.removed, member.Name)
+			break
+		}
+	}
+	return &clientv3.MemberRemoveResponse{}, nil
+}
+
+func (f *fakeEtcd) Status(ctx context.Context, endpoint string) (*clientv3.StatusResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, member := range f.members {
+		if member.ClientURLs[0] == endpoint {
+			return &clientv3.StatusResponse{Header: &etcdserverpb.ResponseHeader{MemberId: member.ID},
+				Leader: 1, Version: "3.5.1"}, nil
+		}
+	}
+	return nil, context.DeadlineExceeded
+}
+
+func (f *fakeEtcd) Close() error {
+	return nil
+}
+
+// setupEtcd lets newEtcdClient return a client for f
+func setupEtcd(t *testing.T, f *fakeEtcd) {
+	saved := newEtcdClient
+	newEtcdClient = func(ctx context.Context, executor tools.NodeExecutor) (*etcd.Client, error) {
+		return etcd.NewClientFromAPI(f), nil
+	}
+	t.Cleanup(func() {
+		newEtcdClient = saved
+	})
+}
@@ -15,198 +15,527 @@
 package kubeadm
 
 import (
-	"os"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/deployment"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
 	"github.com/thkukuk/kubic-control/pkg/tools"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-func uncordon(stream pb.Kubeadm_UpgradeKubernetesServer, hostname string) error {
-	// uncordon
-	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "uncordon", hostname)
-	if success != true {
-		// Report error, but don't fail
-		if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
-			return err
+const (
+	// how long the upgraded nodes of a batch may need to become Ready
+	upgradeGateTimeout  = 10 * time.Minute
+	upgradeGateInterval = 10 * time.Second
+)
+
+// kubeletVersion strips down kubernetes_version to get the kubelet
+// major version for openSUSE Kubic (from "v1.18.6" to "1.18")
+func kubeletVersion(kubernetes_version string) string {
+	kubelet_version := strings.TrimPrefix(kubernetes_version, "v")
+	if i := strings.LastIndex(kubelet_version, "."); i > 0 {
+		kubelet_version = kubelet_version[:i]
+	}
+	return kubelet_version
+}
+
+// upgradeStream serializes the messages, workers are upgraded in parallel
+type upgradeStream struct {
+	pb.Kubeadm_UpgradeKubernetesServer
+	mu sync.Mutex
+}
+
+func (s *upgradeStream) Send(reply *pb.StatusReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Kubeadm_UpgradeKubernetesServer.Send(reply)
+}
+
+// parseMaxUnavailable returns how many of total nodes may be upgraded
+// at the same time, value is a number or a percentage of total.
+func parseMaxUnavailable(value string, total int) (int, error) {
+	if len(value) == 0 {
+		return 1, nil
+	}
+	maxUnavailable := intstr.Parse(value)
+	count, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, total, false)
+	if err != nil {
+		return 0, errors.New("invalid max unavailable \"" + value + "\": " + err.Error())
+	}
+	if count < 0 || (maxUnavailable.Type == intstr.Int && count == 0) {
+		return 0, errors.New("invalid max unavailable \"" + value + "\": must be at least 1")
+	}
+	// a percentage gets rounded down, but at least one node
+	// has to be upgraded at a time
+	if count == 0 {
+		count = 1
+	}
+	return count, nil
+}
+
+// orderNodes sorts nodelist by name, the nodes listed in order are
+// moved to the front in the given order.
+func orderNodes(nodelist []string, order []string) []string {
+	rest := map[string]bool{}
+	for _, node := range nodelist {
+		rest[node] = true
+	}
+	var ordered []string
+	for _, node := range order {
+		if rest[node] {
+			ordered = append(ordered, node)
+			delete(rest, node)
 		}
 	}
-	return nil
+	var sorted []string
+	for node := range rest {
+		sorted = append(sorted, node)
+	}
+	sort.Strings(sorted)
+	return append(ordered, sorted...)
 }
 
-func upgradeFirstMaster(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer, kubernetes_version string) error {
-	var hostname string
-	var err error
+// notReadyNodes returns the nodes of hostnames, which are not Ready
+func notReadyNodes(ctx context.Context, client *k8s.Client, hostnames []string) ([]string, error) {
+	if err := client.Readyz(ctx); err != nil {
+		return nil, err
+	}
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ready := map[string]bool{}
+	for _, node := range nodes {
+		ready[node.Name] = nodeReady(node) == corev1.ConditionTrue
+	}
+	var notReady []string
+	for _, hostname := range hostnames {
+		if !ready[hostname] {
+			notReady = append(notReady, hostname)
+		}
+	}
+	return notReady, nil
+}
 
-	firstMaster := Read_Cfg("control-plane.conf", "master")
-	if len(firstMaster) > 0 {
-		hostname, err = tools.GetNodeName(firstMaster)
-	} else {
-		hostname, err = os.Hostname()
-		if err != nil {
-			if err2 := stream.Send(&pb.StatusReply{Success: false,
-				Message: "Could not get hostname: " + err.Error()}); err2 != nil {
-				return err2
-			}
+// waitForUpgradedNodes is the health gate between two batches: the API
+// server has to be ready and all upgraded nodes have to be Ready again.
+func waitForUpgradedNodes(ctx context.Context, executor tools.NodeExecutor, hostnames []string) error {
+	if tools.IsDryRun(executor) || len(hostnames) == 0 {
+		return nil
+	}
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upgradeGateTimeout)
+	defer cancel()
+	for {
+		notReady, err := notReadyNodes(ctx, client, hostnames)
+		if err == nil && len(notReady) == 0 {
 			return nil
 		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return errors.New("nodes not ready: " + strings.Join(notReady, ", "))
+		case <-time.After(upgradeGateInterval):
+		}
 	}
+}
 
-	if err = stream.Send(&pb.StatusReply{Success: true, Message: "Validate whether the cluster is upgradeable..."}); err != nil {
-		return err
+// upgradeNode drains the node, upgrades it with kubeadm, switches the
+// kubelet to the new version and uncordons it again. Steps, which the
+// node already completed according to state, are skipped. If backup is
+// set, the control plane gets rolled back if kubeadm fails. The returned
+// string is the reason, why the upgrade failed.
+func upgradeNode(ctx context.Context, executor tools.NodeExecutor, in *pb.UpgradeRequest,
+	stream pb.Kubeadm_UpgradeKubernetesServer, state *upgradeState,
+	node string, hostname string, firstMaster bool, backup *controlPlaneBackup) (string, error) {
+	state.setHostname(node, hostname)
+
+	message := "Upgrade " + masterName(node) + "..."
+	if firstMaster {
+		message = "Upgrade the control plane on " + masterName(node) + "..."
 	}
-	success, message := executeCmdSalt(firstMaster, "kubeadm", "upgrade", "plan", kubernetes_version)
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
-			return err
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
+		return "", err
+	}
+
+	// a node, which is still cordoned from an interrupted upgrade,
+	// was already drained
+	if !state.cordoned(node) {
+		success, message := drainNode(ctx, executor, hostname, in.ForceDrain,
+			tools.StreamAttempts(stream, node, "drain"))
+		if success != true {
+			// skip this node, it is still running the old version
+			state.fail(node, "drain")
+			if err := stream.Send(&pb.StatusReply{Success: true, Message: masterName(node) + ": " + message}); err != nil {
+				return "", err
+			}
+			return "drain", nil
 		}
-		return nil
+		state.set(node, upgradeDrained)
 	}
 
-	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Drain first control plane master (" + hostname + ")..."}); err != nil {
-		return err
+	failed := ""
+	if !state.completed(node, upgradeKubeadmUpgraded) {
+		step := "kubeadm upgrade node"
+		args := []string{"upgrade", "node"}
+		if firstMaster {
+			step = "kubeadm upgrade apply"
+			args = []string{"upgrade", "apply", in.KubernetesVersion, "--yes"}
+		}
+		success, message := tools.RetryStep(ctx, tools.StepKubeadm,
+			tools.StreamAttempts(stream, node, step),
+			func(ctx context.Context) (bool, string) {
+				return executor.RunStream(ctx, node,
+					tools.StreamOutput(stream, node, step),
+					"kubeadm", args...)
+			})
+		if success != true {
+			failed = "kubeadm"
+			if err := stream.Send(&pb.StatusReply{Success: true, Message: masterName(node) + ": " + message}); err != nil {
+				uncordonNode(executor, hostname)
+				state.fail(node, failed)
+				return "", err
+			}
+		} else {
+			state.set(node, upgradeKubeadmUpgraded)
+		}
+	}
+	if len(failed) == 0 && !state.completed(node, upgradeKubeletUpdated) {
+		// Update kubelet
+		success, message := executor.Run(ctx, node, "sed", "-i", "s/KUBELET_VER=.*/KUBELET_VER="+kubeletVersion(in.KubernetesVersion)+"/", "/etc/sysconfig/kubelet")
+		if success != true {
+			failed = "kubelet_ver"
+		} else {
+			success, message = tools.RetryStep(ctx, tools.StepService,
+				tools.StreamAttempts(stream, node, "service"),
+				func(ctx context.Context) (bool, string) {
+					return executor.Call(ctx, node, "service.restart", "kubelet")
+				})
+			if success != true {
+				failed = "kubelet"
+			} else {
+				state.set(node, upgradeKubeletUpdated)
+			}
+		}
+		if len(failed) > 0 {
+			if firstMaster {
+				message = message + " (the control plane is already upgraded and not rolled back, fix the kubelet and run \"kubicctl upgrade resume\")"
+			}
+			if err := stream.Send(&pb.StatusReply{Success: true, Message: masterName(node) + ": " + message}); err != nil {
+				uncordonNode(executor, hostname)
+				state.fail(node, failed)
+				return "", err
+			}
+		}
 	}
-	// if draining fails, ignore
-	tools.DrainNode(hostname, "")
 
-	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Upgrade the control plane..."}); err != nil {
-		uncordon(stream, hostname)
-		return err
+	// Only a failed "kubeadm upgrade apply" can be rolled back. After it
+	// did succeed, kubeadm-config, CoreDNS and kube-proxy of the whole
+	// cluster are upgraded already and would not fit to the old manifests.
+	rolledBack := false
+	if failed == "kubeadm" && backup != nil {
+		if err := rollbackControlPlane(executor, backup, hostname, stream); err != nil {
+			failed = failed + ", rollback failed"
+			if err := stream.Send(&pb.StatusReply{Success: true,
+				Message: "Rollback of " + masterName(node) + " failed: " + err.Error()}); err != nil {
+				uncordonNode(executor, hostname)
+				state.fail(node, failed)
+				return "", err
+			}
+		} else {
+			failed = failed + ", rolled back"
+			rolledBack = true
+		}
 	}
-	success, message = executeCmdSalt(firstMaster, "kubeadm", "upgrade", "apply", kubernetes_version, "--yes")
+
+	// uncordon, even if the request was cancelled. Most likely the
+	// node will still work, else we can run out of nodes
+	success, message := uncordonNode(executor, hostname)
 	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
-			uncordon(stream, hostname)
-			return err
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: masterName(node) + ": " + message}); err != nil {
+			state.fail(node, "uncordon")
+			return "", err
 		}
-		uncordon(stream, hostname)
-		return nil
+		if len(failed) == 0 {
+			failed = "uncordon"
+		}
+	}
+	if rolledBack {
+		state.rolledBack(node, failed)
+		return failed, nil
+	}
+	if len(failed) > 0 {
+		state.fail(node, failed)
+		return failed, nil
+	}
+	state.set(node, upgradeUncordoned)
+	return "", nil
+}
+
+// upgradeFirstMaster upgrades the control plane with "kubeadm upgrade
+// apply" on the first master. Before, the manifests, the kubelet
+// configuration and etcd get backed up to roll back if the upgrade fails.
+// It returns false if the upgrade failed and must not continue with the
+// other nodes.
+func upgradeFirstMaster(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig, in *pb.UpgradeRequest,
+	stream pb.Kubeadm_UpgradeKubernetesServer, state *upgradeState) (bool, error) {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if state.completed(firstMaster, upgradeUncordoned) {
+		return true, nil
 	}
-	// strip down kubernetes_version to get kubelet major version
-	// for openSUSE Kubic (from "v1.18.6" to "1.18")
-	kubelet_version := kubernetes_version[1:]
-	kubelet_version = kubelet_version[:strings.LastIndex(kubelet_version, ".")]
 
-	// Update kubelet
-	success, message = executeCmdSalt(firstMaster, "sed", "-i", "s/KUBELET_VER=.*/KUBELET_VER="+kubelet_version+"/", "/etc/sysconfig/kubelet")
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
-			uncordon(stream, hostname)
-			return err
+	hostname, err := executor.GetHostname(ctx, firstMaster)
+	if err != nil {
+		state.fail(firstMaster, "determine hostname")
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: "Could not get hostname: " + err.Error()}); err != nil {
+			return false, err
 		}
-		uncordon(stream, hostname)
-		return nil
+		return false, nil
 	}
-	success, message = executeCmdSalt(firstMaster, "systemctl", "restart", "kubelet")
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
-			uncordon(stream, hostname)
-			return err
+
+	if !state.completed(firstMaster, upgradeKubeadmUpgraded) {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Validate whether the cluster is upgradeable..."}); err != nil {
+			return false, err
 		}
-		uncordon(stream, hostname)
-		return nil
+		success, message := tools.RetryStep(ctx, tools.StepKubeadm,
+			tools.StreamAttempts(stream, firstMaster, "kubeadm upgrade plan"),
+			func(ctx context.Context) (bool, string) {
+				return executor.Run(ctx, firstMaster, "kubeadm", "upgrade", "plan", in.KubernetesVersion)
+			})
+		if success != true {
+			state.fail(firstMaster, "kubeadm upgrade plan")
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return false, err
+			}
+			return false, nil
+		}
+	}
+
+	// nothing to roll back if "kubeadm upgrade apply" did already
+	// succeed before the upgrade got interrupted
+	var backup *controlPlaneBackup
+	if !state.completed(firstMaster, upgradeKubeadmUpgraded) {
+		backup, err = backupControlPlane(ctx, executor, config, firstMaster, in.KubernetesVersion, stream)
+		if err != nil {
+			state.fail(firstMaster, "backup")
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return false, err
+			}
+			return false, nil
+		}
+	}
+
+	reason, err := upgradeNode(ctx, executor, in, stream, state, firstMaster, hostname, true, backup)
+	if err != nil {
+		return false, err
 	}
-	return uncordon(stream, hostname)
+	if len(reason) > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: "Upgrade of the first master " + hostname + " failed (" + reason + ")"}); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
 }
 
-func upgradeNodes(in *pb.UpgradeRequest,
-	stream pb.Kubeadm_UpgradeKubernetesServer,
-	role string, kubernetes_version string) (string, error) {
-	// Get list of all role nodes:
-	success, message, nodelist := tools.GetListOfNodes(role)
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+// upgradeNodes upgrades all pending nodes of role in batches of
+// maxUnavailable nodes. After every batch the upgraded nodes have to
+// become Ready again, else the upgrade stops. It stops as well if
+// max_failures nodes could not be upgraded.
+func upgradeNodes(ctx context.Context, executor tools.NodeExecutor, in *pb.UpgradeRequest,
+	stream pb.Kubeadm_UpgradeKubernetesServer, state *upgradeState,
+	unreachable map[string]bool, role string, maxUnavailable string) (string, error) {
+	var failedNodes = ""
+	var nodelist []string
+	for _, node := range state.pending(role) {
+		// the preflight check refuses unreachable nodes, but a node
+		// can stop answering before syncUpgradeNodes pings it again.
+		// It stays pending, so that a resume can upgrade it later.
+		if unreachable[node] {
+			failedNodes = failedNodes + node + " (unreachable), "
+		} else {
+			nodelist = append(nodelist, node)
+		}
+	}
+	nodelist = orderNodes(nodelist, in.Order)
+	batchSize, err := parseMaxUnavailable(maxUnavailable, len(nodelist))
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
 			return "", err
 		}
 		return "", nil
 	}
 
-	// strip down kubernetes_version to get kubelet major version
-	// for openSUSE Kubic (from "v1.18.6" to "1.18")
-	kubelet_version := kubernetes_version[1:]
-	kubelet_version = kubelet_version[:strings.LastIndex(kubelet_version, ".")]
+	failed := 0
+	for start := 0; start < len(nodelist); start += batchSize {
+		if ctx.Err() != nil {
+			return failedNodes, ctx.Err()
+		}
+		if in.MaxFailures > 0 && failed >= int(in.MaxFailures) {
+			if err := stream.Send(&pb.StatusReply{Success: true,
+				Message: "Stop upgrade of " + role + " nodes, " + strconv.Itoa(failed) + " nodes failed"}); err != nil {
+				return "", err
+			}
+			for _, node := range nodelist[start:] {
+				failedNodes = failedNodes + node + " (skipped), "
+			}
+			break
+		}
 
-	var failedNodes = ""
-	for i := range nodelist {
-		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Upgrade " + nodelist[i] + "..."}); err != nil {
-			return "", err
+		end := start + batchSize
+		if end > len(nodelist) {
+			end = len(nodelist)
+		}
+		batch := nodelist[start:end]
+		reasons := make([]string, len(batch))
+		hostnames := make([]string, len(batch))
+		var sendErr error
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for i := range batch {
+			go func(i int) {
+				defer wg.Done()
+				hostname, err := executor.GetHostname(ctx, batch[i])
+				if err != nil {
+					reasons[i] = "determine hostname"
+					state.fail(batch[i], reasons[i])
+					return
+				}
+				reasons[i], err = upgradeNode(ctx, executor, in, stream, state, batch[i], hostname, false, nil)
+				if err != nil {
+					mu.Lock()
+					sendErr = err
+					mu.Unlock()
+				}
+				if len(reasons[i]) == 0 {
+					hostnames[i] = hostname
+				}
+			}(i)
+		}
+		wg.Wait()
+		if sendErr != nil {
+			return "", sendErr
 		}
-		hostname, err := tools.GetNodeName(nodelist[i])
-		if err != nil {
-			failedNodes = failedNodes + nodelist[i] + "(determine hostname), "
-		} else {
-			// if draining fails, ignore
-			tools.DrainNode(hostname, "")
 
-			success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "cmd.run",
-				"\"kubeadm upgrade node\"")
-			if success != true {
-				failedNodes = failedNodes + nodelist[i] + " (kubeadm), "
+		var upgraded []string
+		for i := range batch {
+			if len(reasons[i]) > 0 {
+				failedNodes = failedNodes + batch[i] + " (" + reasons[i] + "), "
+				failed++
 			} else {
-				// Update kubelet
-				success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "cmd.run",
-					"\"sed -i s/KUBELET_VER=.*/KUBELET_VER="+kubelet_version+"/ /etc/sysconfig/kubelet\"")
-				if success != true {
-					failedNodes = failedNodes + nodelist[i] + " (kubelet_ver), "
-				} else {
-					success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", nodelist[i], "service.restart", "kubelet")
-					if success != true {
-						failedNodes = failedNodes + nodelist[i] + " (kubelet), "
-					}
-				}
+				upgraded = append(upgraded, hostnames[i])
 			}
-			// uncordon, most likely node will still work, else we can run out of nodes
-			success, message = tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "uncordon", hostname)
-			if success != true {
-				failedNodes = failedNodes + nodelist[i] + " (uncordon), "
+		}
+		if end < len(nodelist) {
+			if err := waitForUpgradedNodes(ctx, executor, upgraded); err != nil {
+				if err := stream.Send(&pb.StatusReply{Success: true,
+					Message: "Stop upgrade of " + role + " nodes, health check failed: " + err.Error()}); err != nil {
+					return "", err
+				}
+				for _, node := range nodelist[end:] {
+					failedNodes = failedNodes + node + " (skipped), "
+				}
+				break
 			}
 		}
 	}
 	return failedNodes, nil
 }
 
-func UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer) error {
-
-	multiMaster := Read_Cfg("control-plane.conf", "MultiMaster")
+// syncUpgradeNodes adds all nodes of the cluster to the upgrade state
+// and drops nodes, which were removed from the cluster meanwhile. The
+// nodes, which cannot be reached, are returned.
+func syncUpgradeNodes(ctx context.Context, executor tools.NodeExecutor,
+	stream pb.Kubeadm_UpgradeKubernetesServer, state *upgradeState) (map[string]bool, bool, error) {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	state.add(firstMaster, roleFirstMaster)
 
-	kubernetes_version := ""
-	if len(in.KubernetesVersion) > 0 {
-		kubernetes_version = in.KubernetesVersion
-	} else {
-		success, message := tools.GetKubeadmVersion("") // XXX Upgrade needs to support remote master
-		if success != true {
-			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
-				return err
+	roles := []string{roleWorker}
+	if strings.EqualFold(Read_Cfg("control-plane.conf", "MultiMaster"), "True") {
+		roles = []string{roleMaster, roleWorker}
+	}
+	unreachable := map[string]bool{}
+	for _, role := range roles {
+		// Get list of all role nodes:
+		results, err := tools.GetListOfNodes(ctx, executor, role)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return nil, false, err
+			}
+			return nil, false, nil
+		}
+		members := map[string]bool{}
+		succeeded := results.Succeeded()
+		sort.Strings(succeeded)
+		for _, node := range succeeded {
+			members[node] = true
+			if node != firstMaster {
+				state.add(node, role)
+			}
+		}
+		for _, node := range results.Failed() {
+			members[node] = true
+			unreachable[node] = true
+			if node != firstMaster {
+				state.add(node, role)
+			}
+		}
+		for _, node := range state.pending(role) {
+			if !members[node] {
+				state.remove(node)
+				if err := stream.Send(&pb.StatusReply{Success: true,
+					Message: node + " is no longer part of the cluster, skipped"}); err != nil {
+					return nil, false, err
+				}
 			}
-			return nil
 		}
-		kubernetes_version = message
 	}
+	return unreachable, true, nil
+}
 
-	// XXX Check if kuberadm is new enough on all nodes
-	// salt '*' --module-executors='direct_call' --out=txt pkg.version kubernetes-kubeadm
+// runUpgrade upgrades the first master, the other masters and the
+// workers, as far as state says they are not upgraded yet
+func runUpgrade(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig,
+	stream pb.Kubeadm_UpgradeKubernetesServer, state *upgradeState) error {
+	in := state.request
+	kubernetes_version := in.KubernetesVersion
 
-	if err := upgradeFirstMaster(in, stream, kubernetes_version); err != nil {
+	unreachable, success, err := syncUpgradeNodes(ctx, executor, stream, state)
+	if success != true {
 		return err
 	}
-	var failedMaster string
-	if strings.EqualFold(multiMaster, "True") {
-		var err error
-		if failedMaster, err = upgradeNodes(in, stream, "master", kubernetes_version); err != nil {
-			return err
-		}
+
+	if success, err := upgradeFirstMaster(ctx, executor, config, in, stream, state); success != true {
+		return err
 	}
-	var failedWorker string
-	{
-		var err error
-		if failedWorker, err = upgradeNodes(in, stream, "worker", kubernetes_version); err != nil {
-			return err
-		}
+	failedMaster, err := upgradeNodes(ctx, executor, in, stream, state, unreachable, roleMaster, "1")
+	if err != nil {
+		return err
+	}
+	failedWorker, err := upgradeNodes(ctx, executor, in, stream, state, unreachable, roleWorker, in.MaxUnavailable)
+	if err != nil {
+		return err
 	}
 
 	// Update pod network, kured and other pods we are running:
-	success, message := deployment.UpdateAll(false)
+	success, message := deployment.UpdateAll(ctx, executor, false)
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
@@ -231,3 +560,84 @@ func UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernete
 	}
 	return nil
 }
+
+func UpgradeKubernetes(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig, in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer) error {
+	stream = &upgradeStream{Kubeadm_UpgradeKubernetesServer: stream}
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	// validate max unavailable before changing anything
+	if _, err := parseMaxUnavailable(in.MaxUnavailable, 100); err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: err.Error()})
+	}
+
+	if !startUpgrade() {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Another upgrade is running"})
+	}
+	defer endUpgrade()
+
+	success, kubernetes_version := upgradeTarget(ctx, executor, in.KubernetesVersion)
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: kubernetes_version}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// don't start from scratch if nodes are still cordoned by the last
+	// upgrade or if it was an upgrade to the same version
+	last, err := loadUpgradeState()
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Cannot load " + upgradeStateFile + ": " + err.Error()})
+	}
+	if last != nil && !last.finished() {
+		if cordoned := last.cordonedNodes(); len(cordoned) > 0 || last.request.KubernetesVersion == kubernetes_version {
+			message := "Upgrade to " + last.request.KubernetesVersion + " is not finished"
+			if len(cordoned) > 0 {
+				message = message + ", nodes still cordoned: " + strings.Join(cordoned, ", ")
+			}
+			return stream.Send(&pb.StatusReply{Success: false,
+				Message: message + "\nContinue it with \"kubicctl upgrade resume\""})
+		}
+	}
+
+	// Check if kubeadm, kubelet and kubectl are new enough on all nodes
+	if success, err := upgradePreflight(ctx, executor, stream, kubernetes_version); success != true {
+		return err
+	}
+
+	persist := !tools.DryRun(executor, "write upgrade progress to "+upgradeStateFile)
+	return runUpgrade(ctx, executor, config, stream, newUpgradeState(in, kubernetes_version, persist))
+}
+
+// ResumeUpgrade continues the last upgrade, which was interrupted or
+// where nodes failed, after the last step every node did complete
+func ResumeUpgrade(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig, in *pb.ResumeUpgradeRequest, resumeStream pb.Kubeadm_ResumeUpgradeServer) error {
+	stream := &upgradeStream{Kubeadm_UpgradeKubernetesServer: resumeStream}
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
+
+	if !startUpgrade() {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Another upgrade is running"})
+	}
+	defer endUpgrade()
+
+	state, err := loadUpgradeState()
+	if err != nil {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "Cannot load " + upgradeStateFile + ": " + err.Error()})
+	}
+	if state == nil || state.finished() {
+		return stream.Send(&pb.StatusReply{Success: false, Message: "No unfinished upgrade found"})
+	}
+	state.persist = !tools.DryRun(executor, "write upgrade progress to "+upgradeStateFile)
+	if in.ForceDrain {
+		state.request.ForceDrain = true
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true,
+		Message: "Resume upgrade to " + state.request.KubernetesVersion + " started " + state.started + "..."}); err != nil {
+		return err
+	}
+	if success, err := upgradePreflight(ctx, executor, stream, state.request.KubernetesVersion); success != true {
+		return err
+	}
+	return runUpgrade(ctx, executor, config, stream, state)
+}
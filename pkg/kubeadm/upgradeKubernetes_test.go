@@ -0,0 +1,305 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// setupUpgrade creates a cluster with the first master and one worker,
+// running v1.20.4 with the packages for v1.21.2 installed
+func setupUpgrade(t *testing.T) (*tools.FakeExecutor, *fake.Clientset) {
+	setupStateDir(t, map[string]string{"master": "master1"})
+
+	executor := tools.NewFakeExecutor()
+	for _, node := range []string{"master1", "worker1"} {
+		executor.AddNode(node, node)
+		executor.Output[node+": rpm -q --qf '%{VERSION}\\n' --whatprovides "] = "'1.21.2\n'"
+	}
+	executor.Grains["worker1"] = map[string][]string{"kubicd": {"kubic-worker-node"}}
+	executor.Output["master1: sha256sum "] =
+		"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08  snapshot.db"
+	executor.Output["master1: etcdctl snapshot status "] = `{"hash":1,"revision":42,"totalKey":10,"totalSize":2048}`
+
+	clientset := setupCluster(t, "v1.20.4",
+		testNode("master1", "v1.20.4"), testNode("worker1", "v1.20.4"))
+	return executor, clientset
+}
+
+func TestUpgradeFirstMasterFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure string
+		err     string
+		reason  string
+		// message of the failed step
+		message    string
+		rolledBack bool
+		completed  string
+	}{
+		{
+			name:       "kubeadm",
+			failure:    "master1: kubeadm upgrade apply",
+			err:        "[upgrade/apply] FATAL: couldn't upgrade control plane",
+			reason:     "kubeadm, rolled back",
+			message:    "master1: [upgrade/apply] FATAL: couldn't upgrade control plane",
+			rolledBack: true,
+			completed:  upgradePending,
+		},
+		{
+			name:       "kubelet",
+			failure:    "master1: service.restart kubelet",
+			err:        "Job for kubelet.service failed",
+			reason:     "kubelet",
+			message:    "master1: Job for kubelet.service failed (giving up after 3 attempts) (the control plane is already upgraded and not rolled back, fix the kubelet and run \"kubicctl upgrade resume\"",
+			rolledBack: false,
+			completed:  upgradeKubeadmUpgraded,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executor, clientset := setupUpgrade(t)
+			executor.Failures[test.failure] = test.err
+
+			stream := &recordStream{}
+			err := UpgradeKubernetes(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+				&pb.UpgradeRequest{KubernetesVersion: "v1.21.2"}, stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if t.Failed() {
+					stream.dump(t)
+				}
+			}()
+
+			if last := stream.last(); last.Success || last.Message != "Upgrade of the first master master1 failed ("+test.reason+")" {
+				t.Errorf("last reply is %v: %q", last.Success, last.Message)
+			}
+			if stream.find(test.message) == nil {
+				t.Errorf("%q not reported", test.message)
+			}
+
+			// the workers must not be touched
+			for _, request := range []string{"worker1: kubeadm", "worker1: sed", "worker1: service.restart"} {
+				if contains(executor.History, request) {
+					t.Errorf("%q was run", request)
+				}
+			}
+
+			if rolledBack := contains(executor.History, "master1: cp -a "+upgradeBackupDir+"/manifests/. "+manifestDir+"/"); rolledBack != test.rolledBack {
+				t.Errorf("rolled back %v, expected %v", rolledBack, test.rolledBack)
+			}
+			if !contains(executor.History, "master1: etcdctl --endpoints https://localhost:2379") {
+				t.Errorf("no etcd snapshot taken")
+			}
+			snapshots, err := readSnapshots()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots) != 1 || !strings.HasPrefix(snapshots[0].Name, "before-upgrade-v1.21.2-") || snapshots[0].Revision != 42 {
+				t.Errorf("snapshots %v", snapshots)
+			}
+
+			node, err := clientset.CoreV1().Nodes().Get(context.Background(), "master1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.Spec.Unschedulable {
+				t.Errorf("master1 is still cordoned")
+			}
+
+			// the upgrade can be resumed from the last completed step
+			state, err := loadUpgradeState()
+			if err != nil || state == nil {
+				t.Fatalf("upgrade state %v: %v", state, err)
+			}
+			status := state.find("master1")
+			if status == nil || status.State != upgradeFailed || status.Reason != test.reason || status.Completed != test.completed {
+				t.Errorf("state of master1 is %v", status)
+			}
+			if status := state.find("worker1"); status == nil || status.State != upgradePending {
+				t.Errorf("state of worker1 is %v", status)
+			}
+		})
+	}
+}
+
+func TestParseMaxUnavailable(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		total    int
+		expected int
+		err      bool
+	}{
+		{value: "", total: 5, expected: 1},
+		{value: "1", total: 5, expected: 1},
+		{value: "2", total: 5, expected: 2},
+		{value: "10", total: 3, expected: 10},
+		{value: "50%", total: 5, expected: 2},
+		{value: "100%", total: 4, expected: 4},
+		// a percentage is rounded down, but at least one node
+		{value: "10%", total: 5, expected: 1},
+		{value: "0%", total: 5, expected: 1},
+		{value: "0", total: 5, err: true},
+		{value: "-1", total: 5, err: true},
+		{value: "two", total: 5, err: true},
+		{value: "x%", total: 5, err: true},
+	} {
+		count, err := parseMaxUnavailable(test.value, test.total)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q of %d: %d, expected an error", test.value, test.total, count)
+			} else if !strings.HasPrefix(err.Error(), "invalid max unavailable \""+test.value+"\"") {
+				t.Errorf("%q of %d: unexpected error %q", test.value, test.total, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q of %d: %v", test.value, test.total, err)
+		} else if count != test.expected {
+			t.Errorf("%q of %d: %d, expected %d", test.value, test.total, count, test.expected)
+		}
+	}
+}
+
+func TestOrderNodes(t *testing.T) {
+	for _, test := range []struct {
+		nodes    []string
+		order    []string
+		expected string
+	}{
+		{nodes: []string{"worker3", "worker1", "worker2"}, expected: "worker1,worker2,worker3"},
+		{nodes: []string{"worker3", "worker1", "worker2"}, order: []string{"worker3"}, expected: "worker3,worker1,worker2"},
+		{nodes: []string{"worker3", "worker1", "worker2"}, order: []string{"worker2", "worker3", "worker1"}, expected: "worker2,worker3,worker1"},
+		// unknown and duplicate nodes in order are ignored
+		{nodes: []string{"worker2", "worker1"}, order: []string{"master1", "worker2", "worker2"}, expected: "worker2,worker1"},
+		{order: []string{"worker1"}, expected: ""},
+	} {
+		if ordered := strings.Join(orderNodes(test.nodes, test.order), ","); ordered != test.expected {
+			t.Errorf("%v ordered by %v: %s, expected %s", test.nodes, test.order, ordered, test.expected)
+		}
+	}
+}
+
+func TestUpgradeOrder(t *testing.T) {
+	executor, clientset := setupUpgrade(t)
+	for _, node := range []string{"worker2", "worker3"} {
+		executor.AddNode(node, node)
+		executor.Output[node+": rpm -q --qf '%{VERSION}\\n' --whatprovides "] = "'1.21.2\n'"
+		executor.Grains[node] = map[string][]string{"kubicd": {"kubic-worker-node"}}
+		if _, err := clientset.CoreV1().Nodes().Create(context.Background(), testNode(node, "v1.20.4"), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := &recordStream{}
+	err := UpgradeKubernetes(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+		&pb.UpgradeRequest{KubernetesVersion: "v1.21.2", MaxUnavailable: "1", Order: []string{"worker3"}}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			stream.dump(t)
+		}
+	}()
+
+	// worker3 first, the others sorted by name
+	var upgraded []string
+	for _, request := range executor.History {
+		if strings.HasSuffix(request, ": kubeadm upgrade node") {
+			upgraded = append(upgraded, strings.TrimSuffix(request, ": kubeadm upgrade node"))
+		}
+	}
+	if strings.Join(upgraded, ",") != "worker3,worker1,worker2" {
+		t.Errorf("upgraded workers in order %v", upgraded)
+	}
+}
+
+func TestResumeUpgrade(t *testing.T) {
+	executor, clientset := setupUpgrade(t)
+	executor.Failures["master1: service.restart kubelet"] = "Job for kubelet.service failed"
+
+	stream := &recordStream{}
+	err := UpgradeKubernetes(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+		&pb.UpgradeRequest{KubernetesVersion: "v1.21.2"}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kubelet got fixed, the control plane must not be upgraded again
+	delete(executor.Failures, "master1: service.restart kubelet")
+	executor.History = nil
+	stream = &recordStream{}
+	if err := ResumeUpgrade(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+		&pb.ResumeUpgradeRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			stream.dump(t)
+		}
+	}()
+
+	if contains(executor.History, "master1: kubeadm upgrade apply") {
+		t.Errorf("control plane upgraded twice")
+	}
+	for _, request := range []string{
+		"master1: service.restart kubelet",
+		"worker1: kubeadm upgrade node",
+		"worker1: service.restart kubelet",
+	} {
+		if !contains(executor.History, request) {
+			t.Errorf("%q missing", request)
+		}
+	}
+
+	state, err := loadUpgradeState()
+	if err != nil || state == nil {
+		t.Fatalf("upgrade state %v: %v", state, err)
+	}
+	if !state.finished() {
+		for _, status := range state.nodes {
+			t.Errorf("state of %s is %v", status.Node, status)
+		}
+	}
+	for _, node := range []string{"master1", "worker1"} {
+		node, err := clientset.CoreV1().Nodes().Get(context.Background(), node, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Spec.Unschedulable {
+			t.Errorf("%s is still cordoned", node.Name)
+		}
+	}
+
+	// a finished upgrade cannot be resumed
+	stream = &recordStream{}
+	if err := ResumeUpgrade(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+		&pb.ResumeUpgradeRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if last := stream.last(); last.Success || last.Message != "No unfinished upgrade found" {
+		t.Errorf("last reply is %v: %q", last.Success, last.Message)
+	}
+}
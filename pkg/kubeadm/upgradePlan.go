@@ -0,0 +1,182 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/deployment"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// imageVersion splits an image reference into the name without registry
+// and the tag: "registry.opensuse.org/kubic/kube-apiserver:v1.18.6"
+// returns "kube-apiserver" and "v1.18.6".
+func imageVersion(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		tag = name[i+1:]
+		name = name[:i]
+	}
+	return name, tag
+}
+
+// targetImages returns the names and tags of the images kubeadm deploys
+// for kubernetes_version
+func targetImages(ctx context.Context, executor tools.NodeExecutor, firstMaster string, kubernetes_version string) ([]string, map[string]string, error) {
+	success, message := executor.Run(ctx, firstMaster, "kubeadm", "config", "images", "list",
+		"--kubernetes-version", kubernetes_version)
+	if success != true {
+		return nil, nil, errors.New(message)
+	}
+	var names []string
+	tags := map[string]string{}
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		name, tag := imageVersion(line)
+		// the pause container is not a component of the cluster
+		if name == "pause" {
+			continue
+		}
+		names = append(names, name)
+		tags[name] = tag
+	}
+	return names, tags, nil
+}
+
+// currentImages returns the tags of the images running in kube-system
+func currentImages(ctx context.Context, client *k8s.Client) (map[string][]string, error) {
+	pods, err := client.ListPods(ctx, "kube-system")
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string][]string{}
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			name, tag := imageVersion(container.Image)
+			found := false
+			for _, t := range tags[name] {
+				if t == tag {
+					found = true
+				}
+			}
+			if !found {
+				tags[name] = append(tags[name], tag)
+			}
+		}
+	}
+	for name := range tags {
+		sort.Strings(tags[name])
+	}
+	return tags, nil
+}
+
+// upgradeTarget returns the version to upgrade to, the version of the
+// kubeadm installed on the first master if none was requested. kubicd
+// does not need to run on the first master.
+func upgradeTarget(ctx context.Context, executor tools.NodeExecutor, requested string) (bool, string) {
+	if len(requested) > 0 {
+		return true, requested
+	}
+	return tools.GetKubeadmVersion(ctx, executor, Read_Cfg("control-plane.conf", "master"))
+}
+
+// PlanUpgrade reports what an upgrade to in.KubernetesVersion would
+// change and why it would be refused. Nothing gets changed.
+func PlanUpgrade(ctx context.Context, executor tools.NodeExecutor, in *pb.PlanUpgradeRequest) *pb.UpgradePlanReply {
+	success, kubernetes_version := upgradeTarget(ctx, executor, in.KubernetesVersion)
+	if success != true {
+		return &pb.UpgradePlanReply{Success: false, Message: kubernetes_version}
+	}
+	target, err := version.ParseGeneric(kubernetes_version)
+	if err != nil {
+		return &pb.UpgradePlanReply{Success: false,
+			Message: "Invalid kubernetes version \"" + kubernetes_version + "\": " + err.Error()}
+	}
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return &pb.UpgradePlanReply{Success: false, Message: err.Error()}
+	}
+	current, err := client.ServerVersion()
+	if err != nil {
+		return &pb.UpgradePlanReply{Success: false, Message: err.Error()}
+	}
+
+	reply := &pb.UpgradePlanReply{Success: true,
+		CurrentVersion: current, TargetVersion: kubernetes_version}
+
+	// kubeadm validates the upgrade itself, without changing anything
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	success, message := executor.Run(ctx, firstMaster, "kubeadm", "upgrade", "plan", kubernetes_version)
+	if success != true {
+		reply.Problems = append(reply.Problems, "kubeadm upgrade plan: "+strings.TrimSpace(message))
+	}
+
+	names, targetTags, err := targetImages(ctx, executor, firstMaster, kubernetes_version)
+	if err != nil {
+		reply.Problems = append(reply.Problems, "kubeadm config images list: "+strings.TrimSpace(err.Error()))
+	}
+	currentTags, err := currentImages(ctx, client)
+	if err != nil {
+		reply.Problems = append(reply.Problems, err.Error())
+	}
+	for _, name := range names {
+		reply.Components = append(reply.Components, &pb.ComponentPlan{Name: name,
+			Current: strings.Join(currentTags[name], ","), Target: targetTags[name]})
+	}
+
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		reply.Problems = append(reply.Problems, err.Error())
+	}
+	for _, node := range nodes {
+		reply.Nodes = append(reply.Nodes, &pb.NodePlan{Name: node.Name,
+			Role:           kubernetesRole(node),
+			CurrentKubelet: node.Status.NodeInfo.KubeletVersion,
+			TargetKubelet:  kubernetes_version})
+	}
+	sort.SliceStable(reply.Nodes, func(i, j int) bool {
+		if reply.Nodes[i].Role != reply.Nodes[j].Role {
+			return roleIndex(reply.Nodes[i].Role) < roleIndex(reply.Nodes[j].Role)
+		}
+		return reply.Nodes[i].Name < reply.Nodes[j].Name
+	})
+
+	addons, err := deployment.ChangedAddons(ctx, executor)
+	if err != nil {
+		reply.Problems = append(reply.Problems, err.Error())
+	}
+	for _, addon := range addons {
+		reply.Addons = append(reply.Addons, &pb.AddonPlan{Name: addon.Name, Kind: addon.Kind})
+	}
+
+	_, problems := preflightChecks(ctx, executor, target)
+	reply.Problems = append(reply.Problems, problems...)
+
+	return reply
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Packages, which need to be installed in the right version on every
+// node before kubeadm can upgrade it.
+const (
+	kubeadmPackage = "kubernetes-kubeadm"
+	// the kubelet is packaged per minor version, KUBELET_VER in
+	// /etc/sysconfig/kubelet selects the one which gets started
+	kubeletPackage = "kubernetes-kubelet"
+	kubectlPackage = "kubernetes-client"
+)
+
+// Version skew supported by kubernetes, see
+// https://kubernetes.io/releases/version-skew-policy/
+const (
+	// a kubelet may be up to two minor versions older than the API server
+	maxKubeletSkew = 2
+	// kubectl may be one minor version older or newer than the API server
+	maxKubectlSkew = 1
+)
+
+type preflightResult struct {
+	node     string
+	versions []string
+	problems []string
+}
+
+func minorSkew(a *version.Version, b *version.Version) int {
+	if a.Major() != b.Major() {
+		// never happened so far, treat it as unsupported
+		return 1000
+	}
+	return int(a.Minor()) - int(b.Minor())
+}
+
+// packageVersion returns the newest installed version of the package
+// providing pkg on node
+func packageVersion(ctx context.Context, executor tools.NodeExecutor, node string, pkg string) (*version.Version, error) {
+	success, message := executor.Run(ctx, node, "rpm", "-q", "--qf", "'%{VERSION}\\n'", "--whatprovides", pkg)
+	if success != true {
+		return nil, errors.New(pkg + " is not installed: " + strings.TrimSpace(message))
+	}
+	var newest *version.Version
+	for _, field := range strings.Fields(strings.Replace(message, "'", "", -1)) {
+		v, err := version.ParseGeneric(field)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse version %q of %s: %v", field, pkg, err)
+		}
+		if newest == nil || newest.LessThan(v) {
+			newest = v
+		}
+	}
+	if newest == nil {
+		return nil, errors.New(pkg + " is not installed")
+	}
+	return newest, nil
+}
+
+// checkNodePackages verifies that kubeadm, kubelet and kubectl on node
+// are able to run target
+func checkNodePackages(ctx context.Context, executor tools.NodeExecutor, node string, target *version.Version) preflightResult {
+	result := preflightResult{node: masterName(node)}
+
+	// kubeadm can only upgrade to versions of its own minor
+	// release, which are not newer than itself
+	kubeadm, err := packageVersion(ctx, executor, node, kubeadmPackage)
+	if err != nil {
+		result.problems = append(result.problems, err.Error())
+	} else {
+		result.versions = append(result.versions, "kubeadm "+kubeadm.String())
+		if minorSkew(kubeadm, target) != 0 || kubeadm.LessThan(target) {
+			result.problems = append(result.problems,
+				fmt.Sprintf("kubeadm %s cannot upgrade to %s", kubeadm, target))
+		}
+	}
+
+	// the kubelet of the target minor version gets started after
+	// the upgrade, it must not be newer than the API server
+	kubelet, err := packageVersion(ctx, executor, node,
+		fmt.Sprintf("%s%d.%d", kubeletPackage, target.Major(), target.Minor()))
+	if err != nil {
+		result.problems = append(result.problems, err.Error())
+	} else {
+		result.versions = append(result.versions, "kubelet "+kubelet.String())
+		if target.LessThan(kubelet) {
+			result.problems = append(result.problems,
+				fmt.Sprintf("kubelet %s is newer than %s", kubelet, target))
+		}
+	}
+
+	kubectl, err := packageVersion(ctx, executor, node, kubectlPackage)
+	if err != nil {
+		result.problems = append(result.problems, err.Error())
+	} else {
+		result.versions = append(result.versions, "kubectl "+kubectl.String())
+		skew := minorSkew(kubectl, target)
+		if skew > maxKubectlSkew || skew < -maxKubectlSkew {
+			result.problems = append(result.problems,
+				fmt.Sprintf("kubectl %s is not supported with %s", kubectl, target))
+		}
+	}
+	return result
+}
+
+// checkClusterSkew verifies, that the cluster can be upgraded from the
+// running version to target without violating the version skew policy
+func checkClusterSkew(ctx context.Context, target *version.Version) []string {
+	client, err := k8s.NewAdminClient()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	gitVersion, err := client.ServerVersion()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	current, err := version.ParseGeneric(gitVersion)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot parse API server version %q: %v", gitVersion, err)}
+	}
+
+	var problems []string
+	if target.LessThan(current) {
+		problems = append(problems,
+			fmt.Sprintf("downgrade from %s to %s is not supported", current, target))
+	} else if minorSkew(target, current) > 1 {
+		problems = append(problems,
+			fmt.Sprintf("cannot skip minor versions, upgrade from %s to %s first", current, target.WithMinor(current.Minor()+1).WithPatch(0)))
+	}
+
+	// kubelets keep running the old version until their node gets
+	// upgraded, they have to support the new control plane
+	nodes, err := client.ListNodes(ctx)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	for _, node := range nodes {
+		kubeletVersion := node.Status.NodeInfo.KubeletVersion
+		kubelet, err := version.ParseGeneric(kubeletVersion)
+		if err != nil {
+			problems = append(problems,
+				fmt.Sprintf("%s: cannot parse kubelet version %q: %v", node.Name, kubeletVersion, err))
+			continue
+		}
+		if minorSkew(target, kubelet) > maxKubeletSkew {
+			problems = append(problems,
+				fmt.Sprintf("%s: running kubelet %s is too old for %s", node.Name, kubelet, target))
+		}
+	}
+	return problems
+}
+
+// preflightChecks runs all checks of the upgrade preflight for target.
+// It returns the results of the nodes and the problems found.
+func preflightChecks(ctx context.Context, executor tools.NodeExecutor, target *version.Version) ([]preflightResult, []string) {
+	var problems []string
+	for _, problem := range checkClusterSkew(ctx, target) {
+		problems = append(problems, "cluster: "+problem)
+	}
+
+	// the first master is not necessarily a salt minion with a
+	// kubicd grain, e.g. if kubicd runs on it
+	nodelist := []string{Read_Cfg("control-plane.conf", "master")}
+	seen := map[string]bool{nodelist[0]: true}
+	roles := []string{"worker"}
+	if strings.EqualFold(Read_Cfg("control-plane.conf", "MultiMaster"), "True") {
+		roles = []string{"master", "worker"}
+	}
+	for _, role := range roles {
+		results, err := tools.GetListOfNodes(ctx, executor, role)
+		if err != nil {
+			problems = append(problems, role+": "+err.Error())
+			continue
+		}
+		for _, node := range results.Failed() {
+			problems = append(problems, node+": unreachable")
+		}
+		succeeded := results.Succeeded()
+		sort.Strings(succeeded)
+		for _, node := range succeeded {
+			if !seen[node] {
+				seen[node] = true
+				nodelist = append(nodelist, node)
+			}
+		}
+	}
+
+	results := make([]preflightResult, len(nodelist))
+	var wg sync.WaitGroup
+	wg.Add(len(nodelist))
+	for i := range nodelist {
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checkNodePackages(ctx, executor, nodelist[i], target)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if len(result.problems) > 0 {
+			problems = append(problems, result.node+": "+strings.Join(result.problems, ", "))
+		}
+	}
+	return results, problems
+}
+
+// upgradePreflight checks on all masters and workers if the installed
+// packages fit to kubernetes_version and if the upgrade is allowed by
+// the version skew policy. Nothing gets changed, if a check fails the
+// report of all failed nodes gets sent and false is returned.
+func upgradePreflight(ctx context.Context, executor tools.NodeExecutor, stream pb.Kubeadm_UpgradeKubernetesServer, kubernetes_version string) (bool, error) {
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Check installed packages and version skew..."}); err != nil {
+		return false, err
+	}
+
+	target, err := version.ParseGeneric(kubernetes_version)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: "Invalid kubernetes version \"" + kubernetes_version + "\": " + err.Error()}); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	results, problems := preflightChecks(ctx, executor, target)
+	for _, result := range results {
+		if len(result.problems) > 0 {
+			continue
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true,
+			Message: result.node + ": " + strings.Join(result.versions, ", ")}); err != nil {
+			return false, err
+		}
+	}
+
+	if len(problems) > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: "Preflight check for " + kubernetes_version + " failed, no node was changed:\n  " +
+				strings.Join(problems, "\n  ")}); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
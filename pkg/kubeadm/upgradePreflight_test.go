@@ -0,0 +1,233 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// checkProblems compares the problems found with the expected ones,
+// an expected problem only needs to be a prefix
+func checkProblems(t *testing.T, problems []string, expected []string) {
+	t.Helper()
+	if len(problems) != len(expected) {
+		t.Errorf("problems %q, expected %q", problems, expected)
+		return
+	}
+	for i := range expected {
+		if !strings.HasPrefix(problems[i], expected[i]) {
+			t.Errorf("problem %q, expected %q", problems[i], expected[i])
+		}
+	}
+}
+
+func TestCheckClusterSkew(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		kubelets []string
+		target   string
+		problems []string
+	}{
+		{
+			name:     "same version",
+			server:   "v1.21.2",
+			kubelets: []string{"v1.21.2"},
+			target:   "v1.21.2",
+		},
+		{
+			name:     "patch release",
+			server:   "v1.21.2",
+			kubelets: []string{"v1.21.2"},
+			target:   "v1.21.5",
+		},
+		{
+			name:     "next minor release",
+			server:   "v1.20.4",
+			kubelets: []string{"v1.20.4", "v1.20.4"},
+			target:   "v1.21.2",
+		},
+		{
+			name:     "skip minor release",
+			server:   "v1.19.4",
+			kubelets: []string{"v1.19.4"},
+			target:   "v1.21.2",
+			problems: []string{"cannot skip minor versions, upgrade from 1.19.4 to 1.20.0 first"},
+		},
+		{
+			name:     "downgrade",
+			server:   "v1.21.2",
+			kubelets: []string{"v1.21.2"},
+			target:   "v1.20.4",
+			problems: []string{"downgrade from 1.21.2 to 1.20.4 is not supported"},
+		},
+		{
+			name:     "patch downgrade",
+			server:   "v1.21.5",
+			kubelets: []string{"v1.21.5"},
+			target:   "v1.21.2",
+			problems: []string{"downgrade from 1.21.5 to 1.21.2 is not supported"},
+		},
+		{
+			name:     "kubelet two minor releases older",
+			server:   "v1.21.2",
+			kubelets: []string{"v1.21.2", "v1.20.4"},
+			target:   "v1.22.1",
+		},
+		{
+			name:     "kubelet three minor releases older",
+			server:   "v1.21.2",
+			kubelets: []string{"v1.21.2", "v1.19.4"},
+			target:   "v1.22.1",
+			problems: []string{"node2: running kubelet 1.19.4 is too old for 1.22.1"},
+		},
+		{
+			name:     "unknown kubelet version",
+			server:   "v1.21.2",
+			kubelets: []string{"unknown"},
+			target:   "v1.21.2",
+			problems: []string{"node1: cannot parse kubelet version \"unknown\""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var nodes []runtime.Object
+			for i, kubelet := range test.kubelets {
+				nodes = append(nodes, testNode("node"+strconv.Itoa(i+1), kubelet))
+			}
+			setupCluster(t, test.server, nodes...)
+
+			checkProblems(t, checkClusterSkew(testContext(), version.MustParseGeneric(test.target)), test.problems)
+		})
+	}
+}
+
+func TestCheckNodePackages(t *testing.T) {
+	tests := []struct {
+		name     string
+		kubeadm  string
+		kubelet  string
+		kubectl  string
+		problems []string
+	}{
+		{
+			name:    "same version",
+			kubeadm: "1.21.2",
+			kubelet: "1.21.2",
+			kubectl: "1.21.2",
+		},
+		{
+			name:    "older kubelet and newer kubeadm",
+			kubeadm: "1.21.5",
+			kubelet: "1.21.0",
+			kubectl: "1.21.2",
+		},
+		{
+			name:    "newest installed version",
+			kubeadm: "1.20.4\n1.21.2",
+			kubelet: "1.21.2",
+			kubectl: "1.21.2",
+		},
+		{
+			name:     "older kubeadm",
+			kubeadm:  "1.21.1",
+			kubelet:  "1.21.2",
+			kubectl:  "1.21.2",
+			problems: []string{"kubeadm 1.21.1 cannot upgrade to 1.21.2"},
+		},
+		{
+			name:     "kubeadm of the previous minor release",
+			kubeadm:  "1.20.4",
+			kubelet:  "1.21.2",
+			kubectl:  "1.21.2",
+			problems: []string{"kubeadm 1.20.4 cannot upgrade to 1.21.2"},
+		},
+		{
+			name:     "kubeadm of the next minor release",
+			kubeadm:  "1.22.0",
+			kubelet:  "1.21.2",
+			kubectl:  "1.21.2",
+			problems: []string{"kubeadm 1.22.0 cannot upgrade to 1.21.2"},
+		},
+		{
+			name:     "newer kubelet",
+			kubeadm:  "1.21.2",
+			kubelet:  "1.21.3",
+			kubectl:  "1.21.2",
+			problems: []string{"kubelet 1.21.3 is newer than 1.21.2"},
+		},
+		{
+			name:    "kubectl one minor release older",
+			kubeadm: "1.21.2",
+			kubelet: "1.21.2",
+			kubectl: "1.20.4",
+		},
+		{
+			name:    "kubectl one minor release newer",
+			kubeadm: "1.21.2",
+			kubelet: "1.21.2",
+			kubectl: "1.22.0",
+		},
+		{
+			name:     "kubectl two minor releases older",
+			kubeadm:  "1.21.2",
+			kubelet:  "1.21.2",
+			kubectl:  "1.19.4",
+			problems: []string{"kubectl 1.19.4 is not supported with 1.21.2"},
+		},
+		{
+			name:     "kubectl two minor releases newer",
+			kubeadm:  "1.21.2",
+			kubelet:  "1.21.2",
+			kubectl:  "1.23.0",
+			problems: []string{"kubectl 1.23.0 is not supported with 1.21.2"},
+		},
+		{
+			name:    "kubelet not installed",
+			kubeadm: "1.21.2",
+			kubectl: "1.21.2",
+			problems: []string{
+				"kubernetes-kubelet1.21 is not installed: no package provides kubernetes-kubelet1.21",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executor := tools.NewFakeExecutor()
+			executor.AddNode("worker1", "worker1")
+			for pkg, installed := range map[string]string{
+				kubeadmPackage:          test.kubeadm,
+				kubeletPackage + "1.21": test.kubelet,
+				kubectlPackage:          test.kubectl,
+			} {
+				request := "worker1: rpm -q --qf '%{VERSION}\\n' --whatprovides " + pkg
+				if len(installed) == 0 {
+					executor.Failures[request] = "no package provides " + pkg
+				} else {
+					executor.Output[request] = "'" + installed + "\n'"
+				}
+			}
+
+			result := checkNodePackages(testContext(), executor, "worker1", version.MustParseGeneric("v1.21.2"))
+			checkProblems(t, result.problems, test.problems)
+		})
+	}
+}
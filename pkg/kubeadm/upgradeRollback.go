@@ -0,0 +1,117 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+const (
+	// backup of the control plane configuration on the first master
+	upgradeBackupDir = "/etc/kubernetes/upgrade-backup"
+	// the rollback has to finish, even if the request was cancelled
+	rollbackTimeout = 30 * time.Minute
+)
+
+// controlPlaneBackup is taken on the first master before "kubeadm
+// upgrade apply" changes the control plane
+type controlPlaneBackup struct {
+	node     string
+	snapshot *pb.SnapshotInfo
+}
+
+// backupControlPlane saves the static pod manifests and
+// /etc/sysconfig/kubelet of the first master below upgradeBackupDir and
+// takes an etcd snapshot.
+func backupControlPlane(ctx context.Context, executor tools.NodeExecutor, config SnapshotConfig,
+	node string, kubernetes_version string, stream pb.Kubeadm_UpgradeKubernetesServer) (*controlPlaneBackup, error) {
+	if err := stream.Send(&pb.StatusReply{Success: true,
+		Message: "Back up static pod manifests and kubelet configuration on " + masterName(node) + "..."}); err != nil {
+		return nil, err
+	}
+	// salt joins the arguments of a command, so run every step on
+	// its own instead of one "sh -c" script
+	for _, command := range [][]string{
+		{"rm", "-rf", upgradeBackupDir},
+		{"mkdir", "-p", "-m", "0700", upgradeBackupDir},
+		{"cp", "-a", manifestDir, upgradeBackupDir + "/manifests"},
+		{"cp", "-a", "/etc/sysconfig/kubelet", upgradeBackupDir + "/kubelet"},
+	} {
+		success, message := executor.Run(ctx, node, command[0], command[1:]...)
+		if success != true {
+			return nil, errors.New("Backup of the control plane failed: " + message)
+		}
+	}
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	name := "before-upgrade-" + kubernetes_version + "-" + time.Now().UTC().Format("20060102-150405")
+	snapshot, err := takeSnapshot(ctx, executor, config, name, stream)
+	if err != nil {
+		return nil, errors.New("etcd snapshot failed: " + err.Error())
+	}
+	return &controlPlaneBackup{node: node, snapshot: snapshot}, nil
+}
+
+// rollbackControlPlane restores the manifests and the kubelet
+// configuration of the backup, restarts the kubelet and waits until etcd,
+// the API server and the node are healthy again. If etcd does not get
+// healthy, the error names the etcd snapshot of the backup. Restoring it
+// replaces the data of all members, so this is left to the admin.
+func rollbackControlPlane(executor tools.NodeExecutor, backup *controlPlaneBackup, hostname string,
+	stream pb.Kubeadm_UpgradeKubernetesServer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	node := backup.node
+	if err := stream.Send(&pb.StatusReply{Success: true,
+		Message: "Roll back the control plane on " + masterName(node) + "..."}); err != nil {
+		return err
+	}
+	success, message := executor.Run(ctx, node, "cp", "-a", upgradeBackupDir+"/manifests/.", manifestDir+"/")
+	if success != true {
+		return errors.New(message)
+	}
+	success, message = executor.Run(ctx, node, "cp", "-a", upgradeBackupDir+"/kubelet", "/etc/sysconfig/kubelet")
+	if success != true {
+		return errors.New(message)
+	}
+	success, message = tools.RetryStep(ctx, tools.StepService,
+		tools.StreamAttempts(stream, node, "service"),
+		func(ctx context.Context) (bool, string) {
+			return executor.Call(ctx, node, "service.restart", "kubelet")
+		})
+	if success != true {
+		return errors.New(message)
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Wait for etcd on " + masterName(node) + "..."}); err != nil {
+		return err
+	}
+	if err := waitForEtcd(ctx, executor, "etcd on "+masterName(node), etcdHealthy(executor, node)); err != nil {
+		return errors.New(err.Error() + ", the etcd snapshot " + backup.snapshot.Name +
+			" was taken before the upgrade and can be restored with \"kubicctl etcd restore " + backup.snapshot.Name + "\"")
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Wait for the API server and " + hostname + "..."}); err != nil {
+		return err
+	}
+	return waitForUpgradedNodes(ctx, executor, []string{hostname})
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// saltCommands is a stand-in for salt-api, which records the command
+// lines of all cmd.run_all jobs. Every command succeeds, output maps a
+// command prefix to its stdout.
+type saltCommands struct {
+	mu       sync.Mutex
+	output   map[string]string
+	commands []string
+	// command of every job id
+	jobs map[string]string
+}
+
+func (s *saltCommands) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reply interface{}
+	switch {
+	case r.URL.Path == "/login":
+		reply = map[string]interface{}{"return": []map[string]interface{}{{"token": "token"}}}
+	case r.Method == "POST" && r.URL.Path == "/minions":
+		var lowstate []struct {
+			Tgt string   `json:"tgt"`
+			Fun string   `json:"fun"`
+			Arg []string `json:"arg"`
+		}
+		json.NewDecoder(r.Body).Decode(&lowstate)
+		if len(lowstate) != 1 || lowstate[0].Fun != "cmd.run_all" || len(lowstate[0].Arg) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		command := lowstate[0].Arg[0]
+		s.commands = append(s.commands, command)
+		jid := fmt.Sprintf("2021%d", len(s.commands))
+		s.jobs[jid] = command
+		reply = map[string]interface{}{
+			"return": []map[string]interface{}{{"jid": jid, "minions": []string{lowstate[0].Tgt}}},
+		}
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/jobs/"):
+		command := s.jobs[strings.TrimPrefix(r.URL.Path, "/jobs/")]
+		stdout := ""
+		for prefix, output := range s.output {
+			if strings.HasPrefix(command, prefix) {
+				stdout = output
+			}
+		}
+		reply = map[string]interface{}{
+			"info": []map[string]interface{}{{
+				"Result": map[string]interface{}{"master1": map[string]interface{}{
+					"return":  map[string]interface{}{"retcode": 0, "stdout": stdout, "stderr": ""},
+					"retcode": 0,
+					"success": true,
+				}},
+			}},
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func TestBackupControlPlaneWithSalt(t *testing.T) {
+	setupStateDir(t, map[string]string{"master": "master1"})
+	api := &saltCommands{
+		output: map[string]string{
+			"sha256sum ":              "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08  snapshot.db",
+			"etcdctl snapshot status": `{"hash":1,"revision":42,"totalKey":10,"totalSize":2048}`,
+		},
+		jobs: map[string]string{},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	executor := tools.NewSaltAPIExecutor(server.URL+"/", "kubic", "secret", "")
+	executor.PollInterval = time.Millisecond
+
+	stream := &recordStream{}
+	backup, err := backupControlPlane(testContext(), executor, SnapshotConfig{Dir: "/var/lib/kubic-control/etcd-snapshots", Keep: 7},
+		"master1", "v1.21.2", stream)
+	if err != nil {
+		stream.dump(t)
+		t.Fatal(err)
+	}
+	if backup.node != "master1" || backup.snapshot.Revision != 42 {
+		t.Errorf("backup of %s with snapshot %v", backup.node, backup.snapshot)
+	}
+
+	// every step is a command line of its own, the salt executors
+	// join the arguments with spaces
+	expected := []string{
+		"rm -rf " + upgradeBackupDir,
+		"mkdir -p -m 0700 " + upgradeBackupDir,
+		"cp -a " + manifestDir + " " + upgradeBackupDir + "/manifests",
+		"cp -a /etc/sysconfig/kubelet " + upgradeBackupDir + "/kubelet",
+	}
+	if len(api.commands) < len(expected) {
+		t.Fatalf("commands %q", api.commands)
+	}
+	for i, command := range expected {
+		if api.commands[i] != command {
+			t.Errorf("command %d is %q, expected %q", i, api.commands[i], command)
+		}
+	}
+	if !strings.HasPrefix(api.commands[len(expected)], "mkdir -p -m 0700 /var/lib/kubic-control/etcd-snapshots") {
+		t.Errorf("snapshot not taken after the backup: %q", api.commands[len(expected):])
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"gopkg.in/ini.v1"
+)
+
+var upgradeStateFile = stateDir + "/upgrade.conf"
+
+// States of a node during the upgrade, in the order they are reached.
+// A node which failed keeps the last step it completed, so that the
+// upgrade can be resumed from there.
+const (
+	upgradePending         = "pending"
+	upgradeDrained         = "drained"
+	upgradeKubeadmUpgraded = "kubeadm-upgraded"
+	upgradeKubeletUpdated  = "kubelet-updated"
+	upgradeUncordoned      = "uncordoned"
+	upgradeFailed          = "failed"
+)
+
+var upgradeSteps = []string{upgradePending, upgradeDrained,
+	upgradeKubeadmUpgraded, upgradeKubeletUpdated, upgradeUncordoned}
+
+// Roles of the nodes in the upgrade state
+const (
+	roleFirstMaster = "first-master"
+	roleMaster      = "master"
+	roleWorker      = "worker"
+)
+
+var (
+	upgradeMutex   sync.Mutex
+	upgradeRunning bool
+)
+
+// startUpgrade returns false if another upgrade is running
+func startUpgrade() bool {
+	upgradeMutex.Lock()
+	defer upgradeMutex.Unlock()
+	if upgradeRunning {
+		return false
+	}
+	upgradeRunning = true
+	return true
+}
+
+func endUpgrade() {
+	upgradeMutex.Lock()
+	defer upgradeMutex.Unlock()
+	upgradeRunning = false
+}
+
+func stepIndex(step string) int {
+	for i := range upgradeSteps {
+		if upgradeSteps[i] == step {
+			return i
+		}
+	}
+	return 0
+}
+
+// upgradeState is the progress of an upgrade, every change gets written
+// to upgradeStateFile
+type upgradeState struct {
+	mu      sync.Mutex
+	persist bool
+	request *pb.UpgradeRequest
+	started string
+	nodes   []*pb.UpgradeNodeStatus
+}
+
+func newUpgradeState(in *pb.UpgradeRequest, kubernetes_version string, persist bool) *upgradeState {
+	return &upgradeState{
+		persist: persist,
+		request: &pb.UpgradeRequest{
+			KubernetesVersion: kubernetes_version,
+			ForceDrain:        in.ForceDrain,
+			MaxUnavailable:    in.MaxUnavailable,
+			Order:             in.Order,
+			MaxFailures:       in.MaxFailures,
+		},
+		started: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// loadUpgradeState reads the state of the last upgrade, nil if there
+// was none
+func loadUpgradeState() (*upgradeState, error) {
+	cfg, err := ini.LooseLoad(upgradeStateFile)
+	if err != nil {
+		return nil, err
+	}
+	global := cfg.Section(ini.DefaultSection)
+	if len(global.Key("kubernetes_version").String()) == 0 {
+		return nil, nil
+	}
+
+	state := &upgradeState{
+		persist: true,
+		request: &pb.UpgradeRequest{
+			KubernetesVersion: global.Key("kubernetes_version").String(),
+			ForceDrain:        global.Key("force_drain").MustBool(false),
+			MaxUnavailable:    global.Key("max_unavailable").String(),
+			MaxFailures:       uint32(global.Key("max_failures").MustUint(0)),
+		},
+		started: global.Key("started").String(),
+	}
+	if order := global.Key("order").String(); len(order) > 0 {
+		state.request.Order = strings.Split(order, ",")
+	}
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+		state.nodes = append(state.nodes, &pb.UpgradeNodeStatus{
+			Node:      section.Key("node").String(),
+			Role:      section.Key("role").String(),
+			Hostname:  section.Key("hostname").String(),
+			State:     section.Key("state").String(),
+			Completed: section.Key("completed").String(),
+			Reason:    section.Key("reason").String(),
+			Updated:   section.Key("updated").String(),
+		})
+	}
+	return state, nil
+}
+
+// save writes the state, the caller has to hold s.mu
+func (s *upgradeState) save() {
+	if !s.persist {
+		return
+	}
+	cfg := ini.Empty()
+	global := cfg.Section(ini.DefaultSection)
+	global.Key("kubernetes_version").SetValue(s.request.KubernetesVersion)
+	global.Key("started").SetValue(s.started)
+	global.Key("force_drain").SetValue(strconv.FormatBool(s.request.ForceDrain))
+	global.Key("max_unavailable").SetValue(s.request.MaxUnavailable)
+	global.Key("order").SetValue(strings.Join(s.request.Order, ","))
+	global.Key("max_failures").SetValue(strconv.FormatUint(uint64(s.request.MaxFailures), 10))
+	for _, node := range s.nodes {
+		section := cfg.Section(masterName(node.Node))
+		section.Key("node").SetValue(node.Node)
+		section.Key("role").SetValue(node.Role)
+		section.Key("hostname").SetValue(node.Hostname)
+		section.Key("state").SetValue(node.State)
+		section.Key("completed").SetValue(node.Completed)
+		section.Key("reason").SetValue(node.Reason)
+		section.Key("updated").SetValue(node.Updated)
+	}
+	// the upgrade continues, it can only not be resumed
+	if err := cfg.SaveTo(upgradeStateFile); err != nil {
+		log.Errorf("Saving upgrade state failed: %v", err)
+	}
+}
+
+func (s *upgradeState) find(node string) *pb.UpgradeNodeStatus {
+	for _, status := range s.nodes {
+		if status.Node == node {
+			return status
+		}
+	}
+	return nil
+}
+
+// add adds node as pending, if it is not part of the upgrade yet
+func (s *upgradeState) add(node string, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(node) != nil {
+		return
+	}
+	s.nodes = append(s.nodes, &pb.UpgradeNodeStatus{Node: node, Role: role,
+		State: upgradePending, Completed: upgradePending,
+		Updated: time.Now().UTC().Format(time.RFC3339)})
+	s.save()
+}
+
+// remove drops a node, which is no longer part of the cluster
+func (s *upgradeState) remove(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, status := range s.nodes {
+		if status.Node == node {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			break
+		}
+	}
+	s.save()
+}
+
+func (s *upgradeState) setHostname(node string, hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.find(node); status != nil && status.Hostname != hostname {
+		status.Hostname = hostname
+		s.save()
+	}
+}
+
+// set records that node reached step
+func (s *upgradeState) set(node string, step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.find(node)
+	if status == nil {
+		return
+	}
+	status.State = step
+	status.Reason = ""
+	if stepIndex(step) > stepIndex(status.Completed) {
+		status.Completed = step
+	}
+	status.Updated = time.Now().UTC().Format(time.RFC3339)
+	s.save()
+}
+
+// fail records that the upgrade of node failed, the completed steps
+// are kept
+func (s *upgradeState) fail(node string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.find(node)
+	if status == nil {
+		return
+	}
+	status.State = upgradeFailed
+	status.Reason = reason
+	status.Updated = time.Now().UTC().Format(time.RFC3339)
+	s.save()
+}
+
+// rolledBack records that the upgrade of node failed and was rolled
+// back, it has to start from the beginning again
+func (s *upgradeState) rolledBack(node string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.find(node)
+	if status == nil {
+		return
+	}
+	status.State = upgradeFailed
+	status.Completed = upgradePending
+	status.Reason = reason
+	status.Updated = time.Now().UTC().Format(time.RFC3339)
+	s.save()
+}
+
+// completed returns true if node already did finish step
+func (s *upgradeState) completed(node string, step string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.find(node)
+	return status != nil && stepIndex(status.Completed) >= stepIndex(step)
+}
+
+// cordoned returns true if node was drained and not uncordoned again
+func (s *upgradeState) cordoned(node string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.find(node)
+	if status == nil {
+		return false
+	}
+	switch status.State {
+	case upgradeDrained, upgradeKubeadmUpgraded, upgradeKubeletUpdated:
+		return true
+	}
+	return false
+}
+
+// cordonedNodes returns the nodes, which were drained and not
+// uncordoned again
+func (s *upgradeState) cordonedNodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var nodes []string
+	for _, status := range s.nodes {
+		switch status.State {
+		case upgradeDrained, upgradeKubeadmUpgraded, upgradeKubeletUpdated:
+			nodes = append(nodes, masterName(status.Node))
+		}
+	}
+	return nodes
+}
+
+// pending returns the nodes of role, which are not upgraded yet
+func (s *upgradeState) pending(role string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var nodes []string
+	for _, status := range s.nodes {
+		if status.Role == role && status.State != upgradeUncordoned {
+			nodes = append(nodes, status.Node)
+		}
+	}
+	return nodes
+}
+
+// finished returns true if all nodes are upgraded
+func (s *upgradeState) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, status := range s.nodes {
+		if status.State != upgradeUncordoned {
+			return false
+		}
+	}
+	return true
+}
+
+// UpgradeStatus reports the progress of the running or last upgrade
+func UpgradeStatus() *pb.UpgradeStatusReply {
+	state, err := loadUpgradeState()
+	if err != nil {
+		return &pb.UpgradeStatusReply{Success: false, Message: "Cannot load " + upgradeStateFile + ": " + err.Error()}
+	}
+	if state == nil {
+		return &pb.UpgradeStatusReply{Success: true, Message: "No upgrade found"}
+	}
+
+	upgradeMutex.Lock()
+	running := upgradeRunning
+	upgradeMutex.Unlock()
+
+	return &pb.UpgradeStatusReply{
+		Success:           true,
+		KubernetesVersion: state.request.KubernetesVersion,
+		Started:           state.started,
+		Running:           running,
+		Finished:          state.finished(),
+		Nodes:             state.nodes,
+	}
+}
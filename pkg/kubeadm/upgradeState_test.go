@@ -0,0 +1,213 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+func TestUpgradeStateTransitions(t *testing.T) {
+	setupStateDir(t, map[string]string{"master": "master1"})
+
+	tests := []struct {
+		name      string
+		change    func(s *upgradeState)
+		state     string
+		completed string
+		reason    string
+		cordoned  bool
+	}{
+		{
+			name:      "added",
+			change:    func(s *upgradeState) {},
+			state:     upgradePending,
+			completed: upgradePending,
+		},
+		{
+			name:      "drained",
+			change:    func(s *upgradeState) { s.set("worker1", upgradeDrained) },
+			state:     upgradeDrained,
+			completed: upgradeDrained,
+			cordoned:  true,
+		},
+		{
+			name: "kubelet updated",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeDrained)
+				s.set("worker1", upgradeKubeadmUpgraded)
+				s.set("worker1", upgradeKubeletUpdated)
+			},
+			state:     upgradeKubeletUpdated,
+			completed: upgradeKubeletUpdated,
+			cordoned:  true,
+		},
+		{
+			// a resumed node gets drained again, the steps it did
+			// complete are kept
+			name: "drained again",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeKubeadmUpgraded)
+				s.set("worker1", upgradeDrained)
+			},
+			state:     upgradeDrained,
+			completed: upgradeKubeadmUpgraded,
+			cordoned:  true,
+		},
+		{
+			name: "uncordoned",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeKubeletUpdated)
+				s.set("worker1", upgradeUncordoned)
+			},
+			state:     upgradeUncordoned,
+			completed: upgradeUncordoned,
+		},
+		{
+			name: "failed",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeKubeadmUpgraded)
+				s.fail("worker1", "kubelet")
+			},
+			state:     upgradeFailed,
+			completed: upgradeKubeadmUpgraded,
+			reason:    "kubelet",
+		},
+		{
+			name: "failed and resumed",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeKubeadmUpgraded)
+				s.fail("worker1", "kubelet")
+				s.set("worker1", upgradeKubeletUpdated)
+			},
+			state:     upgradeKubeletUpdated,
+			completed: upgradeKubeletUpdated,
+			cordoned:  true,
+		},
+		{
+			name: "rolled back",
+			change: func(s *upgradeState) {
+				s.set("worker1", upgradeDrained)
+				s.rolledBack("worker1", "kubeadm, rolled back")
+			},
+			state:     upgradeFailed,
+			completed: upgradePending,
+			reason:    "kubeadm, rolled back",
+		},
+		{
+			name: "unknown node",
+			change: func(s *upgradeState) {
+				s.set("worker2", upgradeDrained)
+				s.fail("worker2", "drain")
+				s.rolledBack("worker2", "kubeadm")
+			},
+			state:     upgradePending,
+			completed: upgradePending,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := newUpgradeState(&pb.UpgradeRequest{}, "v1.21.2", false)
+			state.add("worker1", roleWorker)
+			test.change(state)
+
+			status := state.find("worker1")
+			if status.State != test.state || status.Completed != test.completed || status.Reason != test.reason {
+				t.Errorf("state %q, completed %q, reason %q, expected %q, %q, %q",
+					status.State, status.Completed, status.Reason, test.state, test.completed, test.reason)
+			}
+			if cordoned := state.cordoned("worker1"); cordoned != test.cordoned {
+				t.Errorf("cordoned %v, expected %v", cordoned, test.cordoned)
+			}
+			for _, step := range upgradeSteps {
+				expected := stepIndex(step) <= stepIndex(test.completed)
+				if completed := state.completed("worker1", step); completed != expected {
+					t.Errorf("completed %s is %v, expected %v", step, completed, expected)
+				}
+			}
+			if state.find("worker2") != nil || state.completed("worker2", upgradePending) || state.cordoned("worker2") {
+				t.Errorf("unknown node worker2 is part of the upgrade")
+			}
+		})
+	}
+}
+
+func TestUpgradeStateSave(t *testing.T) {
+	setupStateDir(t, map[string]string{"master": "master1"})
+
+	if state, err := loadUpgradeState(); state != nil || err != nil {
+		t.Fatalf("loaded %v, %v without an upgrade", state, err)
+	}
+
+	state := newUpgradeState(&pb.UpgradeRequest{ForceDrain: true, MaxUnavailable: "50%",
+		Order: []string{"worker2", "worker1"}, MaxFailures: 2}, "v1.21.2", true)
+	state.add("master1", roleFirstMaster)
+	state.add("worker1", roleWorker)
+	state.add("worker2", roleWorker)
+	state.add("worker3", roleWorker)
+	state.setHostname("master1", "master1.example.com")
+	state.set("master1", upgradeUncordoned)
+	state.set("worker1", upgradeKubeadmUpgraded)
+	state.fail("worker1", "kubelet")
+	state.set("worker2", upgradeDrained)
+	state.remove("worker3")
+
+	loaded, err := loadUpgradeState()
+	if err != nil || loaded == nil {
+		t.Fatalf("loaded %v: %v", loaded, err)
+	}
+	if !reflect.DeepEqual(loaded.request, state.request) {
+		t.Errorf("request %v, expected %v", loaded.request, state.request)
+	}
+	if loaded.started != state.started {
+		t.Errorf("started %q, expected %q", loaded.started, state.started)
+	}
+	if len(loaded.nodes) != len(state.nodes) {
+		t.Fatalf("nodes %v, expected %v", loaded.nodes, state.nodes)
+	}
+	for i := range state.nodes {
+		if !reflect.DeepEqual(loaded.nodes[i], state.nodes[i]) {
+			t.Errorf("node %v, expected %v", loaded.nodes[i], state.nodes[i])
+		}
+	}
+
+	if cordoned := strings.Join(loaded.cordonedNodes(), ","); cordoned != "worker2" {
+		t.Errorf("cordoned nodes %s", cordoned)
+	}
+	if pending := strings.Join(loaded.pending(roleWorker), ","); pending != "worker1,worker2" {
+		t.Errorf("pending workers %s", pending)
+	}
+	if loaded.finished() {
+		t.Errorf("upgrade finished")
+	}
+
+	// without persist nothing gets written
+	loaded.persist = false
+	loaded.set("worker1", upgradeUncordoned)
+	loaded.set("worker2", upgradeUncordoned)
+	if !loaded.finished() {
+		t.Errorf("upgrade not finished")
+	}
+	again, err := loadUpgradeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.finished() {
+		t.Errorf("state without persist got saved")
+	}
+}
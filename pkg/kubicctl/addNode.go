@@ -27,7 +27,9 @@ import (
 )
 
 var (
-	nodeType = "worker"
+	nodeType   = "worker"
+	nodeLabels []string
+	nodeTaints []string
 )
 
 func AddNodeCmd() *cobra.Command {
@@ -39,6 +41,10 @@ func AddNodeCmd() *cobra.Command {
 	}
 
 	subCmd.PersistentFlags().StringVar(&nodeType, "type", nodeType, "type of node, valid values are 'worker' or 'master'")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"join.retries=3\"")
+	subCmd.PersistentFlags().StringSliceVar(&nodeLabels, "label", nodeLabels, "Labels of the new nodes, e.g. \"zone=a\"")
+	subCmd.PersistentFlags().StringSliceVar(&nodeTaints, "taint", nodeTaints, "Taints of the new nodes, e.g. \"dedicated=db:NoSchedule\"")
 
 	return subCmd
 }
@@ -59,7 +65,7 @@ func addNode(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
-	stream, err := client.AddNode(ctx, &pb.AddNodeRequest{NodeNames: nodes, Type: nodeType})
+	stream, err := client.AddNode(ctx, &pb.AddNodeRequest{NodeNames: nodes, Type: nodeType, DryRun: dryRun, Policy: policy, Labels: nodeLabels, Taints: nodeTaints})
 	if err != nil {
 		log.Errorf("could not initialize: %v", err)
 		return
@@ -74,10 +80,14 @@ func addNode(cmd *cobra.Command, args []string) {
 			if r == nil {
 				fmt.Fprintf(os.Stderr, "Adding node %s failed: %v\n", nodes, err)
 			} else {
-				fmt.Fprintf(os.Stderr, "Adding node %s failed: %s\n%v\n", r.Message, err)
+				fmt.Fprintf(os.Stderr, "Adding node %s failed: %s\n%v\n", nodes, r.Message, err)
 			}
 			os.Exit(1)
 		}
+		if r.Output {
+			printOutput(r)
+			continue
+		}
 		if r.Success != true {
 			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
 			os.Exit(1)
@@ -0,0 +1,99 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+func CheckHealthCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "health",
+		Short: "Check health of the cluster, exits with 1 if a check failed",
+		Run:   checkHealth,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func checkHealth(cmd *cobra.Command, args []string) {
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	stream, err := client.CheckHealth(ctx, &pb.Empty{})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		os.Exit(1)
+	}
+	printHealthStream(stream)
+}
+
+// healthStream is implemented by all client streams of HealthReply
+type healthStream interface {
+	Recv() (*pb.HealthReply, error)
+}
+
+// printHealthStream prints all results and a summary, exits with 1 if
+// a check failed
+func printHealthStream(stream healthStream) {
+	var passed, warnings, failed int
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch r.Status {
+		case pb.HealthStatus_PASS:
+			passed++
+		case pb.HealthStatus_WARN:
+			warnings++
+		default:
+			failed++
+		}
+		if len(r.Object) > 0 {
+			fmt.Printf("%-4s %-10s %s: %s\n", r.Status, r.Check, r.Object, r.Message)
+		} else {
+			fmt.Printf("%-4s %-10s %s\n", r.Status, r.Check, r.Message)
+		}
+	}
+
+	fmt.Printf("%d passed, %d warnings, %d failed\n", passed, warnings, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
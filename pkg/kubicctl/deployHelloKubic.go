@@ -41,6 +41,7 @@ func DeployHelloKubicCmd() *cobra.Command {
 
 	subCmd.PersistentFlags().StringVarP(&service_type, "type", "t", service_type, "Type for this service: NodePort or LoadBalancer")
 	subCmd.PersistentFlags().StringVarP(&arg_lbip, "ip", "i", arg_lbip, "LoadBalancer IP")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
 
 	return subCmd
 }
@@ -74,7 +75,7 @@ func deployHelloKubic(cmd *cobra.Command, args []string) {
 	}
 
 	r, err := c.DeployKustomize(ctx,
-		&pb.DeployKustomizeRequest{Service: "hello-kubic", Argument: arg})
+		&pb.DeployKustomizeRequest{Service: "hello-kubic", Argument: arg, DryRun: dryRun})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
 		os.Exit(1)
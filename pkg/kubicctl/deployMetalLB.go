@@ -33,6 +33,8 @@ func DeployMetalLBCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 	}
 
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
 	return subCmd
 }
 
@@ -53,7 +55,7 @@ func deployMetalLB(cmd *cobra.Command, args []string) {
 	defer cancel()
 
 	r, err := c.DeployKustomize(ctx,
-		&pb.DeployKustomizeRequest{Service: "metallb", Argument: iprange})
+		&pb.DeployKustomizeRequest{Service: "metallb", Argument: iprange, DryRun: dryRun})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
 		os.Exit(1)
@@ -50,7 +50,8 @@ func destroyCluster(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
-	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: "*"})
+	// the whole cluster goes away, quorum does not matter
+	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: "*", Force: true})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
 		return
@@ -65,7 +66,7 @@ func destroyCluster(cmd *cobra.Command, args []string) {
 			if r == nil {
 				fmt.Fprintf(os.Stderr, "Removing all nodes failed: %v\n", err)
 			} else {
-				fmt.Fprintf(os.Stderr, "Removing node %s failed: %s\n%v\n", r.Message, err)
+				fmt.Fprintf(os.Stderr, "Removing all nodes failed: %s\n%v\n", r.Message, err)
 			}
 			os.Exit(1)
 		}
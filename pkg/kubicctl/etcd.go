@@ -0,0 +1,344 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+var confirmToken = ""
+
+func EtcdCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "etcd",
+		Short: "Manage the etcd database of the cluster",
+	}
+
+	subCmd.AddCommand(
+		EtcdSnapshotCmd(),
+		EtcdSnapshotsCmd(),
+		EtcdRestoreCmd(),
+		EtcdMemberCmd(),
+		EtcdHealthCmd(),
+		EtcdMaintainCmd(),
+	)
+
+	return subCmd
+}
+
+func EtcdSnapshotCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "snapshot [name]",
+		Short: "Take a snapshot of the etcd database",
+		Run:   etcdSnapshot,
+		Args:  cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func EtcdRestoreCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "restore <name>",
+		Short: "Replace the etcd database of the cluster with a snapshot",
+		Run:   etcdRestore,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&confirmToken, "confirm", confirmToken, "Confirmation token of the snapshot")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func EtcdMemberCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "member",
+		Short: "Manage etcd members",
+	}
+
+	subCmd.AddCommand(
+		ListMembersCmd(),
+		RemoveMemberCmd(),
+	)
+
+	return subCmd
+}
+
+func ListMembersCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List all etcd members",
+		Run:   listMembers,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func RemoveMemberCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "remove <name|id>",
+		Short: "Remove a member from the etcd cluster",
+		Run:   removeMember,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func EtcdHealthCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "health",
+		Short: "Check health of all etcd members, exits with 1 if a member is unhealthy",
+		Run:   etcdHealth,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func EtcdMaintainCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "maintain",
+		Short: "Compact and defragment the etcd database",
+		Run:   etcdMaintain,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func EtcdSnapshotsCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "snapshots",
+		Short: "Manage etcd snapshots",
+	}
+
+	subCmd.AddCommand(
+		ListSnapshotsCmd(),
+	)
+
+	return subCmd
+}
+
+func ListSnapshotsCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List all etcd snapshots",
+		Run:   listSnapshots,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func etcdSnapshot(cmd *cobra.Command, args []string) {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	stream, err := client.Snapshot(ctx, &pb.SnapshotRequest{Name: name, DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "Taking etcd snapshot", name)
+}
+
+func etcdRestore(cmd *cobra.Command, args []string) {
+	name := args[0]
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	stream, err := client.Restore(ctx, &pb.RestoreRequest{Name: name, Confirm: confirmToken, DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "Restoring etcd snapshot", name)
+}
+
+func listSnapshots(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.ListSnapshots(ctx, &pb.Empty{})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if !r.Success {
+		log.Errorf("Getting list of snapshots failed: %s", r.Message)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tNODE\tSIZE\tREVISION\tPATH\tSHA256")
+	for _, snapshot := range r.Snapshots {
+		node := snapshot.Node
+		if len(node) == 0 {
+			node = "local"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			snapshot.Name, snapshot.Created, node, snapshot.Size,
+			snapshot.Revision, snapshot.Path, orNone(snapshot.Sha256))
+	}
+	w.Flush()
+}
+
+func listMembers(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.ListMembers(ctx, &pb.Empty{})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if !r.Success {
+		log.Errorf("Getting list of etcd members failed: %s", r.Message)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPEER-URLS\tCLIENT-URLS\tLEARNER")
+	for _, member := range r.Members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n",
+			member.Id, orNone(member.Name),
+			orNone(strings.Join(member.PeerUrls, ",")),
+			orNone(strings.Join(member.ClientUrls, ",")), member.Learner)
+	}
+	w.Flush()
+}
+
+func removeMember(cmd *cobra.Command, args []string) {
+	member := args[0]
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.RemoveMember(ctx, &pb.RemoveMemberRequest{Member: member, DryRun: dryRun})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if r.Success {
+		fmt.Printf("%s\n", r.Message)
+	} else {
+		log.Errorf("Removing etcd member %s failed: %s", member, r.Message)
+	}
+}
+
+func etcdHealth(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	stream, err := client.Health(ctx, &pb.Empty{})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		os.Exit(1)
+	}
+	printHealthStream(stream)
+}
+
+func etcdMaintain(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewEtcdClient(conn)
+
+	// defragmentation of every member can take up to 10 minutes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	stream, err := client.Maintain(ctx, &pb.MaintainRequest{DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "etcd maintenance", "")
+}
@@ -52,6 +52,8 @@ func InitMasterCmd() *cobra.Command {
 	subCmd.PersistentFlags().StringVar(&stage, "stage", stage, "Stage of development: 'official', 'devel'")
 	subCmd.PersistentFlags().StringVar(&haproxy, "haproxy", haproxy, "Name of salt minion running haproxy as loadbalancer")
 	subCmd.PersistentFlags().StringVar(&firstMaster, "salt", firstMaster, "Name of salt minion of first master")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"join.retries=3\"")
 
 	return subCmd
 }
@@ -71,7 +73,7 @@ func initMaster(cmd *cobra.Command, args []string) {
 	defer cancel()
 
 	fmt.Print("Initializing kubernetes master can take several minutes, please be patient.\n")
-	stream, err := client.InitMaster(ctx, &pb.InitRequest{PodNetworking: podNetwork, AdvAddr: adv_addr, ApiserverCertExtraSans: apiserver_cert_extra_sans, MultiMaster: multiMaster, KubernetesVersion: kubernetesVersion, Stage: stage, Haproxy: haproxy, FirstMaster: firstMaster})
+	stream, err := client.InitMaster(ctx, &pb.InitRequest{PodNetworking: podNetwork, AdvAddr: adv_addr, ApiserverCertExtraSans: apiserver_cert_extra_sans, MultiMaster: multiMaster, KubernetesVersion: kubernetesVersion, Stage: stage, Haproxy: haproxy, FirstMaster: firstMaster, DryRun: dryRun, Policy: policy})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
 		return
@@ -89,6 +91,10 @@ func initMaster(cmd *cobra.Command, args []string) {
 			}
 			os.Exit(1)
 		} else {
+			if r.Output {
+				printOutput(r)
+				continue
+			}
 			if r.Success != true {
 				fmt.Fprintf(os.Stderr, "%s\n", r.Message)
 			} else {
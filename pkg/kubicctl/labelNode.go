@@ -0,0 +1,99 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+func LabelNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "label <node> <key>=<value>|<key>-...",
+		Short: "Set or remove labels of a node, they are restored if the node is added again",
+		Run:   labelNode,
+		Args:  cobra.MinimumNArgs(2),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func TaintNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "taint <node> <key>=<value>:<effect>|<key>[:<effect>]-...",
+		Short: "Set or remove taints of a node, they are restored if the node is added again",
+		Run:   taintNode,
+		Args:  cobra.MinimumNArgs(2),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func labelNode(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.SetNodeLabels(ctx, &pb.NodeLabelsRequest{NodeName: args[0], Labels: args[1:], DryRun: dryRun})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if r.Success {
+		fmt.Printf("%s\n", r.Message)
+	} else {
+		log.Errorf("Setting labels of node %s failed: %s", args[0], r.Message)
+	}
+}
+
+func taintNode(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.SetNodeTaints(ctx, &pb.NodeTaintsRequest{NodeName: args[0], Taints: args[1:], DryRun: dryRun})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if r.Success {
+		fmt.Printf("%s\n", r.Message)
+	} else {
+		log.Errorf("Setting taints of node %s failed: %s", args[0], r.Message)
+	}
+}
@@ -17,6 +17,9 @@ package kubicctl
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -27,7 +30,7 @@ import (
 func ListNodesCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
 		Use:   "list",
-		Short: "List all reachable worker nodes",
+		Short: "List all nodes known to salt or kubernetes",
 		Run:   listNodes,
 		Args:  cobra.ExactArgs(0),
 	}
@@ -54,16 +57,67 @@ func listNodes(cmd *cobra.Command, args []string) {
 		return
 	}
 	if r.Success {
-		fmt.Printf("Reacheable nodes: ")
-		for i := range r.Node {
-			if i == 0 {
-				fmt.Print(r.Node[i])
-			} else {
-				fmt.Print(", " + r.Node[i])
-			}
+		printNodeTable(r.Nodes)
+		if len(r.Message) > 0 {
+			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
 		}
-		fmt.Print("\n")
 	} else {
 		log.Errorf("Getting list of nodes failed: %s", r.Message)
 	}
 }
+
+func printNodeTable(nodes []*pb.NodeInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "SALT-ID\tNAME\tROLE\tSTATUS\tVERSION\tADDRESSES\tOS-IMAGE\tSALT")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orNone(node.SaltId), orNone(node.Name), node.Role,
+			nodeStatus(node), orNone(node.KubeletVersion),
+			orNone(strings.Join(node.Addresses, ",")),
+			orNone(node.OsImage), saltStatus(node))
+	}
+	w.Flush()
+}
+
+func orNone(value string) string {
+	if len(value) == 0 {
+		return "<none>"
+	}
+	return value
+}
+
+func nodeStatus(node *pb.NodeInfo) string {
+	if !node.InKubernetes {
+		if node.Role == "haproxy" {
+			return "-"
+		}
+		return "NotInKubernetes"
+	}
+
+	var status string
+	switch node.Ready {
+	case "True":
+		status = "Ready"
+	case "False":
+		status = "NotReady"
+	default:
+		status = "Unknown"
+	}
+	if !node.Schedulable {
+		status = status + ",SchedulingDisabled"
+	}
+	return status
+}
+
+func saltStatus(node *pb.NodeInfo) string {
+	if node.Local {
+		return "local"
+	}
+	if !node.InSalt {
+		return "missing"
+	}
+	if !node.Reachable {
+		return "unreachable"
+	}
+	return "reachable"
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+var (
+	drainTimeout       = ""
+	gracePeriod        = -1
+	podSelector        = ""
+	deleteEmptyDirData = false
+)
+
+// statusStream is implemented by all client streams of StatusReply
+type statusStream interface {
+	Recv() (*pb.StatusReply, error)
+}
+
+func CordonNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "cordon <node>",
+		Short: "Mark nodes as unschedulable",
+		Run:   cordonNode,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func UncordonNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "uncordon <node>",
+		Short: "Mark nodes as schedulable",
+		Run:   uncordonNode,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
+	return subCmd
+}
+
+func MaintenanceNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "maintenance on|off <node>",
+		Short: "Cordon and drain nodes for maintenance, or uncordon them afterwards",
+		Run:   maintenanceNode,
+		Args:  cobra.ExactArgs(2),
+	}
+
+	subCmd.PersistentFlags().StringVar(&drainTimeout, "timeout", drainTimeout, "How long draining a node may take, e.g. \"20m\"")
+	subCmd.PersistentFlags().IntVar(&gracePeriod, "grace-period", gracePeriod, "Termination grace period of the pods in seconds, 0 deletes them immediately, -1 uses the one of the pod")
+	subCmd.PersistentFlags().StringVar(&podSelector, "pod-selector", podSelector, "Only evict pods matching this label selector")
+	subCmd.PersistentFlags().BoolVar(&deleteEmptyDirData, "delete-emptydir-data", deleteEmptyDirData, "Evict pods with emptyDir volumes, their data gets lost")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"drain.retries=3\"")
+
+	return subCmd
+}
+
+// printStatusStream prints all messages of stream and exits if an
+// error occurs
+func printStatusStream(stream statusStream, action string, nodes string) {
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", strings.TrimSpace(action+" "+nodes), err)
+			os.Exit(1)
+		}
+		if r.Output {
+			printOutput(r)
+			continue
+		}
+		if r.Success != true {
+			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
+		} else {
+			fmt.Printf("%s\n", r.Message)
+		}
+	}
+}
+
+func cordonNode(cmd *cobra.Command, args []string) {
+	nodes := args[0]
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	stream, err := client.CordonNode(ctx, &pb.CordonRequest{NodeNames: nodes, DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "Cordoning node", nodes)
+}
+
+func uncordonNode(cmd *cobra.Command, args []string) {
+	nodes := args[0]
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	stream, err := client.UncordonNode(ctx, &pb.CordonRequest{NodeNames: nodes, DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "Uncordoning node", nodes)
+}
+
+func maintenanceNode(cmd *cobra.Command, args []string) {
+	var enable bool
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		enable = true
+	case "off":
+		enable = false
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid argument '%s', valid values are 'on' or 'off'\n", args[0])
+		os.Exit(1)
+	}
+	nodes := args[1]
+
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	// draining can take long, every node has it's own timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Hour)
+	defer cancel()
+
+	request := &pb.MaintenanceRequest{NodeNames: nodes,
+		Enable: enable, Timeout: drainTimeout,
+		PodSelector: podSelector, DeleteEmptydirData: deleteEmptyDirData,
+		DryRun: dryRun, Policy: policy}
+	if gracePeriod != -1 {
+		seconds := int32(gracePeriod)
+		request.GracePeriod = &seconds
+	}
+	stream, err := client.MaintenanceNode(ctx, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
+		return
+	}
+	printStatusStream(stream, "Maintenance of node", nodes)
+}
@@ -43,6 +43,11 @@ func NodeCmd() *cobra.Command {
 		RemoveNodeCmd(),
 		RebootNodeCmd(),
 		ListNodesCmd(),
+		LabelNodeCmd(),
+		TaintNodeCmd(),
+		CordonNodeCmd(),
+		UncordonNodeCmd(),
+		MaintenanceNodeCmd(),
 		DeployNodeCmd(),
 	)
 
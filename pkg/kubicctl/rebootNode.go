@@ -17,9 +17,9 @@ package kubicctl
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
 )
@@ -32,6 +32,10 @@ func RebootNodeCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 	}
 
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"join.retries=3\"")
+	subCmd.PersistentFlags().BoolVar(&force, "force", force, "Reboot masters even if etcd loses quorum or less than min_masters masters are running")
+	subCmd.PersistentFlags().BoolVar(&forceDrain, "force-drain", forceDrain, "Reboot the node even if draining it fails")
+
 	return subCmd
 }
 
@@ -48,17 +52,14 @@ func rebootNode(cmd *cobra.Command, args []string) {
 
 	c := pb.NewKubeadmClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	// draining can take long, every node has it's own timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Hour)
 	defer cancel()
 
-	r, err := c.RebootNode(ctx, &pb.RebootNodeRequest{NodeNames: nodes})
+	stream, err := c.RebootNode(ctx, &pb.RebootNodeRequest{NodeNames: nodes, Policy: policy, ForceDrain: forceDrain, Force: force})
 	if err != nil {
-		log.Errorf("could not initialize: %v", err)
+		fmt.Fprintf(os.Stderr, "could not initialize: %v\n", err)
 		return
 	}
-	if r.Success {
-		fmt.Printf("Node %s rebootd\n", nodes)
-	} else {
-		log.Errorf("Removing node %s failed: %s", nodes, r.Message)
-	}
+	printStatusStream(stream, "Rebooting node", nodes)
 }
@@ -33,6 +33,11 @@ func RemoveNodeCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 	}
 
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"join.retries=3\"")
+	subCmd.PersistentFlags().BoolVar(&force, "force", force, "Remove masters even if etcd loses quorum or less than min_masters masters are left")
+	subCmd.PersistentFlags().BoolVar(&forceDrain, "force-drain", forceDrain, "Remove the node even if draining it fails")
+
 	return subCmd
 }
 
@@ -49,10 +54,11 @@ func removeNode(cmd *cobra.Command, args []string) {
 
 	client := pb.NewKubeadmClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	// draining can take long, every node has it's own timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
 	defer cancel()
 
-	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: nodes})
+	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: nodes, DryRun: dryRun, Policy: policy, ForceDrain: forceDrain, Force: force})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
 		return
@@ -67,7 +73,7 @@ func removeNode(cmd *cobra.Command, args []string) {
 			if r == nil {
 				fmt.Fprintf(os.Stderr, "Removing node %s failed: %v\n", nodes, err)
 			} else {
-				fmt.Fprintf(os.Stderr, "Removing node %s failed: %s\n%v\n", r.Message, err)
+				fmt.Fprintf(os.Stderr, "Removing node %s failed: %s\n%v\n", nodes, r.Message, err)
 			}
 			os.Exit(1)
 		}
@@ -17,12 +17,14 @@ package kubicctl
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"os"
 
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -39,6 +41,11 @@ var (
 	Version    = "unreleased"
 	servername = "localhost"
 	port       = "7148"
+	verbose    = false
+	dryRun     = false
+	policy     []string
+	forceDrain = false
+	force      = false
 
 	usercfg = "~/.config/kubicctl/kubicctl.conf"
 
@@ -100,6 +107,7 @@ func Execute() error {
 	rootCmd.PersistentFlags().StringVar(&crtFile, "crtfile", crtFile, "Certificate with the public key for the user")
 	rootCmd.PersistentFlags().StringVar(&keyFile, "keyfile", keyFile, "Private key for the user")
 	rootCmd.PersistentFlags().StringVar(&caFile, "cafile", caFile, "Certificate with the public key of the CA for the server certificate")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", verbose, "Show the output of the commands run by kubicd, output of commands run via salt on remote nodes is shown after they finished")
 	rootCmd.AddCommand(
 		VersionCmd(),
 		InitMasterCmd(),
@@ -110,6 +118,8 @@ func Execute() error {
 		DestroyClusterCmd(),
 		rbac.RBACCmd(),
 		GetStatusCmd(),
+		CheckHealthCmd(),
+		EtcdCmd(),
 		DeployCmd(),
 	)
 
@@ -134,6 +144,18 @@ func Execute() error {
 	return nil
 }
 
+// printOutput prints a line of output of a command run by kubicd
+func printOutput(r *pb.StatusReply) {
+	if !verbose {
+		return
+	}
+	if len(r.Node) > 0 {
+		fmt.Printf("[%s] %s: %s\n", r.Node, r.Step, r.Message)
+	} else {
+		fmt.Printf("%s: %s\n", r.Step, r.Message)
+	}
+}
+
 func CreateConnection() (*grpc.ClientConn, error) {
 	// Load the certificates from disk
 	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
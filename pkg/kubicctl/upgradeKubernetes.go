@@ -19,12 +19,21 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"text/tabwriter"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
 )
 
+var (
+	maxUnavailable = "1"
+	upgradeOrder   []string
+	maxFailures    uint32
+	planUpgrade    bool
+)
+
 func UpgradeKubernetesCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
 		Use:   "upgrade",
@@ -34,11 +43,50 @@ func UpgradeKubernetesCmd() *cobra.Command {
 	}
 
 	subCmd.PersistentFlags().StringVar(&kubernetesVersion, "kubernetes-version", kubernetesVersion, "Kubernetes version of the control plane to deploy")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+	subCmd.PersistentFlags().StringSliceVar(&policy, "policy", policy, "Override timeout, retries or backoff of a step, e.g. \"join.retries=3\"")
+	subCmd.PersistentFlags().BoolVar(&forceDrain, "force-drain", forceDrain, "Upgrade a node even if draining it fails")
+	subCmd.Flags().StringVar(&maxUnavailable, "max-unavailable", maxUnavailable, "Number or percentage of workers upgraded at the same time")
+	subCmd.Flags().StringSliceVar(&upgradeOrder, "order", upgradeOrder, "Nodes to upgrade first, in this order")
+	subCmd.Flags().Uint32Var(&maxFailures, "max-failures", maxFailures, "Stop the upgrade after this many nodes failed, 0 never stops")
+	subCmd.Flags().BoolVar(&planUpgrade, "plan", planUpgrade, "Only show what the upgrade would change")
+
+	subCmd.AddCommand(
+		UpgradeResumeCmd(),
+		UpgradeStatusCmd(),
+	)
+
+	return subCmd
+}
+
+func UpgradeResumeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "resume",
+		Short: "Continue an interrupted or failed upgrade",
+		Run:   resumeUpgrade,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func UpgradeStatusCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the progress of the running or last upgrade",
+		Run:   upgradeStatus,
+		Args:  cobra.ExactArgs(0),
+	}
 
 	return subCmd
 }
 
 func upgradeKubernetes(cmd *cobra.Command, args []string) {
+	if planUpgrade {
+		printUpgradePlan()
+		return
+	}
+
 	// Set up a connection to the server.
 
 	conn, err := CreateConnection()
@@ -49,15 +97,21 @@ func upgradeKubernetes(cmd *cobra.Command, args []string) {
 
 	client := pb.NewKubeadmClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	// every node gets drained, which can take long
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Hour)
 	defer cancel()
 
 	fmt.Print("Upgrading kubernetes can take a very long time, please be patient.\n")
-	stream, err := client.UpgradeKubernetes(ctx, &pb.UpgradeRequest{KubernetesVersion: kubernetesVersion})
+	stream, err := client.UpgradeKubernetes(ctx, &pb.UpgradeRequest{KubernetesVersion: kubernetesVersion, DryRun: dryRun, Policy: policy, ForceDrain: forceDrain,
+		MaxUnavailable: maxUnavailable, Order: upgradeOrder, MaxFailures: maxFailures})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not upgrade: %v", err)
 		os.Exit(1)
 	}
+	printUpgradeStream(stream)
+}
+
+func printUpgradeStream(stream statusStream) {
 	for {
 		r, err := stream.Recv()
 		if err == io.EOF {
@@ -71,6 +125,10 @@ func upgradeKubernetes(cmd *cobra.Command, args []string) {
 			}
 			os.Exit(1)
 		}
+		if r.Output {
+			printOutput(r)
+			continue
+		}
 		if r.Success != true {
 			fmt.Fprintf(os.Stderr, "Upgrading kubernetes failed: %s\n", r.Message)
 			os.Exit(1)
@@ -79,3 +137,146 @@ func upgradeKubernetes(cmd *cobra.Command, args []string) {
 		}
 	}
 }
+
+func resumeUpgrade(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	// every node gets drained, which can take long
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Hour)
+	defer cancel()
+
+	stream, err := client.ResumeUpgrade(ctx, &pb.ResumeUpgradeRequest{DryRun: dryRun, Policy: policy, ForceDrain: forceDrain})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not resume upgrade: %v", err)
+		os.Exit(1)
+	}
+	printUpgradeStream(stream)
+}
+
+func upgradeStatus(cmd *cobra.Command, args []string) {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := client.UpgradeStatus(ctx, &pb.Empty{})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		return
+	}
+	if !r.Success {
+		log.Errorf("Getting upgrade status failed: %s", r.Message)
+		return
+	}
+	if len(r.KubernetesVersion) == 0 {
+		fmt.Printf("%s\n", r.Message)
+		return
+	}
+
+	status := "interrupted"
+	if r.Running {
+		status = "running"
+	} else if r.Finished {
+		status = "finished"
+	}
+	upgraded := 0
+	for _, node := range r.Nodes {
+		if node.State == "uncordoned" {
+			upgraded++
+		}
+	}
+	fmt.Printf("Upgrade to %s, started %s: %s, %d of %d nodes upgraded\n\n",
+		r.KubernetesVersion, r.Started, status, upgraded, len(r.Nodes))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NODE\tHOSTNAME\tROLE\tSTATE\tCOMPLETED\tREASON\tUPDATED")
+	for _, node := range r.Nodes {
+		name := node.Node
+		if len(name) == 0 {
+			name = "local"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name, orNone(node.Hostname), node.Role, node.State,
+			node.Completed, orNone(node.Reason), node.Updated)
+	}
+	w.Flush()
+}
+
+func printUpgradePlan() {
+	conn, err := CreateConnection()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	// the packages of every node get queried
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	defer cancel()
+
+	r, err := client.PlanUpgrade(ctx, &pb.PlanUpgradeRequest{KubernetesVersion: kubernetesVersion})
+	if err != nil {
+		log.Errorf("could not initialize: %v", err)
+		os.Exit(1)
+	}
+	if !r.Success {
+		log.Errorf("Planning the upgrade failed: %s", r.Message)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Upgrade control plane from %s to %s\n\n", r.CurrentVersion, r.TargetVersion)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tCURRENT\tTARGET")
+	for _, component := range r.Components {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", component.Name,
+			orNone(component.Current), component.Target)
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "NODE\tROLE\tKUBELET\tTARGET")
+	for _, node := range r.Nodes {
+		target := node.TargetKubelet
+		if node.CurrentKubelet == node.TargetKubelet {
+			target = "unchanged"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", node.Name, node.Role,
+			orNone(node.CurrentKubelet), target)
+	}
+	w.Flush()
+	fmt.Println()
+
+	if len(r.Addons) == 0 {
+		fmt.Println("All deployed services are up to date.")
+	} else {
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tKIND\tSTATUS")
+		for _, addon := range r.Addons {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", addon.Name, addon.Kind, "newer version available")
+		}
+		w.Flush()
+	}
+
+	if len(r.Problems) > 0 {
+		fmt.Fprintf(os.Stderr, "\nThe upgrade would be refused:\n")
+		for _, problem := range r.Problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", problem)
+		}
+		os.Exit(1)
+	}
+}
@@ -33,6 +33,8 @@ func YomiInstallCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 	}
 
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
+
 	return subCmd
 }
 
@@ -53,7 +55,7 @@ func install(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
-	stream, err := client.Install(ctx, &pb.InstallRequest{Saltnode: node})
+	stream, err := client.Install(ctx, &pb.InstallRequest{Saltnode: node, DryRun: dryRun})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
 		return
@@ -74,6 +76,10 @@ func install(cmd *cobra.Command, args []string) {
 			}
 			retval = 1
 		} else {
+			if r.Output {
+				printOutput(r)
+				continue
+			}
 			if r.Success != true {
 				fmt.Fprintf(os.Stderr, "%s\n", r.Message)
 			} else {
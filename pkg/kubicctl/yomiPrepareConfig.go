@@ -48,6 +48,7 @@ func YomiPrepareConfigCmd() *cobra.Command {
 	subCmd.PersistentFlags().StringVar(&arg_repo_update, "update-repo", "", "Update repository to install from")
 	subCmd.PersistentFlags().BoolVar(&arg_efi, "efi", false, "Machine has EFI firmware")
 	subCmd.PersistentFlags().BoolVar(&arg_baremetal, "baremetal", false, "Machine is bare metal")
+	subCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", dryRun, "Only show what would be done, don't change anything")
 
 	return subCmd
 }
@@ -72,7 +73,7 @@ func prepareConfig(cmd *cobra.Command, args []string) {
 
 	// XXX efi and baremetal are missing
 	stream, err := client.PrepareConfig(ctx, &pb.PrepareConfigRequest{Saltnode: node, Type: nodeType,
-		Disk: arg_disk, Repo: arg_repo, RepoUpdate: arg_repo_update})
+		Disk: arg_disk, Repo: arg_repo, RepoUpdate: arg_repo_update, DryRun: dryRun})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
 		return
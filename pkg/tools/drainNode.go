@@ -14,17 +14,35 @@
 
 package tools
 
-func DrainNode(hostname string, timeout string) (bool, string) {
+import (
+	"context"
 
-	var arg_timeout string
+	"github.com/thkukuk/kubic-control/pkg/k8s"
+)
 
-	if len(timeout) > 0 {
-		arg_timeout = timeout
-	} else {
-		arg_timeout = "10m"
+// DrainNode evicts all pods from hostname, including pods with emptyDir
+// volumes. Every evicted pod and every failed attempt gets reported.
+// The timeout and the number of retries are defined by the drain policy.
+func DrainNode(ctx context.Context, executor NodeExecutor, hostname string, report AttemptFunc) (bool, string) {
+	return DrainNodeWithOptions(ctx, executor, hostname, k8s.DrainOptions{DeleteEmptyDirData: true}, report)
+}
+
+// DrainNodeWithOptions is like DrainNode, but options define which pods
+// get evicted and how.
+func DrainNodeWithOptions(ctx context.Context, executor NodeExecutor, hostname string, options k8s.DrainOptions, report AttemptFunc) (bool, string) {
+
+	if DryRun(executor, "drain node "+hostname) {
+		return true, ""
 	}
 
-	return ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
-		"drain", hostname, "--timeout", arg_timeout, "--delete-local-data",
-		"--force", "--ignore-daemonsets")
+	return RetryStep(ctx, StepDrain, report, func(ctx context.Context) (bool, string) {
+		client, err := k8s.NewAdminClient()
+		if err != nil {
+			return false, err.Error()
+		}
+		if err := client.Drain(ctx, hostname, options, k8s.ProgressFunc(report)); err != nil {
+			return false, err.Error()
+		}
+		return true, ""
+	})
 }
@@ -0,0 +1,184 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+// dryRunQueries only read data from a node. They are executed even in
+// dry-run mode, since the following steps depend on the result.
+var dryRunQueries = []string{
+	"rpm -q",
+	"test -f ",
+	"systemd-detect-virt",
+	"devices.hwinfo",
+	"sha256sum ",
+	"cat /etc/kubernetes/manifests/",
+	"cat /etc/kubernetes/pki/etcd/",
+}
+
+var dryRunQuerySuffixes = []string{
+	" member list",
+}
+
+// DryRunExecutor does not change anything. Every command, which would
+// be executed on a node, is reported to the output function instead.
+// Queries are passed to the real executor.
+type DryRunExecutor struct {
+	executor NodeExecutor
+	mu       sync.Mutex
+	output   OutputFunc
+}
+
+func NewDryRunExecutor(executor NodeExecutor, output OutputFunc) *DryRunExecutor {
+	return &DryRunExecutor{executor: executor, output: output}
+}
+
+// DryRunStream returns executor, or if dryRun is set, a DryRunExecutor
+// sending all changes to stream.
+func DryRunStream(executor NodeExecutor, dryRun bool, stream StatusSender) NodeExecutor {
+	if !dryRun {
+		return executor
+	}
+	return NewDryRunExecutor(executor, func(line string) {
+		stream.Send(&pb.StatusReply{Success: true, Message: line})
+	})
+}
+
+// DryRunPlan returns executor, or if dryRun is set, a DryRunExecutor
+// collecting all changes. plan returns them as message for requests,
+// which have only a single reply.
+func DryRunPlan(executor NodeExecutor, dryRun bool) (NodeExecutor, func() string) {
+	var lines []string
+	plan := func() string {
+		return strings.Join(lines, "\n")
+	}
+	if !dryRun {
+		return executor, plan
+	}
+	return NewDryRunExecutor(executor, func(line string) {
+		lines = append(lines, line)
+	}), plan
+}
+
+// IsDryRun returns true if executor does not change anything
+func IsDryRun(executor NodeExecutor) bool {
+	_, ok := executor.(*DryRunExecutor)
+	return ok
+}
+
+// DryRun reports change if executor is a DryRunExecutor. Returns
+// true in this case, the change must not be done by the caller.
+func DryRun(executor NodeExecutor, change string) bool {
+	d, ok := executor.(*DryRunExecutor)
+	if !ok {
+		return false
+	}
+	d.report(change)
+	return true
+}
+
+func (d *DryRunExecutor) report(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.output("[dry-run] " + line)
+}
+
+func isDryRunQuery(command string) bool {
+	for _, query := range dryRunQueries {
+		if strings.HasPrefix(command, query) {
+			return true
+		}
+	}
+	for _, query := range dryRunQuerySuffixes {
+		if strings.HasSuffix(command, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandLine returns the command as it would be executed on node
+func commandLine(node string, command string, arg []string) string {
+	if len(arg) > 0 {
+		command = command + " " + strings.Join(arg, " ")
+	}
+	if len(node) == 0 {
+		return command
+	}
+	return "salt '" + node + "' cmd.run_all \"" + command + "\""
+}
+
+// callLine returns the salt function call as it would be executed on node
+func callLine(node string, function string, arg []string) string {
+	line := strings.Join(append([]string{function}, arg...), " ")
+	if len(node) == 0 {
+		return "local " + line
+	}
+	return "salt '" + node + "' " + line
+}
+
+func (d *DryRunExecutor) Run(ctx context.Context, node string, command string, arg ...string) (bool, string) {
+	return d.RunStream(ctx, node, nil, command, arg...)
+}
+
+func (d *DryRunExecutor) RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string) {
+	if isDryRunQuery(strings.Join(append([]string{command}, arg...), " ")) {
+		return d.executor.Run(ctx, node, command, arg...)
+	}
+	d.report(commandLine(node, command, arg))
+	return true, ""
+}
+
+func (d *DryRunExecutor) Call(ctx context.Context, node string, function string, arg ...string) (bool, string) {
+	if isDryRunQuery(function) {
+		return d.executor.Call(ctx, node, function, arg...)
+	}
+	d.report(callLine(node, function, arg))
+	return true, ""
+}
+
+func (d *DryRunExecutor) ServiceStart(ctx context.Context, node string, service string) (bool, string) {
+	return d.Call(ctx, node, "service.start", service)
+}
+
+func (d *DryRunExecutor) ServiceEnable(ctx context.Context, node string, service string) (bool, string) {
+	return d.Call(ctx, node, "service.enable", service)
+}
+
+func (d *DryRunExecutor) GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string) {
+	return d.Call(ctx, node, "grains.append", key, value)
+}
+
+func (d *DryRunExecutor) GetHostname(ctx context.Context, node string) (string, error) {
+	return d.executor.GetHostname(ctx, node)
+}
+
+func (d *DryRunExecutor) FileExists(ctx context.Context, node string, path string) (bool, error) {
+	return d.executor.FileExists(ctx, node, path)
+}
+
+func (d *DryRunExecutor) Ping(ctx context.Context, target string) (SaltResults, error) {
+	return d.executor.Ping(ctx, target)
+}
+
+func (d *DryRunExecutor) GrainMatch(ctx context.Context, key string, value string) (SaltResults, error) {
+	return d.executor.GrainMatch(ctx, key, value)
+}
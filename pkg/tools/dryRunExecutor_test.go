@@ -0,0 +1,63 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDryRunPlan(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.Output["worker1: rpm -q kubernetes-kubeadm"] = "kubernetes-kubeadm-1.23.1"
+
+	executor, plan := DryRunPlan(fake, true)
+	if !IsDryRun(executor) {
+		t.Fatalf("DryRunPlan did not return a dry-run executor")
+	}
+	ctx := context.Background()
+	if _, version := executor.Run(ctx, "worker1", "rpm", "-q", "kubernetes-kubeadm"); version != "kubernetes-kubeadm-1.23.1" {
+		t.Errorf("query returned %q", version)
+	}
+	executor.Run(ctx, "worker1", "kubeadm", "reset", "--force")
+	executor.GrainsAppend(ctx, "worker1", "kubicd", "kubic-worker-node")
+	DryRun(executor, "delete node worker1")
+
+	want := "[dry-run] salt 'worker1' cmd.run_all \"kubeadm reset --force\"\n" +
+		"[dry-run] salt 'worker1' grains.append kubicd kubic-worker-node\n" +
+		"[dry-run] delete node worker1"
+	if got := plan(); got != want {
+		t.Errorf("got plan\n%s\nwant\n%s", got, want)
+	}
+	if len(fake.History) != 1 || fake.History[0] != "worker1: rpm -q kubernetes-kubeadm" {
+		t.Errorf("changes reached the nodes: %v", fake.History)
+	}
+}
+
+func TestDryRunPlanDisabled(t *testing.T) {
+	fake := NewFakeExecutor()
+
+	executor, plan := DryRunPlan(fake, false)
+	if executor != fake {
+		t.Fatalf("DryRunPlan wrapped the executor without dry-run")
+	}
+	executor.Run(context.Background(), "worker1", "kubeadm", "reset", "--force")
+	if plan() != "" {
+		t.Errorf("got plan %q without dry-run", plan())
+	}
+	if len(fake.History) != 1 {
+		t.Errorf("command was not executed: %v", fake.History)
+	}
+}
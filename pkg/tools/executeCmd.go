@@ -15,37 +15,112 @@
 package tools
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os/exec"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func ExecuteCmd(command string, arg ...string) (bool, string) {
+	return ExecuteCmdContext(context.Background(), command, arg...)
+}
+
+// ExecuteCmdContext is like ExecuteCmd, but kills the command if ctx
+// is done before the command finished.
+func ExecuteCmdContext(ctx context.Context, command string, arg ...string) (bool, string) {
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 
-	cmd := exec.Command(command, arg...)
+	cmd := exec.CommandContext(ctx, command, arg...)
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
 	log.Infof("Executing %s: %v", cmd.Path, cmd.Args)
 
 	if err := cmd.Run(); err != nil {
-		if command == "salt" {
-			stderr = out // salt is evil, errors are written to stdout
+		if ctx.Err() != nil {
+			log.Errorf("Error invoking %s: %v", command, ctx.Err())
+			return false, "Error invoking " + command + ": " + ctx.Err().Error()
 		}
 		log.Error("Error invoking " + command + ": " + fmt.Sprint(err) + "\n" + stderr.String())
-		if command == "salt" {
-			return false, "Error invoking " + command + ": " + err.Error() + "\n(" + strings.TrimSuffix(stderr.String(), "\n") + ")"
-		} else {
-			return false, "Error invoking " + command + ": " + err.Error()
+		return false, "Error invoking " + command + ": " + err.Error()
+	} else {
+		log.Info(out.String())
+	}
+
+	return true, out.String()
+}
+
+// ExecuteCmdStream is like ExecuteCmdContext, but passes every line of
+// stdout and stderr to output as soon as it arrives.
+func ExecuteCmdStream(ctx context.Context, output OutputFunc, command string, arg ...string) (bool, string) {
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	cmd := exec.CommandContext(ctx, command, arg...)
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, "Error invoking " + command + ": " + err.Error()
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return false, "Error invoking " + command + ": " + err.Error()
+	}
+
+	log.Infof("Executing %s: %v", cmd.Path, cmd.Args)
+
+	if err := cmd.Start(); err != nil {
+		log.Error("Error invoking " + command + ": " + fmt.Sprint(err))
+		return false, "Error invoking " + command + ": " + err.Error()
+	}
+
+	forward := func(r io.Reader, buf *bytes.Buffer) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			mu.Lock()
+			buf.WriteString(scanner.Text() + "\n")
+			output(scanner.Text())
+			mu.Unlock()
 		}
+		// line too long, don't block the command
+		io.Copy(ioutil.Discard, r)
+	}
+	wg.Add(2)
+	go forward(stdoutPipe, &out)
+	go forward(stderrPipe, &stderr)
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			log.Errorf("Error invoking %s: %v", command, ctx.Err())
+			return false, "Error invoking " + command + ": " + ctx.Err().Error()
+		}
+		log.Error("Error invoking " + command + ": " + fmt.Sprint(err) + "\n" + stderr.String())
+		return false, "Error invoking " + command + ": " + err.Error()
 	} else {
 		log.Info(out.String())
 	}
 
 	return true, out.String()
 }
+
+// outputLines passes text line by line to output
+func outputLines(output OutputFunc, text string) {
+	if output == nil || len(text) == 0 {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		output(line)
+	}
+}
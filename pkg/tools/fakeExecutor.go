@@ -0,0 +1,249 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+)
+
+// FakeExecutor is an in-memory NodeExecutor. It does not execute
+// anything, but records every request in History and answers from
+// the configured state. Meant to test the cluster operations without
+// a salt master.
+type FakeExecutor struct {
+	mu sync.Mutex
+
+	// Nodes maps the name of every reachable node to its hostname
+	Nodes map[string]string
+	// Files contains "node:path" for every existing file
+	Files map[string]bool
+	// Grains of every node
+	Grains map[string]map[string][]string
+	// Services contains "node:service" with the state "started"
+	// and/or "enabled"
+	Services map[string][]string
+	// Output maps "node: command" or a prefix of it to the output of
+	// the command. An exact match wins over the longest prefix.
+	Output map[string]string
+	// Failures maps a prefix of "node: command" to an error message.
+	// Every request starting with this prefix fails.
+	Failures map[string]string
+	// History of all requests as "node: command"
+	History []string
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		Nodes:    make(map[string]string),
+		Files:    make(map[string]bool),
+		Grains:   make(map[string]map[string][]string),
+		Services: make(map[string][]string),
+		Output:   make(map[string]string),
+		Failures: make(map[string]string),
+	}
+}
+
+// AddNode adds a reachable node with the given hostname
+func (f *FakeExecutor) AddNode(node string, hostname string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Nodes[node] = hostname
+}
+
+// record the request and return the configured result
+func (f *FakeExecutor) request(ctx context.Context, node string, request string) (bool, string) {
+	entry := node + ": " + request
+
+	f.History = append(f.History, entry)
+	if ctx.Err() != nil {
+		return false, ctx.Err().Error()
+	}
+	for prefix, message := range f.Failures {
+		if strings.HasPrefix(entry, prefix) {
+			return false, message
+		}
+	}
+	return true, f.output(entry)
+}
+
+// output returns the configured output of the request entry
+func (f *FakeExecutor) output(entry string) string {
+	if output, ok := f.Output[entry]; ok {
+		return output
+	}
+	match := ""
+	for prefix := range f.Output {
+		if len(prefix) > len(match) && strings.HasPrefix(entry, prefix) {
+			match = prefix
+		}
+	}
+	return f.Output[match]
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, node string, command string, arg ...string) (bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(arg) > 0 {
+		command = command + " " + strings.Join(arg, " ")
+	}
+	return f.request(ctx, node, command)
+}
+
+func (f *FakeExecutor) RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string) {
+	success, message := f.Run(ctx, node, command, arg...)
+	if success == true {
+		outputLines(output, message)
+	}
+	return success, message
+}
+
+func (f *FakeExecutor) Call(ctx context.Context, node string, function string, arg ...string) (bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	success, message := f.request(ctx, node, strings.Join(append([]string{function}, arg...), " "))
+	if success != true {
+		return success, message
+	}
+
+	switch function {
+	case "service.start":
+		if len(arg) == 1 {
+			f.Services[node+":"+arg[0]] = append(f.Services[node+":"+arg[0]], "started")
+		}
+	case "service.enable":
+		if len(arg) == 1 {
+			f.Services[node+":"+arg[0]] = append(f.Services[node+":"+arg[0]], "enabled")
+		}
+	case "service.stop", "service.disable":
+		if len(arg) == 1 {
+			f.Services[node+":"+arg[0]] = nil
+		}
+	case "grains.append":
+		if len(arg) == 2 {
+			if f.Grains[node] == nil {
+				f.Grains[node] = make(map[string][]string)
+			}
+			f.Grains[node][arg[0]] = append(f.Grains[node][arg[0]], arg[1])
+		}
+	case "grains.delkey":
+		if len(arg) == 1 && f.Grains[node] != nil {
+			delete(f.Grains[node], arg[0])
+		}
+	}
+	return true, message
+}
+
+func (f *FakeExecutor) ServiceStart(ctx context.Context, node string, service string) (bool, string) {
+	return f.Call(ctx, node, "service.start", service)
+}
+
+func (f *FakeExecutor) ServiceEnable(ctx context.Context, node string, service string) (bool, string) {
+	return f.Call(ctx, node, "service.enable", service)
+}
+
+func (f *FakeExecutor) GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string) {
+	return f.Call(ctx, node, "grains.append", key, value)
+}
+
+func (f *FakeExecutor) GetHostname(ctx context.Context, node string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	success, message := f.request(ctx, node, "network.get_hostname")
+	if success != true {
+		return node, errors.New(message)
+	}
+	if hostname, ok := f.Nodes[node]; ok {
+		return hostname, nil
+	}
+	return node, errors.New(node + ": no response")
+}
+
+func (f *FakeExecutor) FileExists(ctx context.Context, node string, path string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	success, message := f.request(ctx, node, "file.access "+path)
+	if success != true {
+		return false, errors.New(message)
+	}
+	return f.Files[node+":"+path], nil
+}
+
+// match a salt target: a single name, a comma separated list or a glob
+func fakeMatch(target string, node string) bool {
+	if strings.Index(target, ",") >= 0 && strings.Index(target, "[") == -1 {
+		for _, entry := range strings.Split(target, ",") {
+			if strings.TrimSpace(entry) == node {
+				return true
+			}
+		}
+		return false
+	}
+	matched, _ := path.Match(target, node)
+	return matched
+}
+
+// ping all nodes for which match returns true
+func (f *FakeExecutor) ping(ctx context.Context, match func(node string) bool) SaltResults {
+	results := make(SaltResults)
+	for node := range f.Nodes {
+		if !match(node) {
+			continue
+		}
+		success, message := f.request(ctx, node, "test.ping")
+		if success != true {
+			results[node] = &SaltResult{Return: fakeString(message), Retcode: 1}
+		} else {
+			results[node] = &SaltResult{Return: json.RawMessage("true")}
+		}
+	}
+	return results
+}
+
+func fakeString(message string) json.RawMessage {
+	raw, _ := json.Marshal(message)
+	return raw
+}
+
+func (f *FakeExecutor) Ping(ctx context.Context, target string) (SaltResults, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ping(ctx, func(node string) bool {
+		return fakeMatch(target, node)
+	}), nil
+}
+
+func (f *FakeExecutor) GrainMatch(ctx context.Context, key string, value string) (SaltResults, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ping(ctx, func(node string) bool {
+		for _, entry := range f.Grains[node][key] {
+			if entry == value {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
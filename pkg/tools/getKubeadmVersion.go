@@ -15,25 +15,17 @@
 package tools
 
 import (
+	"context"
 	"strings"
 )
 
-func GetKubeadmVersion(salt string) (bool, string) {
+func GetKubeadmVersion(ctx context.Context, executor NodeExecutor, salt string) (bool, string) {
 	// find out our kubeadm version and use that to upgrade to this version
-	var success bool
-	var message string
-	if len(salt) > 0 {
-		success, message = ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", salt, "cmd.run", "rpm -q --qf '%{VERSION}' kubernetes-kubeadm")
-		message = strings.Replace(message, "\n", "", -1)
-		i := strings.Index(message, ":") + 1
-		message = strings.TrimSpace(message[i:])
-	} else {
-		success, message = ExecuteCmd("rpm", "-q", "--qf", "'%{VERSION}'", "kubernetes-kubeadm")
-	}
+	success, message := executor.Run(ctx, salt, "rpm", "-q", "--qf", "'%{VERSION}'", "kubernetes-kubeadm")
 	if success != true {
 		return false, message
 	}
-	kubernetes_version := "v" + strings.Replace(message, "'", "", -1)
+	kubernetes_version := "v" + strings.TrimSpace(strings.Replace(message, "'", "", -1))
 
 	return true, kubernetes_version
 }
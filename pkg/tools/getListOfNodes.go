@@ -15,22 +15,15 @@
 package tools
 
 import (
-	"strings"
+	"context"
 )
 
-func GetListOfNodes(role string) (bool, string, []string) {
+func GetListOfNodes(ctx context.Context, executor NodeExecutor, role string) (SaltResults, error) {
 
 	if len(role) == 0 {
 		role = "worker"
 	}
 
 	// Get list of all nodes of this role
-	success, message := ExecuteCmd("salt", "--module-executors='direct_call'", "-G", "kubicd:kubic-"+role+"-node", "grains.get", "kubic-"+role+"-node")
-	if success != true {
-		return success, message, nil
-	}
-	message = strings.TrimSuffix(message, "\n")
-	nodelist := strings.Split(strings.Replace(message, ":", "", -1), "\n")
-
-	return true, "", nodelist
+	return executor.GrainMatch(ctx, "kubicd", "kubic-"+role+"-node")
 }
@@ -0,0 +1,97 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+// LocalExecutor runs everything on the local machine, the node name is
+// ignored. Useful for single node setups without a salt master.
+type LocalExecutor struct{}
+
+func NewLocalExecutor() *LocalExecutor {
+	return &LocalExecutor{}
+}
+
+// localCommand returns the command to execute, a complete command
+// line is split by the shell
+func localCommand(command string, arg []string) (string, []string) {
+	if len(arg) == 0 && strings.ContainsAny(command, " ;|&") {
+		return "/bin/sh", []string{"-c", command}
+	}
+	return command, arg
+}
+
+func (l *LocalExecutor) Run(ctx context.Context, node string, command string, arg ...string) (bool, string) {
+	command, arg = localCommand(command, arg)
+	return ExecuteCmdContext(ctx, command, arg...)
+}
+
+func (l *LocalExecutor) RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string) {
+	if output == nil {
+		return l.Run(ctx, node, command, arg...)
+	}
+	command, arg = localCommand(command, arg)
+	return ExecuteCmdStream(ctx, output, command, arg...)
+}
+
+func (l *LocalExecutor) Call(ctx context.Context, node string, function string, arg ...string) (bool, string) {
+	switch function {
+	case "service.start", "service.stop", "service.restart",
+		"service.enable", "service.disable":
+		if len(arg) != 1 {
+			return false, function + ": exactly one service name needed"
+		}
+		return ExecuteCmdContext(ctx, "systemctl", strings.TrimPrefix(function, "service."), arg[0])
+	case "system.reboot":
+		return ExecuteCmdContext(ctx, "systemctl", "reboot")
+	case "grains.append", "grains.delkey":
+		// there are no grains without salt
+		return true, ""
+	}
+	return false, "Salt function '" + function + "' is not supported by the local executor"
+}
+
+func (l *LocalExecutor) ServiceStart(ctx context.Context, node string, service string) (bool, string) {
+	return l.Call(ctx, node, "service.start", service)
+}
+
+func (l *LocalExecutor) ServiceEnable(ctx context.Context, node string, service string) (bool, string) {
+	return l.Call(ctx, node, "service.enable", service)
+}
+
+func (l *LocalExecutor) GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string) {
+	return l.Call(ctx, node, "grains.append", key, value)
+}
+
+func (l *LocalExecutor) GetHostname(ctx context.Context, node string) (string, error) {
+	return os.Hostname()
+}
+
+func (l *LocalExecutor) FileExists(ctx context.Context, node string, path string) (bool, error) {
+	return Exists(path)
+}
+
+func (l *LocalExecutor) Ping(ctx context.Context, target string) (SaltResults, error) {
+	return nil, errors.New("No remote nodes available without salt")
+}
+
+func (l *LocalExecutor) GrainMatch(ctx context.Context, key string, value string) (SaltResults, error) {
+	return SaltResults{}, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+)
+
+// OutputFunc gets the output of a command line by line
+type OutputFunc func(line string)
+
+// NodeExecutor hides how commands reach the nodes of the cluster.
+// An empty node name always means the machine kubicd is running on,
+// everything else is the name of a salt minion.
+type NodeExecutor interface {
+	// Run executes command with the given arguments on node
+	Run(ctx context.Context, node string, command string, arg ...string) (bool, string)
+	// RunStream is like Run, but passes every line of stdout and stderr
+	// to output. Only local commands are forwarded while they are
+	// running. Remote commands run via salt as cmd.run_all, which
+	// returns stdout and stderr first after the command did finish,
+	// so their lines are relayed all at once at the end.
+	RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string)
+	// Call executes a salt execution module function on node, the
+	// result is returned as salt json output
+	Call(ctx context.Context, node string, function string, arg ...string) (bool, string)
+	ServiceStart(ctx context.Context, node string, service string) (bool, string)
+	ServiceEnable(ctx context.Context, node string, service string) (bool, string)
+	GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string)
+	// GetHostname returns the hostname of node, which is identical
+	// with the kubernetes node name
+	GetHostname(ctx context.Context, node string) (string, error)
+	FileExists(ctx context.Context, node string, path string) (bool, error)
+	// Ping returns the test.ping result of every node matching target.
+	// target can be a single name, a comma separated list or a glob.
+	// Nodes which did not answer are reported as failed, an empty
+	// result means no node matched.
+	Ping(ctx context.Context, target string) (SaltResults, error)
+	// GrainMatch returns the test.ping result of every node which has
+	// value in the grain key
+	GrainMatch(ctx context.Context, key string, value string) (SaltResults, error)
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "<redacted>"
+
+type redactPattern struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// redactPatterns matches secrets in command lines and output:
+// PEM blocks, kubeconfig credentials, bootstrap tokens, discovery
+// token hashes and the certificate key of "kubeadm init phase upload-certs".
+// Other sha256 sums like image digests and snapshot checksums are no
+// secrets and stay visible.
+var redactPatterns = []redactPattern{
+	{regexp.MustCompile(`(-----BEGIN [A-Z0-9 ]+-----)[\s\S]*?(-----END [A-Z0-9 ]+-----)`), "${1}" + redacted + "${2}"},
+	{regexp.MustCompile(`((?:client-key-data|client-certificate-data|token|password|secretkey)["']?\s*[:=]\s*["']?)[^\s"'\]},]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(--(?:token|discovery-token|tls-bootstrap-token|certificate-key)[ =])[^\s"'\]},]+`), "${1}" + redacted},
+	{regexp.MustCompile(`\b[a-z0-9]{6}\.[a-z0-9]{16}\b`), redacted},
+	{regexp.MustCompile(`(--discovery-token-ca-cert-hash[ =]sha256:)[a-fA-F0-9]{64}`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(certificate key:(?:\s|\\n)*)[a-f0-9]{64}`), "${1}" + redacted},
+}
+
+// Redact masks all secrets in text, which should not end in logs or
+// messages to the client.
+func Redact(text string) string {
+	for _, pattern := range redactPatterns {
+		text = pattern.re.ReplaceAllString(text, pattern.repl)
+	}
+	return text
+}
+
+// RedactFormatter masks secrets in every log message and in all string
+// fields before they are passed to Formatter.
+type RedactFormatter struct {
+	log.Formatter
+}
+
+func (f *RedactFormatter) Format(entry *log.Entry) ([]byte, error) {
+	masked := *entry
+	masked.Message = Redact(entry.Message)
+	masked.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if text, ok := value.(string); ok {
+			value = Redact(text)
+		}
+		masked.Data[key] = value
+	}
+	return f.Formatter.Format(&masked)
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Step types, every type has it's own timeout and retry policy
+const (
+	StepPing    = "ping"
+	StepService = "service"
+	StepJoin    = "join"
+	StepDrain   = "drain"
+	StepReboot  = "reboot"
+	StepKubeadm = "kubeadm"
+)
+
+// StepPolicy defines how long a step may run and how often it is
+// retried after a failure. The delay between two attempts starts with
+// Backoff and is doubled after every attempt. A Timeout of 0 means
+// no timeout.
+type StepPolicy struct {
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+}
+
+// RetryPolicy contains the StepPolicy for every step type
+type RetryPolicy map[string]StepPolicy
+
+// AttemptFunc gets called for every failed attempt, which will be retried
+type AttemptFunc func(message string)
+
+type retryPolicyKey struct{}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		StepPing:    {Timeout: 1 * time.Minute, Retries: 2, Backoff: 5 * time.Second},
+		StepService: {Timeout: 2 * time.Minute, Retries: 2, Backoff: 5 * time.Second},
+		StepJoin:    {Timeout: 10 * time.Minute, Retries: 1, Backoff: 30 * time.Second},
+		StepDrain:   {Timeout: 10 * time.Minute, Retries: 1, Backoff: 30 * time.Second},
+		StepReboot:  {Timeout: 5 * time.Minute, Retries: 1, Backoff: 10 * time.Second},
+		StepKubeadm: {Timeout: 30 * time.Minute, Retries: 0, Backoff: 30 * time.Second},
+	}
+}
+
+// Copy returns a copy of the policy, which can be modified
+func (p RetryPolicy) Copy() RetryPolicy {
+	policy := RetryPolicy{}
+	for step, value := range p {
+		policy[step] = value
+	}
+	return policy
+}
+
+// Set changes one setting of a step, key is "timeout", "retries"
+// or "backoff".
+func (p RetryPolicy) Set(step string, key string, value string) error {
+	policy, ok := p[step]
+	if !ok {
+		return fmt.Errorf("Unknown step '%s', valid values are %s", step, strings.Join(p.steps(), ", "))
+	}
+
+	switch key {
+	case "timeout", "backoff":
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s for step '%s': %v", key, step, err)
+		}
+		if duration < 0 {
+			return fmt.Errorf("Invalid %s for step '%s': negative duration", key, step)
+		}
+		if key == "timeout" {
+			policy.Timeout = duration
+		} else {
+			policy.Backoff = duration
+		}
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("Invalid retries for step '%s': '%s'", step, value)
+		}
+		policy.Retries = retries
+	default:
+		return fmt.Errorf("Unknown setting '%s', valid values are timeout, retries and backoff", key)
+	}
+	p[step] = policy
+	return nil
+}
+
+// Parse applies a list of overrides in the form "step.key=value",
+// e.g. "join.retries=3".
+func (p RetryPolicy) Parse(overrides []string) error {
+	for _, entry := range overrides {
+		setting := strings.SplitN(entry, "=", 2)
+		name := strings.SplitN(strings.TrimSpace(setting[0]), ".", 2)
+		if len(setting) != 2 || len(name) != 2 {
+			return errors.New("Invalid policy '" + entry + "', expected step.key=value")
+		}
+		if err := p.Set(name[0], name[1], strings.TrimSpace(setting[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p RetryPolicy) steps() []string {
+	var steps []string
+	for step := range p {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	return steps
+}
+
+// WithRetryPolicy returns a copy of ctx, which carries policy
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+// StepPolicyFrom returns the policy of step from ctx. If ctx does not
+// carry a policy, the default is used.
+func StepPolicyFrom(ctx context.Context, step string) StepPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		if stepPolicy, ok := policy[step]; ok {
+			return stepPolicy
+		}
+	}
+	return DefaultRetryPolicy()[step]
+}
+
+// RetryStep runs fn with the timeout of step and retries it as long as
+// it fails and the policy allows it. Every failed attempt, which gets
+// retried, is reported.
+func RetryStep(ctx context.Context, step string, report AttemptFunc, fn func(ctx context.Context) (bool, string)) (bool, string) {
+	return retryStep(ctx, step, StepPolicyFrom(ctx, step), report, fn)
+}
+
+func retryStep(ctx context.Context, step string, policy StepPolicy, report AttemptFunc, fn func(ctx context.Context) (bool, string)) (bool, string) {
+	backoff := policy.Backoff
+	attempts := policy.Retries + 1
+
+	for attempt := 1; ; attempt++ {
+		success, message := runStep(ctx, step, policy.Timeout, fn)
+		if success == true || ctx.Err() != nil {
+			return success, message
+		}
+		if attempt >= attempts {
+			if attempts > 1 {
+				message = fmt.Sprintf("%s (giving up after %d attempts)", strings.TrimSpace(message), attempts)
+			}
+			return success, message
+		}
+
+		status := fmt.Sprintf("%s attempt %d/%d failed: %s, retrying in %s",
+			step, attempt, attempts, strings.TrimSpace(message), backoff)
+		log.Warn(status)
+		if report != nil {
+			report(status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, message
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+	}
+}
+
+func runStep(ctx context.Context, step string, timeout time.Duration, fn func(ctx context.Context) (bool, string)) (bool, string) {
+	if timeout == 0 {
+		return fn(ctx)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	success, message := fn(stepCtx)
+	if success != true && ctx.Err() == nil && stepCtx.Err() == context.DeadlineExceeded {
+		message = fmt.Sprintf("%s timed out after %s", step, timeout)
+	}
+	return success, message
+}
+
+// PingNodes pings target. Minions, which did not answer, are pinged
+// again as long as the ping policy allows it.
+func PingNodes(ctx context.Context, executor NodeExecutor, target string, report AttemptFunc) (SaltResults, error) {
+	var results SaltResults
+	var pingErr error
+
+	pending := target
+	success, message := RetryStep(ctx, StepPing, report, func(ctx context.Context) (bool, string) {
+		pinged, err := executor.Ping(ctx, pending)
+		if err != nil {
+			pingErr = err
+			return false, err.Error()
+		}
+		pingErr = nil
+		if results == nil {
+			results = pinged
+		} else {
+			for minion, result := range pinged {
+				results[minion] = result
+			}
+		}
+
+		failed := results.Failed()
+		if len(failed) == 0 {
+			return true, ""
+		}
+		pending = strings.Join(failed, ",")
+		return false, "not reachable: " + pending
+	})
+	if pingErr != nil {
+		return nil, pingErr
+	}
+	if results == nil && success != true {
+		return nil, errors.New(message)
+	}
+	return results, nil
+}
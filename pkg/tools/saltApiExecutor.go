@@ -0,0 +1,390 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SaltAPIExecutor reaches the nodes via salt-api (rest_cherrypy or
+// rest_tornado). Jobs are started asynchronous and polled until all
+// targeted minions did return. Commands for the local machine are
+// run directly.
+type SaltAPIExecutor struct {
+	URL      string
+	Username string
+	Password string
+	Eauth    string
+	// Timeout is the maximum time to wait for a job to finish
+	Timeout time.Duration
+	// PollInterval is the time between two job status requests
+	PollInterval time.Duration
+	Client       *http.Client
+
+	local LocalExecutor
+	mu    sync.Mutex
+	token string
+}
+
+func NewSaltAPIExecutor(url string, username string, password string, eauth string) *SaltAPIExecutor {
+	if len(eauth) == 0 {
+		eauth = "pam"
+	}
+	return &SaltAPIExecutor{
+		URL:          strings.TrimSuffix(url, "/"),
+		Username:     username,
+		Password:     password,
+		Eauth:        eauth,
+		Timeout:      time.Hour,
+		PollInterval: time.Second,
+		Client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// SetCAFile configures the CA used to verify the certificate of salt-api
+func (s *SaltAPIExecutor) SetCAFile(caFile string) error {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		return errors.New("Cannot parse CA certificates in " + caFile)
+	}
+	s.Client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: certPool},
+	}
+	return nil
+}
+
+// login requests a new token, if the current one is the same as
+// expired. Else another request did already login again.
+func (s *SaltAPIExecutor) login(ctx context.Context, expired string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.token) > 0 && s.token != expired {
+		return s.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"username": s.Username,
+		"password": s.Password,
+		"eauth":    s.Eauth,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL+"/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("salt-api login failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Return []struct {
+			Token string `json:"token"`
+		} `json:"return"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("salt-api login failed: %v", err)
+	}
+	if len(result.Return) == 0 || len(result.Return[0].Token) == 0 {
+		return "", errors.New("salt-api login failed: no token returned")
+	}
+	s.token = result.Return[0].Token
+	return s.token, nil
+}
+
+// request sends a request to salt-api and decodes the json answer
+// into result. If the token is missing or expired, login again.
+func (s *SaltAPIExecutor) request(ctx context.Context, method string, path string, lowstate interface{}, result interface{}) error {
+	var body []byte
+	var err error
+
+	if lowstate != nil {
+		body, err = json.Marshal(lowstate)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+
+	for retry := 0; retry < 2; retry++ {
+		if len(token) == 0 || retry > 0 {
+			token, err = s.login(ctx, token)
+			if err != nil {
+				return err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, s.URL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+
+		resp, err := s.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("salt-api %s %s failed: %s", method, path, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		return err
+	}
+	return errors.New("salt-api: authentication failed")
+}
+
+// runJob starts fun asynchronous on all minions matching target and waits
+// until all of them did return or the timeout is reached. Minions, which
+// did not return in time, are reported as failed. If ctx is done, the
+// job is killed on the minions.
+func (s *SaltAPIExecutor) runJob(ctx context.Context, target string, targetType string, fun string, arg ...string) (SaltResults, error) {
+	if arg == nil {
+		arg = []string{}
+	}
+	lowstate := []map[string]interface{}{{
+		"client":   "local_async",
+		"tgt":      target,
+		"tgt_type": targetType,
+		"fun":      fun,
+		"arg":      arg,
+	}}
+
+	log.Infof("Executing via salt-api on %s: %s %v", target, fun, arg)
+
+	var job struct {
+		Return []struct {
+			Jid     string   `json:"jid"`
+			Minions []string `json:"minions"`
+		} `json:"return"`
+	}
+	if err := s.request(ctx, "POST", "/minions", lowstate, &job); err != nil {
+		return nil, err
+	}
+	if len(job.Return) == 0 || len(job.Return[0].Jid) == 0 {
+		// No minions matched the target
+		return make(SaltResults), nil
+	}
+	jid := job.Return[0].Jid
+	minions := job.Return[0].Minions
+
+	deadline := time.Now().Add(s.Timeout)
+	for {
+		var status struct {
+			Info []struct {
+				Minions []string    `json:"Minions"`
+				Result  SaltResults `json:"Result"`
+			} `json:"info"`
+		}
+		if err := s.request(ctx, "GET", "/jobs/"+jid, nil, &status); err != nil {
+			if ctx.Err() != nil {
+				s.killJob(jid, minions)
+			}
+			return nil, err
+		}
+		results := make(SaltResults)
+		if len(status.Info) > 0 {
+			if len(status.Info[0].Minions) > 0 {
+				minions = status.Info[0].Minions
+			}
+			if status.Info[0].Result != nil {
+				results = status.Info[0].Result
+			}
+		}
+		var missing []string
+		for _, minion := range minions {
+			if _, ok := results[minion]; !ok {
+				missing = append(missing, minion)
+			}
+		}
+		if len(missing) == 0 || time.Now().After(deadline) {
+			for _, minion := range missing {
+				results[minion] = &SaltResult{
+					Return:  json.RawMessage(`"Minion did not return. [No response]"`),
+					Retcode: 1,
+				}
+			}
+			for _, result := range results {
+				if strings.HasPrefix(fun, "state.") && stateFailed(result.Return) {
+					result.Retcode = 2
+				}
+			}
+			return results, nil
+		}
+		select {
+		case <-ctx.Done():
+			s.killJob(jid, minions)
+			return nil, ctx.Err()
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+// killJob aborts a running job on the minions. The request context is
+// already done, so use a new one.
+func (s *SaltAPIExecutor) killJob(jid string, minions []string) {
+	if len(minions) == 0 {
+		return
+	}
+	log.Infof("Killing salt job %s on %v", jid, minions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	lowstate := []map[string]interface{}{{
+		"client":   "local",
+		"tgt":      minions,
+		"tgt_type": "list",
+		"fun":      "saltutil.kill_job",
+		"arg":      []string{jid},
+	}}
+	var result interface{}
+	if err := s.request(ctx, "POST", "/", lowstate, &result); err != nil {
+		log.Errorf("Killing salt job %s failed: %v", jid, err)
+	}
+}
+
+// call fun on exactly one node
+func (s *SaltAPIExecutor) callNode(ctx context.Context, node string, fun string, arg ...string) (bool, *SaltResult, string) {
+	results, err := s.runJob(ctx, node, "glob", fun, arg...)
+	if err != nil {
+		log.Errorf("Error invoking %s on %s: %v", fun, node, err)
+		return false, nil, "Error invoking " + fun + ": " + err.Error()
+	}
+	return nodeResult(results, node, fun)
+}
+
+func (s *SaltAPIExecutor) Run(ctx context.Context, node string, command string, arg ...string) (bool, string) {
+	return s.RunStream(ctx, node, nil, command, arg...)
+}
+
+// RunStream relays the output of remote commands first after
+// cmd.run_all did return, salt does not report partial output.
+func (s *SaltAPIExecutor) RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string) {
+	if len(node) == 0 {
+		return s.local.RunStream(ctx, node, output, command, arg...)
+	}
+	if len(arg) > 0 {
+		command = command + " " + strings.Join(arg, " ")
+	}
+	success, result, message := s.callNode(ctx, node, "cmd.run_all", command)
+	if success != true {
+		return success, message
+	}
+	return runAllResult(node, strings.Fields(command)[0], result, output)
+}
+
+func (s *SaltAPIExecutor) Call(ctx context.Context, node string, function string, arg ...string) (bool, string) {
+	if len(node) == 0 {
+		return s.local.Call(ctx, node, function, arg...)
+	}
+	success, result, message := s.callNode(ctx, node, function, arg...)
+	if success != true {
+		return success, message
+	}
+	return callOutput(node, result)
+}
+
+func (s *SaltAPIExecutor) ServiceStart(ctx context.Context, node string, service string) (bool, string) {
+	return s.Call(ctx, node, "service.start", service)
+}
+
+func (s *SaltAPIExecutor) ServiceEnable(ctx context.Context, node string, service string) (bool, string) {
+	return s.Call(ctx, node, "service.enable", service)
+}
+
+func (s *SaltAPIExecutor) GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string) {
+	return s.Call(ctx, node, "grains.append", key, value)
+}
+
+func (s *SaltAPIExecutor) GetHostname(ctx context.Context, node string) (string, error) {
+	if len(node) == 0 {
+		return s.local.GetHostname(ctx, node)
+	}
+	success, result, message := s.callNode(ctx, node, "network.get_hostname")
+	if success != true {
+		return node, errors.New(message)
+	}
+	return strings.TrimSpace(result.String()), nil
+}
+
+func (s *SaltAPIExecutor) FileExists(ctx context.Context, node string, path string) (bool, error) {
+	if len(node) == 0 {
+		return s.local.FileExists(ctx, node, path)
+	}
+	success, result, message := s.callNode(ctx, node, "file.access", path, "f")
+	if success != true {
+		return false, errors.New(message)
+	}
+	return result.Bool(), nil
+}
+
+func (s *SaltAPIExecutor) Ping(ctx context.Context, target string) (SaltResults, error) {
+	targetType := "glob"
+	// Differentiate between 'name1,name2' and 'name[1,2]'
+	if strings.Index(target, ",") >= 0 && strings.Index(target, "[") == -1 {
+		targetType = "list"
+	}
+	results, err := s.runJob(ctx, target, targetType, "test.ping")
+	if err != nil {
+		return nil, err
+	}
+	return pingResults(results), nil
+}
+
+func (s *SaltAPIExecutor) GrainMatch(ctx context.Context, key string, value string) (SaltResults, error) {
+	results, err := s.runJob(ctx, key+":"+value, "grain", "test.ping")
+	if err != nil {
+		return nil, err
+	}
+	return pingResults(results), nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSaltAPI is a minimal stand-in for rest_cherrypy. Jobs return
+// the configured result per minion after polls requests, minions
+// without result never return.
+type fakeSaltAPI struct {
+	mu      sync.Mutex
+	logins  int
+	token   string
+	polls   int
+	jobs    int
+	minions []string
+	results map[string]interface{}
+	// returnAfter is the number of /jobs requests before the results
+	// are reported
+	returnAfter int
+	lowstates   []map[string]interface{}
+	kills       []map[string]interface{}
+}
+
+func (f *fakeSaltAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/login" {
+		var creds map[string]string
+		json.NewDecoder(r.Body).Decode(&creds)
+		if creds["username"] != "kubic" || creds["password"] != "secret" || creds["eauth"] != "pam" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.logins++
+		f.token = fmt.Sprintf("token-%d", f.logins)
+		writeJSON(w, map[string]interface{}{
+			"return": []map[string]interface{}{{"token": f.token}},
+		})
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/minions":
+		var lowstate []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&lowstate)
+		f.lowstates = append(f.lowstates, lowstate...)
+		f.jobs++
+		writeJSON(w, map[string]interface{}{
+			"return": []map[string]interface{}{{
+				"jid":     fmt.Sprintf("2021%d", f.jobs),
+				"minions": f.minions,
+			}},
+		})
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/jobs/"):
+		f.polls++
+		result := map[string]interface{}{}
+		if f.polls > f.returnAfter {
+			for minion, ret := range f.results {
+				// like the minion, report the exit status of cmd.run_all
+				// also as retcode of the job
+				retcode := 0
+				if runAll, ok := ret.(map[string]interface{}); ok {
+					if code, ok := runAll["retcode"].(int); ok {
+						retcode = code
+					}
+				}
+				result[minion] = map[string]interface{}{"return": ret, "retcode": retcode, "success": true}
+			}
+		}
+		writeJSON(w, map[string]interface{}{
+			"info": []map[string]interface{}{{"Minions": f.minions, "Result": result}},
+		})
+	case r.Method == "POST" && r.URL.Path == "/":
+		var lowstate []map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&lowstate)
+		f.kills = append(f.kills, lowstate...)
+		writeJSON(w, map[string]interface{}{"return": []interface{}{}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// expire invalidates the current token like a restart of salt-api
+func (f *fakeSaltAPI) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = "expired"
+}
+
+func (f *fakeSaltAPI) count() (logins int, jobs int, polls int, kills int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins, f.jobs, f.polls, len(f.kills)
+}
+
+func newFakeSaltAPI(t *testing.T, api *fakeSaltAPI) *SaltAPIExecutor {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	executor := NewSaltAPIExecutor(server.URL+"/", "kubic", "secret", "")
+	executor.PollInterval = 10 * time.Millisecond
+	executor.Timeout = 5 * time.Second
+	return executor
+}
+
+func TestSaltAPILoginAndTokenReuse(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"worker1"},
+		results: map[string]interface{}{"worker1": "worker1.example.com"},
+	}
+	executor := newFakeSaltAPI(t, api)
+
+	for i := 0; i < 3; i++ {
+		hostname, err := executor.GetHostname(context.Background(), "worker1")
+		if err != nil {
+			t.Fatalf("GetHostname failed: %v", err)
+		}
+		if hostname != "worker1.example.com" {
+			t.Errorf("got hostname %q", hostname)
+		}
+	}
+	if logins, jobs, _, _ := api.count(); logins != 1 || jobs != 3 {
+		t.Errorf("got %d logins for %d jobs, want 1 login for 3 jobs", logins, jobs)
+	}
+	if fun := api.lowstates[0]["fun"]; fun != "network.get_hostname" {
+		t.Errorf("got function %v", fun)
+	}
+	if client := api.lowstates[0]["client"]; client != "local_async" {
+		t.Errorf("got client %v", client)
+	}
+}
+
+func TestSaltAPILoginFailure(t *testing.T) {
+	api := &fakeSaltAPI{minions: []string{"worker1"}}
+	executor := newFakeSaltAPI(t, api)
+	executor.Password = "wrong"
+
+	success, message := executor.Run(context.Background(), "worker1", "true")
+	if success {
+		t.Fatalf("Run succeeded with wrong password")
+	}
+	if !strings.Contains(message, "login failed") {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func TestSaltAPIReloginAfter401(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"worker1"},
+		results: map[string]interface{}{"worker1": true},
+	}
+	executor := newFakeSaltAPI(t, api)
+
+	if _, err := executor.FileExists(context.Background(), "worker1", "/etc/kubernetes/kubelet.conf"); err != nil {
+		t.Fatalf("FileExists failed: %v", err)
+	}
+	api.expire()
+	exists, err := executor.FileExists(context.Background(), "worker1", "/etc/kubernetes/kubelet.conf")
+	if err != nil {
+		t.Fatalf("FileExists after token expiry failed: %v", err)
+	}
+	if !exists {
+		t.Errorf("FileExists returned false")
+	}
+	if logins, _, _, _ := api.count(); logins != 2 {
+		t.Errorf("got %d logins, want 2", logins)
+	}
+}
+
+func TestSaltAPIAsyncJobPolling(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"master1"},
+		results: map[string]interface{}{
+			"master1": map[string]interface{}{
+				"retcode": 0,
+				"stdout":  "line 1\nline 2\n",
+				"stderr":  "",
+			},
+		},
+		returnAfter: 3,
+	}
+	executor := newFakeSaltAPI(t, api)
+
+	var lines []string
+	success, message := executor.RunStream(context.Background(), "master1",
+		func(line string) { lines = append(lines, line) },
+		"kubeadm", "upgrade", "apply", "v1.23.1", "--yes")
+	if !success {
+		t.Fatalf("RunStream failed: %s", message)
+	}
+	if message != "line 1\nline 2\n" {
+		t.Errorf("got message %q", message)
+	}
+	if strings.Join(lines, "|") != "line 1|line 2" {
+		t.Errorf("got output %q", lines)
+	}
+	if _, jobs, polls, _ := api.count(); jobs != 1 || polls != 4 {
+		t.Errorf("got %d jobs and %d polls, want 1 job and 4 polls", jobs, polls)
+	}
+	lowstate := api.lowstates[0]
+	if lowstate["fun"] != "cmd.run_all" || lowstate["tgt"] != "master1" {
+		t.Errorf("unexpected lowstate %v", lowstate)
+	}
+	if arg, ok := lowstate["arg"].([]interface{}); !ok || len(arg) != 1 || arg[0] != "kubeadm upgrade apply v1.23.1 --yes" {
+		t.Errorf("unexpected arguments %v", lowstate["arg"])
+	}
+}
+
+func TestSaltAPIRunFailure(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"worker1"},
+		results: map[string]interface{}{
+			"worker1": map[string]interface{}{
+				"pid":     4711,
+				"retcode": 1,
+				"stdout":  "",
+				"stderr":  "error execution phase preflight\n",
+			},
+		},
+	}
+	executor := newFakeSaltAPI(t, api)
+
+	success, message := executor.Run(context.Background(), "worker1", "kubeadm", "join")
+	if success {
+		t.Fatalf("Run succeeded")
+	}
+	if message != "Error invoking cmd.run_all on worker1: exit status 1\n(error execution phase preflight)" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func TestSaltAPIMinionTimeout(t *testing.T) {
+	api := &fakeSaltAPI{
+		minions: []string{"worker1", "worker2"},
+		results: map[string]interface{}{"worker1": true},
+	}
+	executor := newFakeSaltAPI(t, api)
+	executor.Timeout = 100 * time.Millisecond
+
+	results, err := executor.Ping(context.Background(), "worker1,worker2")
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if succeeded := results.Succeeded(); len(succeeded) != 1 || succeeded[0] != "worker1" {
+		t.Errorf("got succeeded minions %v", succeeded)
+	}
+	if failed := results.Failed(); len(failed) != 1 || failed[0] != "worker2" {
+		t.Errorf("got failed minions %v", failed)
+	}
+	if !strings.Contains(results.FailedMessage(), "did not return") {
+		t.Errorf("unexpected message %q", results.FailedMessage())
+	}
+	if tgtType := api.lowstates[0]["tgt_type"]; tgtType != "list" {
+		t.Errorf("got target type %v", tgtType)
+	}
+	if _, _, _, kills := api.count(); kills != 0 {
+		t.Errorf("got %d kill requests after timeout", kills)
+	}
+}
+
+func TestSaltAPICancelKillsJob(t *testing.T) {
+	api := &fakeSaltAPI{minions: []string{"worker1"}}
+	executor := newFakeSaltAPI(t, api)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		success, _ := executor.Run(ctx, "worker1", "sleep", "3600")
+		done <- success
+	}()
+
+	for {
+		if _, _, polls, _ := api.count(); polls > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case success := <-done:
+		if success {
+			t.Errorf("Run succeeded after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after cancel")
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.kills) != 1 {
+		t.Fatalf("got %d kill requests, want 1", len(api.kills))
+	}
+	kill := api.kills[0]
+	if kill["fun"] != "saltutil.kill_job" || kill["tgt_type"] != "list" {
+		t.Errorf("unexpected kill request %v", kill)
+	}
+	if arg, ok := kill["arg"].([]interface{}); !ok || len(arg) != 1 || arg[0] != "20211" {
+		t.Errorf("kill request for wrong job: %v", kill["arg"])
+	}
+}
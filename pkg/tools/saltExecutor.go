@@ -0,0 +1,239 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SaltExecutor reaches the nodes via the salt command line tool. Commands
+// for the local machine are run directly.
+type SaltExecutor struct {
+	local LocalExecutor
+}
+
+func NewSaltExecutor() *SaltExecutor {
+	return &SaltExecutor{}
+}
+
+// executeSalt calls fun on all minions matching target and decodes the
+// json output. The exit code of salt is only used if there is no valid
+// output, errors are reported per minion.
+// If ctx is done, the salt command is killed. The job on the minions
+// is not aborted by this.
+func executeSalt(ctx context.Context, target []string, fun string, arg ...string) (SaltResults, error) {
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+
+	args := append([]string{"--module-executors='direct_call'", "--out=json", "--static"}, target...)
+	args = append(args, fun)
+	args = append(args, arg...)
+
+	cmd := exec.CommandContext(ctx, "salt", args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	log.Infof("Executing %s: %v", cmd.Path, cmd.Args)
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		log.Errorf("Error invoking salt: %v", ctx.Err())
+		return nil, errors.New("Error invoking salt: " + ctx.Err().Error())
+	}
+	if strings.HasPrefix(out.String(), "No minions matched the target") {
+		return make(SaltResults), nil
+	}
+	results, parseErr := ParseSaltJSON(fun, out.Bytes())
+	if parseErr != nil {
+		if err != nil {
+			message := strings.TrimSpace(stderr.String() + "\n" + parseErr.Error())
+			log.Error("Error invoking salt: " + fmt.Sprint(err) + "\n" + message)
+			return nil, errors.New("Error invoking salt: " + err.Error() + "\n(" + message + ")")
+		}
+		return nil, parseErr
+	}
+	log.Info(out.String())
+	return results, nil
+}
+
+// call fun on exactly one node
+func (s *SaltExecutor) callNode(ctx context.Context, node string, fun string, arg ...string) (bool, *SaltResult, string) {
+	results, err := executeSalt(ctx, []string{node}, fun, arg...)
+	if err != nil {
+		return false, nil, err.Error()
+	}
+	return nodeResult(results, node, fun)
+}
+
+// nodeResult returns the result of node and an error message, if it
+// failed. For failed commands of cmd.run_all the message contains the
+// exit status and stderr.
+func nodeResult(results SaltResults, node string, fun string) (bool, *SaltResult, string) {
+	result, ok := results[node]
+	if !ok {
+		return false, nil, "Error invoking " + fun + ": no result from " + node
+	}
+	if result.Failed() {
+		var ret struct {
+			Stderr *string `json:"stderr"`
+		}
+		if err := result.Decode(&ret); err == nil && ret.Stderr != nil {
+			return false, result, fmt.Sprintf("Error invoking %s on %s: exit status %d\n(%s)",
+				fun, node, result.Retcode, strings.TrimSuffix(*ret.Stderr, "\n"))
+		}
+		return false, result, "Error invoking " + fun + " on " + node + ": " + result.Error().Error()
+	}
+	return true, result, ""
+}
+
+// callOutput returns the result in the same format as "salt --out=json"
+func callOutput(node string, result *SaltResult) (bool, string) {
+	output, err := json.Marshal(map[string]json.RawMessage{node: result.Return})
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, string(output)
+}
+
+// runAllResult evaluates the return of cmd.run_all and returns the
+// output of the command or the error message. If output is not nil,
+// stdout and stderr are passed to it.
+func runAllResult(node string, command string, result *SaltResult, output OutputFunc) (bool, string) {
+	var ret struct {
+		Retcode int    `json:"retcode"`
+		Stdout  string `json:"stdout"`
+		Stderr  string `json:"stderr"`
+	}
+	if err := result.Decode(&ret); err != nil {
+		return false, "Error invoking " + command + " on " + node + ": " + err.Error()
+	}
+	outputLines(output, ret.Stdout)
+	outputLines(output, ret.Stderr)
+	if ret.Retcode != 0 {
+		result.Retcode = ret.Retcode
+		log.Errorf("Error invoking %s on %s: exit status %d\n%s", command, node, ret.Retcode, ret.Stderr)
+		return false, fmt.Sprintf("Error invoking %s on %s: exit status %d\n(%s)",
+			command, node, ret.Retcode, strings.TrimSuffix(ret.Stderr, "\n"))
+	}
+	return true, ret.Stdout
+}
+
+// targetList converts the target into salt command line arguments.
+// Differentiate between 'name1,name2' and 'name[1,2]'
+func targetList(target string) []string {
+	if strings.Index(target, ",") >= 0 && strings.Index(target, "[") == -1 {
+		return []string{"-L", target}
+	}
+	return []string{target}
+}
+
+func (s *SaltExecutor) Run(ctx context.Context, node string, command string, arg ...string) (bool, string) {
+	return s.RunStream(ctx, node, nil, command, arg...)
+}
+
+// RunStream relays the output of remote commands first after
+// cmd.run_all did return, salt does not report partial output.
+func (s *SaltExecutor) RunStream(ctx context.Context, node string, output OutputFunc, command string, arg ...string) (bool, string) {
+	if len(node) == 0 {
+		return s.local.RunStream(ctx, node, output, command, arg...)
+	}
+	if len(arg) > 0 {
+		command = command + " " + strings.Join(arg, " ")
+	}
+	success, result, message := s.callNode(ctx, node, "cmd.run_all", command)
+	if success != true {
+		return success, message
+	}
+	return runAllResult(node, strings.Fields(command)[0], result, output)
+}
+
+func (s *SaltExecutor) Call(ctx context.Context, node string, function string, arg ...string) (bool, string) {
+	if len(node) == 0 {
+		return s.local.Call(ctx, node, function, arg...)
+	}
+	success, result, message := s.callNode(ctx, node, function, arg...)
+	if success != true {
+		return success, message
+	}
+	return callOutput(node, result)
+}
+
+func (s *SaltExecutor) ServiceStart(ctx context.Context, node string, service string) (bool, string) {
+	return s.Call(ctx, node, "service.start", service)
+}
+
+func (s *SaltExecutor) ServiceEnable(ctx context.Context, node string, service string) (bool, string) {
+	return s.Call(ctx, node, "service.enable", service)
+}
+
+func (s *SaltExecutor) GrainsAppend(ctx context.Context, node string, key string, value string) (bool, string) {
+	return s.Call(ctx, node, "grains.append", key, value)
+}
+
+func (s *SaltExecutor) GetHostname(ctx context.Context, node string) (string, error) {
+	if len(node) == 0 {
+		return s.local.GetHostname(ctx, node)
+	}
+	success, result, message := s.callNode(ctx, node, "network.get_hostname")
+	if success != true {
+		return node, errors.New(message)
+	}
+	return strings.TrimSpace(result.String()), nil
+}
+
+func (s *SaltExecutor) FileExists(ctx context.Context, node string, path string) (bool, error) {
+	if len(node) == 0 {
+		return s.local.FileExists(ctx, node, path)
+	}
+	success, result, message := s.callNode(ctx, node, "file.access", path, "f")
+	if success != true {
+		return false, errors.New(message)
+	}
+	return result.Bool(), nil
+}
+
+// test.ping returns true for every reachable minion
+func pingResults(results SaltResults) SaltResults {
+	for _, result := range results {
+		if !result.Failed() && !result.Bool() {
+			result.Retcode = 1
+		}
+	}
+	return results
+}
+
+func (s *SaltExecutor) Ping(ctx context.Context, target string) (SaltResults, error) {
+	results, err := executeSalt(ctx, targetList(target), "test.ping")
+	if err != nil {
+		return nil, err
+	}
+	return pingResults(results), nil
+}
+
+func (s *SaltExecutor) GrainMatch(ctx context.Context, key string, value string) (SaltResults, error) {
+	results, err := executeSalt(ctx, []string{"-G", key + ":" + value}, "test.ping")
+	if err != nil {
+		return nil, err
+	}
+	return pingResults(results), nil
+}
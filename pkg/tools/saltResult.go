@@ -0,0 +1,175 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// SaltResult is the return of one minion
+type SaltResult struct {
+	Return  json.RawMessage `json:"return"`
+	Retcode int             `json:"retcode"`
+	Success *bool           `json:"success,omitempty"`
+}
+
+// SaltResults maps the minion id to its result
+type SaltResults map[string]*SaltResult
+
+// Messages salt returns instead of the function result if something
+// went wrong on the minion
+var saltErrorPrefixes = []string{
+	"Minion did not return",
+	"ERROR",
+	"The minion function caused an exception",
+	"Passed invalid arguments",
+}
+
+func (r *SaltResult) Failed() bool {
+	return r.Retcode != 0 || (r.Success != nil && *r.Success == false)
+}
+
+// String returns the return value of the minion, strings are
+// returned as they are, everything else as json.
+func (r *SaltResult) String() string {
+	var value string
+	if err := json.Unmarshal(r.Return, &value); err == nil {
+		return value
+	}
+	return string(r.Return)
+}
+
+// Decode unmarshals the return value of the minion into v
+func (r *SaltResult) Decode(v interface{}) error {
+	return json.Unmarshal(r.Return, v)
+}
+
+// Bool returns true if the minion returned the boolean true
+func (r *SaltResult) Bool() bool {
+	var value bool
+	if err := r.Decode(&value); err != nil {
+		return false
+	}
+	return value
+}
+
+// Error returns the return value of a failed minion as error
+func (r *SaltResult) Error() error {
+	if !r.Failed() {
+		return nil
+	}
+	message := strings.TrimSpace(r.String())
+	if len(message) == 0 {
+		message = "failed without message"
+	}
+	return errors.New(message)
+}
+
+// Succeeded returns the sorted list of minions without error
+func (r SaltResults) Succeeded() []string {
+	var list []string
+	for minion, result := range r {
+		if !result.Failed() {
+			list = append(list, minion)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Failed returns the sorted list of minions, which reported an error
+// or did not return at all
+func (r SaltResults) Failed() []string {
+	var list []string
+	for minion, result := range r {
+		if result.Failed() {
+			list = append(list, minion)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Minions returns the sorted list of all minions
+func (r SaltResults) Minions() []string {
+	var list []string
+	for minion := range r {
+		list = append(list, minion)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// FailedMessage returns one line "minion: error" for every failed minion
+func (r SaltResults) FailedMessage() string {
+	var lines []string
+	for _, minion := range r.Failed() {
+		lines = append(lines, minion+": "+r[minion].Error().Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// state functions report failures in the result of every single state
+func stateFailed(raw json.RawMessage) bool {
+	var states map[string]struct {
+		Result *bool `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &states); err != nil {
+		return false
+	}
+	for _, state := range states {
+		if state.Result != nil && *state.Result == false {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSaltJSON decodes the output of "salt --out=json --static" for
+// the salt function fun. Since the salt command line does not report
+// return codes per minion, they are derived from the returned data.
+func ParseSaltJSON(fun string, output []byte) (SaltResults, error) {
+	var data map[string]json.RawMessage
+
+	if err := json.Unmarshal(output, &data); err != nil {
+		message := strings.TrimSpace(string(output))
+		if len(message) == 0 {
+			message = err.Error()
+		}
+		return nil, errors.New(message)
+	}
+
+	results := make(SaltResults)
+	for minion, raw := range data {
+		result := &SaltResult{Return: raw}
+
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			for _, prefix := range saltErrorPrefixes {
+				if strings.HasPrefix(value, prefix) {
+					result.Retcode = 1
+				}
+			}
+		}
+		if strings.HasPrefix(fun, "state.") && stateFailed(raw) {
+			result.Retcode = 2
+		}
+		results[minion] = result
+	}
+	return results, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSaltJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		fun    string
+		output string
+		// all minions, which succeeded and which failed
+		minions   string
+		succeeded string
+		failed    string
+		// FailedMessage
+		message string
+	}{
+		{
+			name: "ping",
+			fun:  "test.ping",
+			output: `{"worker2": true,
+				"master1": true,
+				"worker1": true}`,
+			minions:   "master1,worker1,worker2",
+			succeeded: "master1,worker1,worker2",
+		},
+		{
+			name: "minion did not return",
+			fun:  "test.ping",
+			output: `{"master1": true,
+				"worker1": "Minion did not return. [No response]",
+				"worker2": "Minion did not return. [Not connected]"}`,
+			minions:   "master1,worker1,worker2",
+			succeeded: "master1",
+			failed:    "worker1,worker2",
+			message:   "worker1: Minion did not return. [No response]\nworker2: Minion did not return. [Not connected]",
+		},
+		{
+			name: "errors",
+			fun:  "cmd.run",
+			output: `{"master1": "ERROR: Specified cwd '/nonexistent' either not absolute or does not exist",
+				"worker1": "The minion function caused an exception: Traceback",
+				"worker2": "Passed invalid arguments: run() missing 1 required positional argument: 'cmd'",
+				"worker3": "Linux"}`,
+			minions:   "master1,worker1,worker2,worker3",
+			succeeded: "worker3",
+			failed:    "master1,worker1,worker2",
+			message: "master1: ERROR: Specified cwd '/nonexistent' either not absolute or does not exist\n" +
+				"worker1: The minion function caused an exception: Traceback\n" +
+				"worker2: Passed invalid arguments: run() missing 1 required positional argument: 'cmd'",
+		},
+		{
+			// only strings are checked for error messages
+			name: "non-dict returns",
+			fun:  "grains.get",
+			output: `{"master1": ["kubic-master-node"],
+				"worker1": false,
+				"worker2": 42,
+				"worker3": null,
+				"worker4": ""}`,
+			minions:   "master1,worker1,worker2,worker3,worker4",
+			succeeded: "master1,worker1,worker2,worker3,worker4",
+		},
+		{
+			name: "state failed",
+			fun:  "state.apply",
+			output: `{"master1": {"file_|-kubelet_|-/etc/sysconfig/kubelet_|-managed": {"result": true, "comment": "File is in the correct state"}},
+				"worker1": {"file_|-kubelet_|-/etc/sysconfig/kubelet_|-managed": {"result": true},
+					"pkg_|-kubeadm_|-kubernetes-kubeadm_|-installed": {"result": false, "comment": "Package not found"}}}`,
+			minions:   "master1,worker1",
+			succeeded: "master1",
+			failed:    "worker1",
+			message:   `worker1: {"file_|-kubelet_|-/etc/sysconfig/kubelet_|-managed": {"result": true},`,
+		},
+		{
+			// other functions can return dicts with a result
+			name:      "dict with result",
+			fun:       "cmd.run_all",
+			output:    `{"worker1": {"x": {"result": false}}}`,
+			minions:   "worker1",
+			succeeded: "worker1",
+		},
+		{
+			name:   "no minion matched",
+			fun:    "test.ping",
+			output: `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, err := ParseSaltJSON(test.fun, []byte(test.output))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if minions := strings.Join(results.Minions(), ","); minions != test.minions {
+				t.Errorf("minions %s, expected %s", minions, test.minions)
+			}
+			if succeeded := strings.Join(results.Succeeded(), ","); succeeded != test.succeeded {
+				t.Errorf("succeeded %s, expected %s", succeeded, test.succeeded)
+			}
+			if failed := strings.Join(results.Failed(), ","); failed != test.failed {
+				t.Errorf("failed %s, expected %s", failed, test.failed)
+			}
+			if message := results.FailedMessage(); !strings.HasPrefix(message, test.message) || (test.message == "" && message != "") {
+				t.Errorf("failed message %q, expected %q", message, test.message)
+			}
+
+			for _, minion := range results.Succeeded() {
+				if err := results[minion].Error(); err != nil {
+					t.Errorf("%s succeeded with error %v", minion, err)
+				}
+			}
+			for _, minion := range results.Failed() {
+				if results[minion].Error() == nil {
+					t.Errorf("%s failed without error", minion)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSaltJSONInvalid(t *testing.T) {
+	for _, test := range []struct {
+		output  string
+		message string
+	}{
+		{output: "No minions matched the target. No command was sent, no jid was assigned.\n",
+			message: "No minions matched the target. No command was sent, no jid was assigned."},
+		{output: `["master1"]`, message: `["master1"]`},
+		{output: "", message: "unexpected end of JSON input"},
+	} {
+		results, err := ParseSaltJSON("test.ping", []byte(test.output))
+		if err == nil {
+			t.Errorf("%q parsed as %v", test.output, results)
+		} else if err.Error() != test.message {
+			t.Errorf("%q: error %q, expected %q", test.output, err, test.message)
+		}
+	}
+}
+
+func TestSaltResultValues(t *testing.T) {
+	results, err := ParseSaltJSON("cmd.run", []byte(`{"master1": "Linux\n", "worker1": true, "worker2": {"a": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := results["master1"].String(); value != "Linux\n" {
+		t.Errorf("string %q", value)
+	}
+	if !results["worker1"].Bool() || results["master1"].Bool() {
+		t.Errorf("bool of worker1 %v, master1 %v", results["worker1"].Bool(), results["master1"].Bool())
+	}
+	if value := results["worker2"].String(); value != `{"a": 1}` {
+		t.Errorf("string of a dict %q", value)
+	}
+	var dict map[string]int
+	if err := results["worker2"].Decode(&dict); err != nil || dict["a"] != 1 {
+		t.Errorf("decoded %v: %v", dict, err)
+	}
+
+	// failures from salt-api carry the retcode or success
+	failed := false
+	for _, result := range []*SaltResult{
+		{Return: []byte(`""`), Retcode: 1},
+		{Return: []byte(`"  "`), Success: &failed},
+	} {
+		if !result.Failed() {
+			t.Errorf("%s with retcode %d not failed", result.Return, result.Retcode)
+		} else if err := result.Error(); err == nil || err.Error() != "failed without message" {
+			t.Errorf("%s failed with %v", result.Return, err)
+		}
+	}
+}
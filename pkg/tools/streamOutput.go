@@ -0,0 +1,50 @@
+// Copyright 2021 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+// StatusSender is implemented by all server streams of StatusReply
+type StatusSender interface {
+	Send(*pb.StatusReply) error
+}
+
+// StreamOutput returns an OutputFunc, which sends every line to stream
+// as output of step on node.
+func StreamOutput(stream StatusSender, node string, step string) OutputFunc {
+	return func(line string) {
+		if err := stream.Send(&pb.StatusReply{Success: true, Output: true,
+			Node: node, Step: step, Message: line}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+	}
+}
+
+// StreamAttempts returns an AttemptFunc, which sends every failed
+// attempt of step on node to stream.
+func StreamAttempts(stream StatusSender, node string, step string) AttemptFunc {
+	return func(message string) {
+		if len(node) > 0 {
+			message = node + ": " + message
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true,
+			Node: node, Step: step, Message: message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+	}
+}
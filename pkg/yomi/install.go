@@ -15,11 +15,16 @@
 package yomi
 
 import (
+	"context"
+	"sort"
+	"strings"
+
 	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
+func Install(ctx context.Context, executor tools.NodeExecutor, in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
 
 	if err := stream.Send(&pb.StatusReply{Success: true,
 		Message: "Starting installation of " + in.Saltnode}); err != nil {
@@ -39,7 +44,7 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 	}
 
 	// make sure latest modules are used on minion
-	success, message := tools.ExecuteCmd("salt", "--module-executors='direct_call'", in.Saltnode, "saltutil.sync_all")
+	success, message := executor.Call(ctx, in.Saltnode, "saltutil.sync_all")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: message}); err != nil {
@@ -49,7 +54,7 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 	}
 
 	// wipe harddisk, else salt will not re-create them
-	success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", in.Saltnode, "state.apply", "yomi.storage.wipe")
+	success, message = executor.Call(ctx, in.Saltnode, "state.apply", "yomi.storage.wipe")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: message}); err != nil {
@@ -59,7 +64,7 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 	}
 
 	// Do final installation
-	success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", in.Saltnode, "state.sls", "yomi.installer")
+	success, message = executor.Call(ctx, in.Saltnode, "state.sls", "yomi.installer")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: message}); err != nil {
@@ -67,6 +72,7 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 		}
 		return nil
 	}
+	stateOutput(tools.StreamOutput(stream, in.Saltnode, "yomi.installer"), in.Saltnode, message)
 
 	if err := stream.Send(&pb.StatusReply{Success: true,
 		Message: "Node successful installed!"}); err != nil {
@@ -74,3 +80,43 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 	}
 	return nil
 }
+
+// stateOutput passes the result of every state in the order of execution
+// to output. Salt returns them only after all states did run.
+func stateOutput(output tools.OutputFunc, node string, message string) {
+	results, err := tools.ParseSaltJSON("state.sls", []byte(message))
+	if err != nil {
+		return
+	}
+	result, ok := results[node]
+	if !ok {
+		return
+	}
+	var states map[string]struct {
+		Name    string `json:"name"`
+		Result  *bool  `json:"result"`
+		Comment string `json:"comment"`
+		RunNum  int    `json:"__run_num__"`
+	}
+	if err := result.Decode(&states); err != nil {
+		return
+	}
+	ids := make([]string, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return states[ids[i]].RunNum < states[ids[j]].RunNum
+	})
+	for _, id := range ids {
+		state := states[id]
+		status := "ok"
+		if state.Result == nil {
+			status = "pending"
+		} else if *state.Result == false {
+			status = "failed"
+		}
+		comment := strings.SplitN(strings.TrimSpace(state.Comment), "\n", 2)[0]
+		output(status + ": " + state.Name + ": " + comment)
+	}
+}
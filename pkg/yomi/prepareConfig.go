@@ -15,7 +15,8 @@
 package yomi
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -51,7 +52,8 @@ func set_perm(path string) error {
 	return os.Chown(path, 0, gid)
 }
 
-func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServer) error {
+func PrepareConfig(ctx context.Context, executor tools.NodeExecutor, in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServer) error {
+	executor = tools.DryRunStream(executor, in.DryRun, stream)
 
 	if err := stream.Send(&pb.StatusReply{Success: true,
 		Message: "Prepare salt configuration for Node " + in.Saltnode + " as " + in.Type}); err != nil {
@@ -74,7 +76,7 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 	}
 
 	// make sure latest modules are used on minion
-	success, message := tools.ExecuteCmd("salt", "--module-executors='direct_call'", in.Saltnode, "saltutil.sync_all")
+	success, message := executor.Call(ctx, in.Saltnode, "saltutil.sync_all")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: false,
 			Message: message}); err != nil {
@@ -86,16 +88,8 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 	pillarName := Salt2PillarName(in.Saltnode)
 	pillarFile := "/srv/pillar/kubicd/" + pillarName + ".sls"
 
-	f, err := os.Create(pillarFile)
-	if err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Could not create \"" + pillarFile + "\": " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
-	}
-
-	_, err = f.WriteString("# Meta pillar for Yomi\n" +
+	var pillar strings.Builder
+	pillar.WriteString("# Meta pillar for Yomi\n" +
 		"#\n" +
 		"# There are some parameters that can be configured and adapted to\n" +
 		"# launch a basic Yomi installation:\n" +
@@ -106,19 +100,11 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 		"#   * repo-main = {https://download....}\n" +
 		"#\n" +
 		"\n")
-	if err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Writing to \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
-	}
 
 	useEfi := false
 	if in.Efi == 0 {
 		// UEFI or BIOS?
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", in.Saltnode, "cmd.run",
-			"test -f /sys/firmware/efi/systab && echo true || echo false")
+		success, message = executor.Run(ctx, in.Saltnode, "test -f /sys/firmware/efi/systab && echo true || echo false")
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false,
 				Message: message}); err != nil {
@@ -126,9 +112,7 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 			}
 			return nil
 		}
-		uefi := strings.Replace(message, "\n", "", -1)
-		i := strings.Index(uefi, ":") + 1
-		uefi = strings.TrimSpace(uefi[i:])
+		uefi := strings.TrimSpace(message)
 		log.Info("UEFI: " + uefi)
 		if strings.EqualFold(uefi, "true") {
 			useEfi = true
@@ -139,22 +123,15 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 		useEfi = true
 	}
 	if useEfi {
-		_, err = f.WriteString("{% set efi = True %}\n")
+		pillar.WriteString("{% set efi = True %}\n")
 	} else {
-		_, err = f.WriteString("{% set efi = False %}\n")
-	}
-	if err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Writing to \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
+		pillar.WriteString("{% set efi = False %}\n")
 	}
 
 	useBareMetal := false
 	if in.Baremetal == 0 {
 		// bare metal or virtualisation?
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=txt", in.Saltnode, "cmd.run", "systemd-detect-virt")
+		success, message = executor.Run(ctx, in.Saltnode, "systemd-detect-virt")
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false,
 				Message: message}); err != nil {
@@ -162,9 +139,7 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 			}
 			return nil
 		}
-		virtualisation := strings.Replace(message, "\n", "", -1)
-		i := strings.Index(virtualisation, ":") + 1
-		virtualisation = strings.TrimSpace(virtualisation[i:])
+		virtualisation := strings.TrimSpace(message)
 		log.Info("Virtualisation: " + virtualisation)
 		if strings.EqualFold(virtualisation, "none") {
 			useBareMetal = true
@@ -175,23 +150,16 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 		useBareMetal = true
 	}
 	if useBareMetal {
-		_, err = f.WriteString("{% set baremetal = True %}\n")
+		pillar.WriteString("{% set baremetal = True %}\n")
 	} else {
-		_, err = f.WriteString("{% set baremetal = False %}\n")
-	}
-	if err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Writing to \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
+		pillar.WriteString("{% set baremetal = False %}\n")
 	}
 
 	entry := ""
 	if len(in.Disk) > 0 {
 		entry = "{% set disk = '" + in.Disk + "' %}\n"
 	} else {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='direct_call'", "--out=json", in.Saltnode, "devices.hwinfo", "disk")
+		success, message = executor.Call(ctx, in.Saltnode, "devices.hwinfo", "disk")
 		if success != true {
 			if err := stream.Send(&pb.StatusReply{Success: false,
 				Message: message}); err != nil {
@@ -199,8 +167,19 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 			}
 			return nil
 		}
-		var hwinfo_all map[string]interface{}
-		err = json.Unmarshal([]byte(message), &hwinfo_all)
+		var hwinfo struct {
+			Hwinfo struct {
+				Disk map[string]string `json:"disk"`
+			} `json:"hwinfo"`
+		}
+		results, err := tools.ParseSaltJSON("devices.hwinfo", []byte(message))
+		if err == nil {
+			if result, ok := results[in.Saltnode]; ok {
+				err = result.Decode(&hwinfo)
+			} else {
+				err = errors.New(in.Saltnode + " did not return")
+			}
+		}
 		if err != nil {
 			if err2 := stream.Send(&pb.StatusReply{Success: false,
 				Message: "Detecting disks failed: " + err.Error()}); err2 != nil {
@@ -208,13 +187,11 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 			}
 			return nil
 		}
-		hwinfo_node := hwinfo_all[in.Saltnode].(map[string]interface{})
-		hwinfo := hwinfo_node["hwinfo"].(map[string]interface{})
-		hwinfo_disk := hwinfo["disk"].(map[string]interface{})
+		hwinfo_disk := hwinfo.Hwinfo.Disk
 		if len(hwinfo_disk) != 1 {
 			message = "Found more than one disk:\n"
 			for key, value := range hwinfo_disk {
-				message = message + "- " + key + " (" + value.(string) + ")\n"
+				message = message + "- " + key + " (" + value + ")\n"
 			}
 			if err := stream.Send(&pb.StatusReply{Success: false,
 				Message: message}); err != nil {
@@ -235,52 +212,31 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 		entry = entry + "{% set repo_main = 'http://download.opensuse.org/tumbleweed/repo/oss' %}"
 	}
 
-	_, err = f.WriteString(entry +
+	pillar.WriteString(entry +
 		"\n" +
 		"{% include \"kubicd/_haproxy.sls\" %}\n\n")
-	if err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Writing to \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
-	}
-
-	if err := f.Close(); err != nil {
-		if err2 := stream.Send(&pb.StatusReply{Success: false,
-			Message: "Closing \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
-			return err2
-		}
-		return nil
-	}
 
-	set_perm(pillarFile)
-
-	// Create top.sls if it does not exist, else add our entry
-	found, _ := tools.Exists("/srv/pillar/top.sls")
-	if !found {
-		f, err := os.Create("/srv/pillar/top.sls")
-		if err != nil {
-			message = "Could not create \"/srv/pillar/top.sls\": " + err.Error()
+	if !tools.DryRun(executor, "write "+pillarFile+":\n"+pillar.String()) {
+		if err := ioutil.WriteFile(pillarFile, []byte(pillar.String()), 0640); err != nil {
 			if err2 := stream.Send(&pb.StatusReply{Success: false,
-				Message: message}); err2 != nil {
+				Message: "Writing to \"" + pillarFile + "\" failed: " + err.Error()}); err2 != nil {
 				return err2
 			}
 			return nil
 		}
+		set_perm(pillarFile)
+	}
 
-		_, err = f.WriteString("base:\n" +
-			"  " + in.Saltnode + ":\n" +
-			"    - kubicd/" + pillarName + "\n" +
-			"\n")
-		if err := f.Close(); err != nil {
-			message = "Closing \"/srv/pillar/top.sls\" failed: " + err.Error()
-			if err2 := stream.Send(&pb.StatusReply{Success: false,
-				Message: message}); err2 != nil {
-				return err2
-			}
-			return nil
-		}
+	// Create top.sls if it does not exist, else add our entry
+	var newContent []string
+	write_pillar := false
+	found, _ := tools.Exists("/srv/pillar/top.sls")
+	if !found {
+		newContent = []string{"base:",
+			"  " + in.Saltnode + ":",
+			"    - kubicd/" + pillarName,
+			""}
+		write_pillar = true
 	} else {
 		// File exists,
 
@@ -299,10 +255,8 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 		/* func Split(s, sep string) []string */
 		temp := strings.Split(file, "\n")
 
-		var newContent []string
 		found_node := false
 		found_pillar := false
-		write_pillar := false
 		for _, item := range temp {
 			if found_node {
 				if strings.Contains(item, "    -") {
@@ -326,33 +280,14 @@ func PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServ
 			newContent = append(newContent, "    - kubicd/"+pillarName)
 			write_pillar = true
 		}
-		if write_pillar {
-			// Write back top.sls file
-			// XXX create backup of old file
-			f, err := os.Create("/srv/pillar/top.sls")
-			if err != nil {
-				message = "Could not create \"/srv/pillar/top.sls\": " + err.Error()
-				if err2 := stream.Send(&pb.StatusReply{Success: false,
-					Message: message}); err2 != nil {
-					return err2
-				}
-				return nil
-			}
-
-			for _, item := range newContent {
-				_, err = f.WriteString(item + "\n")
-				if err != nil {
-					message = "Writing to \"/srv/pillar/top.sls\" failed: " + err.Error()
-					if err2 := stream.Send(&pb.StatusReply{Success: false,
-						Message: message}); err2 != nil {
-						return err2
-					}
-					return nil
-				}
-
-			}
-			if err := f.Close(); err != nil {
-				message = "Closing \"/srv/pillar/top.sls\" failed: " + err.Error()
+	}
+	if write_pillar {
+		// Write back top.sls file
+		// XXX create backup of old file
+		content := strings.Join(newContent, "\n") + "\n"
+		if !tools.DryRun(executor, "write /srv/pillar/top.sls:\n"+content) {
+			if err := ioutil.WriteFile("/srv/pillar/top.sls", []byte(content), 0640); err != nil {
+				message = "Writing to \"/srv/pillar/top.sls\" failed: " + err.Error()
 				if err2 := stream.Send(&pb.StatusReply{Success: false,
 					Message: message}); err2 != nil {
 					return err2